@@ -0,0 +1,164 @@
+package envelopefile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/rotatingfile"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// Envelopes are stored as a four byte big-endian length followed by the
+// protobuf encoded envelope.
+const (
+	lengthPrefixBytes = 4
+	maxEnvelopeBytes  = 64 << 20
+)
+
+// Writer records envelopes to a file, rotating it as described by
+// rotatingfile.File.
+type Writer struct {
+	file *rotatingfile.File
+}
+
+func NewWriter(path string, maxBytes int64, maxFiles int) (*Writer, error) {
+	file, err := rotatingfile.Open(path, maxBytes, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: file}, nil
+}
+
+func (w *Writer) Write(envelope *events.Envelope) error {
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	// One Write per envelope so that rotation never splits one.
+	record := make([]byte, lengthPrefixBytes+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[lengthPrefixBytes:], data)
+	_, err = w.file.Write(record)
+	return err
+}
+
+func (w *Writer) Close() error {
+	return w.file.Close()
+}
+
+// Reader reads envelopes written by a Writer.
+type Reader struct {
+	reader *bufio.Reader
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(reader)}
+}
+
+// Next returns the next envelope, or io.EOF once the file is exhausted. A
+// file that ends part way through an envelope returns io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*events.Envelope, error) {
+	var prefix [lengthPrefixBytes]byte
+	_, err := io.ReadFull(r.reader, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length > maxEnvelopeBytes {
+		return nil, fmt.Errorf("Can not read envelope of %d bytes, the file is probably corrupt", length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r.reader, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &events.Envelope{}
+	err = proto.Unmarshal(data, envelope)
+	if err != nil {
+		return nil, fmt.Errorf("Can not parse envelope: %s", err)
+	}
+	return envelope, nil
+}
+
+// ReplaySource streams the envelopes in a recorded file to the nozzle. At
+// original speed it waits between envelopes as long as their timestamps are
+// apart; otherwise it sends them as fast as the nozzle takes them. The error
+// channel receives io.EOF once every envelope has been delivered.
+type ReplaySource struct {
+	path          string
+	originalSpeed bool
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+func NewReplaySource(path string, originalSpeed bool) *ReplaySource {
+	return &ReplaySource{
+		path:          path,
+		originalSpeed: originalSpeed,
+		done:          make(chan struct{}),
+	}
+}
+
+func (s *ReplaySource) Stream(onConnect func()) (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		errs <- fmt.Errorf("Can not open envelope file %s: %s", s.path, err)
+		return messages, errs
+	}
+	if onConnect != nil {
+		onConnect()
+	}
+
+	go func() {
+		defer file.Close()
+		errs <- s.replay(NewReader(file), messages)
+	}()
+	return messages, errs
+}
+
+func (s *ReplaySource) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *ReplaySource) replay(reader *Reader, messages chan<- *events.Envelope) error {
+	var previous int64
+	for {
+		envelope, err := reader.Next()
+		if err != nil {
+			return err
+		}
+
+		if s.originalSpeed && previous != 0 && envelope.GetTimestamp() > previous {
+			select {
+			case <-time.After(time.Duration(envelope.GetTimestamp() - previous)):
+			case <-s.done:
+				return io.EOF
+			}
+		}
+		previous = envelope.GetTimestamp()
+
+		// messages is unbuffered, so by the time io.EOF is sent the nozzle
+		// has taken every envelope.
+		select {
+		case messages <- envelope:
+		case <-s.done:
+			return io.EOF
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package envelopefile_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/envelopefile"
+	"github.com/cloudfoundry/sonde-go/events"
+	pb "github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EnvelopeFile", func() {
+	var dir string
+	var path string
+
+	envelope := func(name string, timestamp time.Duration) *events.Envelope {
+		return &events.Envelope{
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(int64(timestamp)),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  pb.String(name),
+				Value: pb.Float64(1),
+				Unit:  pb.String("gauge"),
+			},
+		}
+	}
+
+	readAll := func(path string) []*events.Envelope {
+		file, err := os.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+
+		var envelopes []*events.Envelope
+		reader := envelopefile.NewReader(file)
+		for {
+			next, err := reader.Next()
+			if err == io.EOF {
+				return envelopes
+			}
+			Expect(err).ToNot(HaveOccurred())
+			envelopes = append(envelopes, next)
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "envelopefile")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "envelopes")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("reads back what it writes", func() {
+		writer, err := envelopefile.NewWriter(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Write(envelope("a", time.Second))).To(Succeed())
+		Expect(writer.Write(envelope("b", 2*time.Second))).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+
+		envelopes := readAll(path)
+		Expect(envelopes).To(HaveLen(2))
+		Expect(envelopes[0].GetValueMetric().GetName()).To(Equal("a"))
+		Expect(envelopes[1].GetTimestamp()).To(BeEquivalentTo(2 * time.Second))
+	})
+
+	It("rotates the file once it reaches the size limit", func() {
+		size := 4 + pb.Size(envelope("a", time.Second))
+		writer, err := envelopefile.NewWriter(path, int64(2*size), 3)
+		Expect(err).ToNot(HaveOccurred())
+		for _, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			Expect(writer.Write(envelope(name, time.Second))).To(Succeed())
+		}
+		Expect(writer.Close()).To(Succeed())
+
+		Expect(readAll(path)).To(HaveLen(1))
+		Expect(readAll(path + ".1")).To(HaveLen(2))
+		Expect(readAll(path + ".2")[0].GetValueMetric().GetName()).To(Equal("c"))
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+	})
+
+	It("reports a truncated file", func() {
+		var buffer bytes.Buffer
+		buffer.Write([]byte{0, 0, 0, 10, 1, 2})
+
+		_, err := envelopefile.NewReader(&buffer).Next()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	Describe("ReplaySource", func() {
+		BeforeEach(func() {
+			writer, err := envelopefile.NewWriter(path, 0, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(writer.Write(envelope("a", time.Second))).To(Succeed())
+			Expect(writer.Write(envelope("b", time.Second+300*time.Millisecond))).To(Succeed())
+			Expect(writer.Close()).To(Succeed())
+		})
+
+		replay := func(originalSpeed bool) ([]*events.Envelope, time.Duration) {
+			connected := false
+			source := envelopefile.NewReplaySource(path, originalSpeed)
+			start := time.Now()
+			messages, errs := source.Stream(func() { connected = true })
+			Expect(connected).To(BeTrue())
+
+			var envelopes []*events.Envelope
+			for {
+				select {
+				case next := <-messages:
+					envelopes = append(envelopes, next)
+				case err := <-errs:
+					Expect(err).To(Equal(io.EOF))
+					return envelopes, time.Since(start)
+				}
+			}
+		}
+
+		It("replays as fast as possible and ends with io.EOF", func() {
+			envelopes, elapsed := replay(false)
+			Expect(envelopes).To(HaveLen(2))
+			Expect(elapsed).To(BeNumerically("<", 300*time.Millisecond))
+		})
+
+		It("keeps the original spacing between envelopes", func() {
+			envelopes, elapsed := replay(true)
+			Expect(envelopes).To(HaveLen(2))
+			Expect(elapsed).To(BeNumerically(">=", 300*time.Millisecond))
+		})
+
+		It("reports a missing file", func() {
+			_, errs := envelopefile.NewReplaySource(filepath.Join(dir, "missing"), false).Stream(nil)
+			Expect((<-errs).Error()).To(ContainSubstring("Can not open envelope file"))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package envelopefile_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestEnvelopeFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Envelope File Suite")
+}
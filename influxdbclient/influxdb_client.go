@@ -8,8 +8,8 @@ import (
 	"time"
 
 	"errors"
-	"log"
 
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
@@ -22,6 +22,7 @@ type Client struct {
 	prefix                string
 	deployment            string
 	ip                    string
+	logger                *nozzlelogger.Logger
 	totalMessagesReceived uint64
 	totalMetricsSent      uint64
 }
@@ -53,7 +54,7 @@ type Point struct {
 	Value     float64
 }
 
-func New(url string, database string, user string, password string, prefix string, deployment string, ip string) *Client {
+func New(url string, database string, user string, password string, prefix string, deployment string, ip string, logger *nozzlelogger.Logger) *Client {
 	return &Client{
 		url:          url,
 		database:     database,
@@ -63,6 +64,7 @@ func New(url string, database string, user string, password string, prefix strin
 		prefix:       prefix,
 		deployment:   deployment,
 		ip:           ip,
+		logger:       logger.With(nozzlelogger.Fields{"sink": "influxdb"}),
 	}
 }
 
@@ -102,7 +104,7 @@ func (c *Client) PostMetrics() error {
 
 	c.populateInternalMetrics()
 	numMetrics := len(c.metricPoints)
-	log.Printf("Posting %d metrics", numMetrics)
+	c.logger.Debug("Posting metrics", nozzlelogger.Fields{"series": numMetrics})
 
 	seriesBytes, metricsCount := c.formatMetrics()
 
@@ -125,7 +127,7 @@ func (c *Client) PostMetrics() error {
 
 func (c *Client) seriesURL() string {
 	url := fmt.Sprintf("%s/write?db=%s", c.url, c.database)
-	log.Print("Using the following influx URL " + url)
+	c.logger.Debug("Using influx URL", nozzlelogger.Fields{"url": url})
 	return url
 }
 
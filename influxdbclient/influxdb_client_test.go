@@ -4,13 +4,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 
-	"github.com/18F/influxdb-firehose-nozzle/influxdbclient"
+	"github.com/18F/riemann-firehose-nozzle/influxdbclient"
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
 
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
 
-	"encoding/json"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -20,18 +22,24 @@ import (
 var bodies [][]byte
 var responseCode int
 
-var _ = Describe("DatadogClient", func() {
+var _ = Describe("InfluxDbClient", func() {
 
 	var ts *httptest.Server
+	var logger *nozzlelogger.Logger
 
 	BeforeEach(func() {
+		logger = nozzlelogger.New(ioutil.Discard, nozzlelogger.Debug, nozzlelogger.FormatJSON)
 		bodies = nil
-		responseCode = http.StatusOK
+		responseCode = http.StatusNoContent
 		ts = httptest.NewServer(http.HandlerFunc(handlePost))
 	})
 
+	AfterEach(func() {
+		ts.Close()
+	})
+
 	It("ignores messages that aren't value metrics or counter events", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -65,41 +73,36 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
+		series := parseSeries(bodies[0])
+		Expect(series).To(HaveLen(3))
 
-		validateMetrics(payload, 2, 0)
+		validateMetrics(series, 2, 0)
 	})
 
 	It("generates aggregate messages even when idle", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
+		series := parseSeries(bodies[0])
+		Expect(series).To(HaveLen(3))
 
-		validateMetrics(payload, 0, 0)
+		validateMetrics(series, 0, 0)
 
 		err = c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(2))
-		err = json.Unmarshal(bodies[1], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
+		series = parseSeries(bodies[1])
+		Expect(series).To(HaveLen(3))
 
-		validateMetrics(payload, 0, 3)
+		validateMetrics(series, 0, 3)
 	})
 
-	It("posts ValueMetrics in JSON format", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	It("posts ValueMetrics in the line protocol", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -129,38 +132,20 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
+		series := parseSeries(bodies[0])
+		Expect(series).To(HaveLen(4))
 
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(4))
-
-		metricFound := false
-		for _, metric := range payload.Series {
-			Expect(metric.Type).To(Equal("gauge"))
-
-			if metric.Metric == "datadog.nozzle.origin.metricName" {
-				metricFound = true
-				Expect(metric.Points).To(Equal([]influxdbclient.Point{
-					influxdbclient.Point{
-						Timestamp: 1,
-						Value:     5.0,
-					},
-					influxdbclient.Point{
-						Timestamp: 2,
-						Value:     76.0,
-					},
-				}))
-				Expect(metric.Tags).To(Equal([]string{"deployment:deployment-name", "job:doppler"}))
-			}
-		}
-		Expect(metricFound).To(BeTrue())
+		metric := findSeries(series, "influxdb.nozzle.origin.metricName")
+		Expect(metric).NotTo(BeNil())
+		Expect(metric.values).To(Equal([]float64{5, 76}))
+		Expect(metric.timestamp).To(Equal(int64(1000000000)))
+		Expect(metric.tags).To(Equal([]string{"deployment=deployment-name", "job=doppler"}))
 
-		validateMetrics(payload, 2, 0)
+		validateMetrics(series, 2, 0)
 	})
 
 	It("registers metrics with the same name but different tags as different", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -190,35 +175,20 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(5))
+		series := parseSeries(bodies[0])
+		Expect(series).To(HaveLen(5))
 		dopplerFound := false
 		gorouterFound := false
-		for _, metric := range payload.Series {
-			Expect(metric.Type).To(Equal("gauge"))
-
-			if metric.Metric == "datadog.nozzle.origin.metricName" {
-				Expect(metric.Tags).To(HaveLen(2))
-				Expect(metric.Tags[0]).To(Equal("deployment:deployment-name"))
-				if metric.Tags[1] == "job:doppler" {
+		for _, metric := range series {
+			if metric.name == "influxdb.nozzle.origin.metricName" {
+				Expect(metric.tags).To(HaveLen(2))
+				Expect(metric.tags[0]).To(Equal("deployment=deployment-name"))
+				if metric.tags[1] == "job=doppler" {
 					dopplerFound = true
-					Expect(metric.Points).To(Equal([]influxdbclient.Point{
-						influxdbclient.Point{
-							Timestamp: 1,
-							Value:     5.0,
-						},
-					}))
-				} else if metric.Tags[1] == "job:gorouter" {
+					Expect(metric.values).To(Equal([]float64{5}))
+				} else if metric.tags[1] == "job=gorouter" {
 					gorouterFound = true
-					Expect(metric.Points).To(Equal([]influxdbclient.Point{
-						influxdbclient.Point{
-							Timestamp: 2,
-							Value:     76.0,
-						},
-					}))
+					Expect(metric.values).To(Equal([]float64{76}))
 				} else {
 					panic("Unknown tag found")
 				}
@@ -226,11 +196,11 @@ var _ = Describe("DatadogClient", func() {
 		}
 		Expect(dopplerFound).To(BeTrue())
 		Expect(gorouterFound).To(BeTrue())
-		validateMetrics(payload, 2, 0)
+		validateMetrics(series, 2, 0)
 	})
 
-	It("posts CounterEvents in JSON format and empties map after post", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	It("posts CounterEvents in the line protocol and empties map after post", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		c.AddMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -258,46 +228,26 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
+		series := parseSeries(bodies[0])
+		Expect(series).To(HaveLen(4))
 
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(4))
-		counterNameFound := false
-		for _, metric := range payload.Series {
-			Expect(metric.Type).To(Equal("gauge"))
-
-			if metric.Metric == "datadog.nozzle.origin.counterName" {
-				counterNameFound = true
-				Expect(metric.Points).To(Equal([]influxdbclient.Point{
-					influxdbclient.Point{
-						Timestamp: 1,
-						Value:     5.0,
-					},
-					influxdbclient.Point{
-						Timestamp: 2,
-						Value:     11.0,
-					},
-				}))
-			}
-		}
-		Expect(counterNameFound).To(BeTrue())
-		validateMetrics(payload, 2, 0)
+		metric := findSeries(series, "influxdb.nozzle.origin.counterName")
+		Expect(metric).NotTo(BeNil())
+		Expect(metric.values).To(Equal([]float64{5, 11}))
+		validateMetrics(series, 2, 0)
 
 		err = c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(2))
+		series = parseSeries(bodies[1])
+		Expect(series).To(HaveLen(3))
 
-		err = json.Unmarshal(bodies[1], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
-
-		validateMetrics(payload, 2, 4)
+		validateMetrics(series, 2, 4)
 	})
 
 	It("sends a value 1 for the slowConsumerAlert metric when consumer error is set", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		c.AlertSlowConsumerError()
 
@@ -305,39 +255,31 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
+		series := parseSeries(bodies[0])
+		Expect(series).To(HaveLen(3))
 
-		errMetric := findSlowConsumerMetric(payload)
+		errMetric := findSeries(series, "influxdb.nozzle.slowConsumerAlert")
 		Expect(errMetric).NotTo(BeNil())
-		Expect(errMetric.Type).To(Equal("gauge"))
-		Expect(errMetric.Points).To(HaveLen(1))
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(1))
+		Expect(errMetric.values).To(Equal([]float64{1}))
 	})
 
 	It("sends a value 0 for the slowConsumerAlert metric when consumer error is not set", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
+		series := parseSeries(bodies[0])
+		Expect(series).To(HaveLen(3))
 
-		errMetric := findSlowConsumerMetric(payload)
+		errMetric := findSeries(series, "influxdb.nozzle.slowConsumerAlert")
 		Expect(errMetric).NotTo(BeNil())
-		Expect(errMetric.Type).To(Equal("gauge"))
-		Expect(errMetric.Points).To(HaveLen(1))
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(0))
+		Expect(errMetric.values).To(Equal([]float64{0}))
 	})
 
-	It("unsets the slow consumer error once it publishes the alert to datadog", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	It("unsets the slow consumer error once it publishes the alert to influxdb", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
 		c.AlertSlowConsumerError()
 
@@ -345,75 +287,96 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-
-		errMetric := findSlowConsumerMetric(payload)
+		errMetric := findSeries(parseSeries(bodies[0]), "influxdb.nozzle.slowConsumerAlert")
 		Expect(errMetric).NotTo(BeNil())
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(1))
+		Expect(errMetric.values).To(Equal([]float64{1}))
 
 		err = c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(bodies).Should(HaveLen(2))
-		err = json.Unmarshal(bodies[1], &payload)
-		Expect(err).NotTo(HaveOccurred())
-
-		errMetric = findSlowConsumerMetric(payload)
-		Expect(findSlowConsumerMetric(payload)).ToNot(BeNil())
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(0))
+		errMetric = findSeries(parseSeries(bodies[1]), "influxdb.nozzle.slowConsumerAlert")
+		Expect(errMetric).NotTo(BeNil())
+		Expect(errMetric.values).To(Equal([]float64{0}))
 	})
 
-	It("returns an error when datadog responds with a non 200 response code", func() {
+	It("returns an error when influxdb responds with a non 2xx response code", func() {
+		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip", logger)
 
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
 		responseCode = http.StatusBadRequest // 400
 		err := c.PostMetrics()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("datadog request returned HTTP response: 400 Bad Request"))
+		Expect(err.Error()).To(ContainSubstring("InfluxDB request returned HTTP response: 400 Bad Request"))
 
 		responseCode = http.StatusSwitchingProtocols // 101
 		err = c.PostMetrics()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("datadog request returned HTTP response: 101"))
+		Expect(err.Error()).To(ContainSubstring("InfluxDB request returned HTTP response: 101"))
 
-		responseCode = http.StatusAccepted // 201
+		responseCode = http.StatusAccepted // 202
 		err = c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
-
 	})
 
 })
 
-func validateMetrics(payload influxdbclient.Payload, totalMessagesReceived int, totalMetricsSent int) {
-	totalMessagesReceivedFound := false
-	totalMetricsSentFound := false
-	for _, metric := range payload.Series {
-		Expect(metric.Type).To(Equal("gauge"))
-
-		internalMetric := false
-		var metricValue int
-		if metric.Metric == "datadog.nozzle.totalMessagesReceived" {
-			totalMessagesReceivedFound = true
-			internalMetric = true
-			metricValue = totalMessagesReceived
+// series is one line of the line protocol the client writes: a name, its
+// tags, one value field per point and the timestamp of the first point.
+type series struct {
+	name      string
+	tags      []string
+	values    []float64
+	timestamp int64
+}
+
+func parseSeries(body []byte) []series {
+	var parsed []series
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		parts := strings.Split(line, " ")
+		Expect(parts).To(HaveLen(3), line)
+
+		key := strings.Split(parts[0], ",")
+		s := series{name: key[0]}
+		for _, tag := range key[1:] {
+			if tag != "" {
+				s.tags = append(s.tags, tag)
+			}
 		}
-		if metric.Metric == "datadog.nozzle.totalMetricsSent" {
-			totalMetricsSentFound = true
-			internalMetric = true
-			metricValue = totalMetricsSent
+		for _, field := range strings.Split(parts[1], ",") {
+			Expect(field).To(HavePrefix("value="))
+			value, err := strconv.ParseFloat(strings.TrimPrefix(field, "value="), 64)
+			Expect(err).NotTo(HaveOccurred())
+			s.values = append(s.values, value)
 		}
+		timestamp, err := strconv.ParseInt(parts[2], 10, 64)
+		Expect(err).NotTo(HaveOccurred())
+		s.timestamp = timestamp
+
+		parsed = append(parsed, s)
+	}
+	return parsed
+}
 
-		if internalMetric {
-			Expect(metric.Points).To(HaveLen(1))
-			Expect(metric.Points[0].Timestamp).To(BeNumerically(">", time.Now().Unix()-10), "Timestamp should not be less than 10 seconds ago")
-			Expect(metric.Points[0].Value).To(Equal(float64(metricValue)))
-			Expect(metric.Tags).To(Equal([]string{"ip:dummy-ip", "deployment:test-deployment"}))
+func findSeries(parsed []series, name string) *series {
+	for _, s := range parsed {
+		if s.name == name {
+			return &s
 		}
 	}
-	Expect(totalMessagesReceivedFound).To(BeTrue())
-	Expect(totalMetricsSentFound).To(BeTrue())
+	return nil
+}
+
+func validateMetrics(parsed []series, totalMessagesReceived int, totalMetricsSent int) {
+	for name, value := range map[string]int{
+		"influxdb.nozzle.totalMessagesReceived": totalMessagesReceived,
+		"influxdb.nozzle.totalMetricsSent":      totalMetricsSent,
+	} {
+		metric := findSeries(parsed, name)
+		Expect(metric).NotTo(BeNil(), name)
+		Expect(metric.values).To(Equal([]float64{float64(value)}), name)
+		Expect(metric.timestamp).To(BeNumerically(">", (time.Now().Unix()-10)*int64(time.Second)), "Timestamp should not be less than 10 seconds ago")
+		Expect(metric.tags).To(Equal([]string{"ip=dummy-ip", "deployment=test-deployment"}))
+	}
 }
 
 func handlePost(w http.ResponseWriter, r *http.Request) {
@@ -426,12 +389,3 @@ func handlePost(w http.ResponseWriter, r *http.Request) {
 	bodies = append(bodies, body)
 	w.WriteHeader(responseCode)
 }
-
-func findSlowConsumerMetric(payload influxdbclient.Payload) *influxdbclient.Metric {
-	for _, metric := range payload.Series {
-		if metric.Metric == "datadog.nozzle.slowConsumerAlert" {
-			return &metric
-		}
-	}
-	return nil
-}
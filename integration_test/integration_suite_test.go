@@ -9,7 +9,7 @@ import (
 	"github.com/onsi/gomega/gexec"
 )
 
-func TestDatadogFirehoseNozzle(t *testing.T) {
+func TestRiemannFirehoseNozzle(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Integration Suite")
 }
@@ -18,7 +18,7 @@ var pathToNozzleExecutable string
 
 var _ = BeforeSuite(func() {
 	var err error
-	pathToNozzleExecutable, err = gexec.Build("github.com/cloudfoundry-incubator/datadog-firehose-nozzle")
+	pathToNozzleExecutable, err = gexec.Build("github.com/18F/riemann-firehose-nozzle")
 	Expect(err).ShouldNot(HaveOccurred())
 })
 
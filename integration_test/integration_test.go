@@ -1,44 +1,36 @@
 package integration_test
 
 import (
-	"encoding/json"
+	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/amir/raidman/proto"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/gogo/protobuf/proto"
+	pb "github.com/gogo/protobuf/proto"
 
-	"github.com/18F/influxdb-firehose-nozzle/datadogclient"
-	. "github.com/18F/influxdb-firehose-nozzle/testhelpers"
+	. "github.com/18F/riemann-firehose-nozzle/testhelpers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
-	"os"
-	"strings"
 )
 
-var _ = Describe("DatadogFirehoseNozzle", func() {
+var _ = Describe("RiemannFirehoseNozzle", func() {
 	var (
-		fakeUAA        *FakeUAA
-		fakeFirehose   *FakeFirehose
-		fakeDatadogAPI *FakeDatadogAPI
+		fakeUAA      *FakeUAA
+		fakeFirehose *FakeFirehose
+		fakeRiemann  *FakeRiemann
 
 		nozzleSession *gexec.Session
 	)
 
-	BeforeEach(func() {
-		fakeUAA = NewFakeUAA("bearer", "123456789")
-		fakeToken := fakeUAA.AuthToken()
-		fakeFirehose = NewFakeFirehose(fakeToken)
-		fakeDatadogAPI = NewFakeDatadogAPI()
-
-		fakeUAA.Start()
-		fakeFirehose.Start()
-		fakeDatadogAPI.Start()
+	startNozzle := func(transport string) {
+		fakeRiemann = NewFakeRiemann(transport)
+		fakeRiemann.Start()
 
-		os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "2")
-		os.Setenv("NOZZLE_UAAURL", fakeUAA.URL())
-		os.Setenv("NOZZLE_DATADOGURL", fakeDatadogAPI.URL())
-		os.Setenv("NOZZLE_TRAFFICCONTROLLERURL", strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1))
+		os.Setenv("NOZZLE_RIEMANN_HOST", fakeRiemann.Host())
+		os.Setenv("NOZZLE_RIEMANN_PORT", fakeRiemann.Port())
+		os.Setenv("NOZZLE_RIEMANN_TRANSPORT", fakeRiemann.Transport())
 
 		var err error
 		nozzleCommand := exec.Command(pathToNozzleExecutable, "-config", "fixtures/test-config.json")
@@ -48,120 +40,128 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 			gexec.NewPrefixedWriter("[e][nozzle] ", GinkgoWriter),
 		)
 		Expect(err).NotTo(HaveOccurred())
-	})
+	}
 
-	AfterEach(func() {
-		fakeUAA.Close()
-		fakeFirehose.Close()
-		fakeDatadogAPI.Close()
-		nozzleSession.Kill().Wait()
-	})
+	BeforeEach(func() {
+		fakeUAA = NewFakeUAA("bearer", "123456789")
+		fakeToken := fakeUAA.AuthToken()
+		fakeFirehose = NewFakeFirehose(fakeToken)
+
+		fakeUAA.Start()
+		fakeFirehose.Start()
 
-	It("forwards metrics in a batch", func(done Done) {
+		os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "1")
+		os.Setenv("NOZZLE_UAAURL", fakeUAA.URL())
+		os.Setenv("NOZZLE_TRAFFICCONTROLLERURL", strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1))
 
 		fakeFirehose.AddEvent(events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(1000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(1000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
 			ValueMetric: &events.ValueMetric{
-				Name:  proto.String("metricName"),
-				Value: proto.Float64(5),
-				Unit:  proto.String("gauge"),
+				Name:  pb.String("metricName"),
+				Value: pb.Float64(5),
+				Unit:  pb.String("gauge"),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("doppler"),
 		})
 
 		fakeFirehose.AddEvent(events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(2000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(2000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
 			ValueMetric: &events.ValueMetric{
-				Name:  proto.String("metricName"),
-				Value: proto.Float64(10),
-				Unit:  proto.String("gauge"),
+				Name:  pb.String("metricName"),
+				Value: pb.Float64(10),
+				Unit:  pb.String("gauge"),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("gorouter"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("gorouter"),
 		})
 
 		fakeFirehose.AddEvent(events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(3000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(3000000000),
 			EventType: events.Envelope_CounterEvent.Enum(),
 			CounterEvent: &events.CounterEvent{
-				Name:  proto.String("counterName"),
-				Delta: proto.Uint64(3),
-				Total: proto.Uint64(15),
+				Name:  pb.String("counterName"),
+				Delta: pb.Uint64(3),
+				Total: pb.Uint64(15),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("doppler"),
 		})
+	})
 
-		// eventually receive a batch from fake DD
-		var messageBytes []byte
-		Eventually(fakeDatadogAPI.ReceivedContents, "2s").Should(Receive(&messageBytes))
+	AfterEach(func() {
+		fakeUAA.Close()
+		fakeFirehose.Close()
+		fakeRiemann.Close()
+		nozzleSession.Kill().Wait()
+	})
 
-		// Break JSON blob into a list of blobs, one for each metric
-		var payload datadogclient.Payload
-		err := json.Unmarshal(messageBytes, &payload)
-		Expect(err).NotTo(HaveOccurred())
+	for _, transport := range []string{"tcp", "udp"} {
+		transport := transport
+
+		Context("over "+transport, func() {
+			BeforeEach(func() {
+				startNozzle(transport)
+			})
+
+			It("forwards metrics as Riemann events", func() {
+				Eventually(func() *proto.Event {
+					return findEvent(fakeRiemann.Events(), "origin.counterName", "doppler")
+				}, "5s").ShouldNot(BeNil())
+
+				receivedEvents := fakeRiemann.Events()
+
+				doppler := findEvent(receivedEvents, "origin.metricName", "doppler")
+				Expect(doppler).NotTo(BeNil())
+				Expect(doppler.GetTime()).To(BeEquivalentTo(1))
+				Expect(doppler.GetMetricD()).To(Equal(5.0))
+				Expect(attributes(doppler)).To(HaveKeyWithValue("deployment", "deployment-name"))
+
+				gorouter := findEvent(receivedEvents, "origin.metricName", "gorouter")
+				Expect(gorouter).NotTo(BeNil())
+				Expect(gorouter.GetTime()).To(BeEquivalentTo(2))
+				Expect(gorouter.GetMetricD()).To(Equal(10.0))
+
+				counter := findEvent(receivedEvents, "origin.counterName", "doppler")
+				Expect(counter.GetTime()).To(BeEquivalentTo(3))
+				Expect(counter.GetMetricD()).To(Equal(15.0))
+			})
+
+			It("reports its internal metrics", func() {
+				Eventually(func() *proto.Event {
+					return findEvent(fakeRiemann.Events(), "totalMessagesReceived", "")
+				}, "5s").ShouldNot(BeNil())
+
+				received := findEvent(fakeRiemann.Events(), "totalMessagesReceived", "")
+				Expect(received.GetMetricD()).To(Equal(3.0))
+				Expect(attributes(received)).To(HaveKey("ip"))
+				Expect(attributes(received)).To(HaveKeyWithValue("deployment", "deployment-name"))
+
+				Expect(findEvent(fakeRiemann.Events(), "totalMetricsSent", "")).NotTo(BeNil())
+				Expect(findEvent(fakeRiemann.Events(), "slowConsumerAlert", "")).NotTo(BeNil())
+			})
+		})
+	}
+})
 
-		for _, metric := range payload.Series {
-			Expect(metric.Type).To(Equal("gauge"))
-
-			if metric.Metric == "origin.metricName" {
-				Expect(metric.Tags).To(HaveLen(2))
-				Expect(metric.Tags[0]).To(Equal("deployment:deployment-name"))
-				if metric.Tags[1] == "job:doppler" {
-					Expect(metric.Points).To(Equal([]datadogclient.Point{
-						datadogclient.Point{
-							Timestamp: 1,
-							Value:     5.0,
-						},
-					}))
-				} else if metric.Tags[1] == "job:gorouter" {
-					Expect(metric.Points).To(Equal([]datadogclient.Point{
-						datadogclient.Point{
-							Timestamp: 2,
-							Value:     10.0,
-						},
-					}))
-				} else {
-					panic("Unknown tag")
-				}
-			} else if metric.Metric == "origin.counterName" {
-				Expect(metric.Tags).To(HaveLen(2))
-				Expect(metric.Tags[0]).To(Equal("deployment:deployment-name"))
-				Expect(metric.Tags[1]).To(Equal("job:doppler"))
-
-				Expect(metric.Points).To(Equal([]datadogclient.Point{
-					datadogclient.Point{
-						Timestamp: 3,
-						Value:     15.0,
-					},
-				}))
-			} else if metric.Metric == "totalMessagesReceived" {
-				Expect(metric.Tags).To(HaveLen(2))
-				Expect(metric.Tags[0]).To(HavePrefix("ip:"))
-				Expect(metric.Tags[1]).To(HavePrefix("deployment:"))
-
-				Expect(metric.Points).To(HaveLen(1))
-				Expect(metric.Points[0].Value).To(Equal(3.0))
-			} else if metric.Metric == "totalMetricsSent" {
-				Expect(metric.Tags).To(HaveLen(2))
-				Expect(metric.Tags[0]).To(HavePrefix("ip:"))
-				Expect(metric.Tags[1]).To(HavePrefix("deployment:"))
-
-				Expect(metric.Points).To(HaveLen(1))
-				Expect(metric.Points[0].Value).To(Equal(0.0))
-			} else if metric.Metric == "slowConsumerAlert" {
-
-			} else {
-				panic("Unknown metric " + metric.Metric)
-			}
+func findEvent(events []*proto.Event, service string, job string) *proto.Event {
+	for _, event := range events {
+		if event.GetService() == service && attributes(event)["job"] == job {
+			return event
 		}
-
-		close(done)
-	}, 2.0)
-})
+	}
+	return nil
+}
+
+func attributes(event *proto.Event) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range event.GetAttributes() {
+		attributes[attribute.GetKey()] = attribute.GetValue()
+	}
+	return attributes
+}
@@ -1,65 +1,207 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"io"
-	"log"
+	"fmt"
+	"strings"
 
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
+	"github.com/18F/riemann-firehose-nozzle/envelopefile"
 	"github.com/18F/riemann-firehose-nozzle/nozzleconfig"
+	"github.com/18F/riemann-firehose-nozzle/nozzlehealth"
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/nozzlepush"
+	"github.com/18F/riemann-firehose-nozzle/nozzletap"
 	"github.com/18F/riemann-firehose-nozzle/riemannfirehosenozzle"
+	"github.com/18F/riemann-firehose-nozzle/sysloglistener"
 	"github.com/18F/riemann-firehose-nozzle/uaatokenfetcher"
 )
 
+// configPaths collects every -config flag so that several files can be
+// layered on top of each other.
+type configPaths []string
+
+func (p *configPaths) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *configPaths) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
 func main() {
-	log.Println("\n\n---------------\n\nStarting in main()\n\n--------------")
-	configFilePath := flag.String("config", "config/riemann-firehose-nozzle.json", "Location of the nozzle config json file")
+	var configFilePaths configPaths
+	flag.Var(&configFilePaths, "config", "Location of a nozzle config file (.json, .yml or .yaml). May be repeated; later files override earlier ones")
+	validateOnly := flag.Bool("validate", false, "Validate the config and exit")
+	printConfig := flag.Bool("print-config", false, "Print the effective config with secrets redacted and exit")
+	recordPath := flag.String("record", "", "Also write every envelope received to this file, rotating it as it grows")
+	recordMaxBytes := flag.Int64("record-max-bytes", 100<<20, "Size at which the -record file is rotated")
+	recordMaxFiles := flag.Int("record-max-files", 5, "Number of -record files to keep, including the current one")
+	replayPath := flag.String("replay", "", "Read envelopes from a file written with -record instead of the firehose, then exit")
+	dryRun := flag.Bool("dry-run", false, "Write events as JSON lines to the debug sink (stdout by default) instead of sending them to Riemann")
+	replayFast := flag.Bool("replay-fast", false, "Replay as fast as possible instead of at the original speed")
 	flag.Parse()
 
-	config, err := nozzleconfig.Parse(*configFilePath)
+	switch flag.Arg(0) {
+	case "check-config":
+		*validateOnly = true
+		flag.CommandLine.Parse(flag.Args()[1:])
+	case "print-config":
+		*printConfig = true
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	if len(configFilePaths) == 0 {
+		configFilePaths = configPaths{"config/riemann-firehose-nozzle.json"}
+	}
+
+	config, err := nozzleconfig.Parse(configFilePaths...)
+	if err == nil && *dryRun {
+		config.DryRun = true
+	}
+	if err == nil && !*printConfig {
+		err = config.Validate()
+	}
 	if err != nil {
-		log.Fatalf("Error parsing config: %s", err.Error())
+		fmt.Fprintf(os.Stderr, "Invalid config %s:\n%s\n", configFilePaths.String(), err)
+		os.Exit(1)
 	}
+	if *printConfig {
+		output, _ := json.MarshalIndent(config.Redacted(), "", "  ")
+		fmt.Println(string(output))
+		return
+	}
+	if *validateOnly {
+		fmt.Printf("Config %s is valid\n", configFilePaths.String())
+		return
+	}
+
+	logOutput := os.Stdout
+	if config.DebugSinkOnStdout() {
+		logOutput = os.Stderr
+	}
+	logger, err := config.Logger(logOutput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring logging: %s\n", err)
+		os.Exit(1)
+	}
+	logger.Info("Starting in main()", nozzlelogger.Fields{"config": configFilePaths.String()})
 
-	tokenFetcher := &uaatokenfetcher.UAATokenFetcher{
-		UaaUrl:                config.UAAURL,
-		Username:              config.Username,
-		Password:              config.Password,
-		InsecureSSLSkipVerify: false, //config.InsecureSSLSkipVerify,
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		logger.Error("Error configuring TLS", err)
+		os.Exit(1)
+	}
+
+	newTokenFetcher := func(foundation nozzleconfig.FoundationConfig) *uaatokenfetcher.UAATokenFetcher {
+		return &uaatokenfetcher.UAATokenFetcher{
+			UaaUrl:                foundation.UAAURL,
+			Username:              foundation.Username,
+			Password:              foundation.Password,
+			InsecureSSLSkipVerify: config.InsecureSSLSkipVerify,
+			TLSConfig:             tlsConfig,
+			Logger:                logger,
+		}
 	}
 
 	threadDumpChan := registerGoRoutineDumpSignalChannel()
 	defer close(threadDumpChan)
 	go dumpGoRoutine(threadDumpChan)
 
-	go runServer()
+	riemannNozzle := riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, newTokenFetcher(config.FoundationConfigs()[0]), logger)
+	if len(config.Foundations) > 0 {
+		for _, foundation := range config.FoundationConfigs() {
+			fields := nozzlelogger.Fields{"foundation": foundation.Name, "traffic_controller_url": foundation.TrafficControllerURL}
+			if foundation.RLPGatewayURL != "" {
+				fields = nozzlelogger.Fields{"foundation": foundation.Name, "rlp_gateway_url": foundation.RLPGatewayURL}
+			}
+			logger.Info("Reading foundation", fields)
+			riemannNozzle.AddFoundation(foundation, newTokenFetcher(foundation))
+		}
+	}
 
-	riemannNozzle := riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, tokenFetcher)
-	riemannNozzle.Start()
-}
+	if *replayPath != "" {
+		logger.Info("Replaying recorded envelopes", nozzlelogger.Fields{"file": *replayPath, "fast": *replayFast})
+		riemannNozzle.SetEnvelopeSource(envelopefile.NewReplaySource(*replayPath, !*replayFast))
+	}
+	var recorder *envelopefile.Writer
+	if *recordPath != "" {
+		recorder, err = envelopefile.NewWriter(*recordPath, *recordMaxBytes, *recordMaxFiles)
+		if err != nil {
+			logger.Error("Error opening record file", err)
+			os.Exit(1)
+		}
+		logger.Info("Recording envelopes", nozzlelogger.Fields{"file": *recordPath})
+		riemannNozzle.SetEnvelopeRecorder(recorder)
+	}
+
+	if config.SyslogListenAddress != "" {
+		syslogTLSConfig, err := config.SyslogTLSConfig()
+		if err != nil {
+			logger.Error("Error configuring syslog TLS", err)
+			os.Exit(1)
+		}
+		logger.Info("Listening for syslog", nozzlelogger.Fields{"address": config.SyslogListenAddress, "tls": syslogTLSConfig != nil})
+		riemannNozzle.AddSource(nozzlehealth.Syslog, sysloglistener.New(config.SyslogListenAddress, syslogTLSConfig, logger))
+	}
+
+	var tap *nozzletap.Tap
+	if config.TapToken != "" {
+		tap = nozzletap.New(config.TapToken, config.TapRatePerSecond, config.TapMaxClients, config.MetricPrefix)
+		riemannNozzle.SetTap(tap)
+	}
 
-func defaultResponse(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, "{ \"status\" : \"running\" }")
+	var pushReceiver *nozzlepush.Receiver
+	if config.PushToken != "" {
+		pushReceiver = nozzlepush.New(config.PushToken, int64(config.PushMaxBytes))
+		pushReceiver.SetMaxSkew(time.Duration(config.MaxClockSkewSeconds) * time.Second)
+		riemannNozzle.SetPushReceiver(pushReceiver)
+	}
+
+	go runServer(logger, riemannNozzle.Health(), tap, pushReceiver)
+
+	err = riemannNozzle.Start()
+	if recorder != nil {
+		recorder.Close()
+	}
+	if err != nil {
+		logger.Error("Riemann Firehose Nozzle stopped", err)
+		os.Exit(1)
+	}
 }
 
-func runServer() {
+func runServer(logger *nozzlelogger.Logger, health *nozzlehealth.Tracker, tap *nozzletap.Tap, pushReceiver *nozzlepush.Receiver) {
 	port := os.Getenv("PORT")
 
-	log.Print("Go Port from environment: " + port)
+	logger.Debug("Go Port from environment", nozzlelogger.Fields{"port": port})
 
 	if port == "" {
 		port = "8000"
 	}
 
-	log.Print("Starting server with port: " + port)
+	logger.Info("Starting server", nozzlelogger.Fields{"port": port})
 
-	http.HandleFunc("/", defaultResponse)
-	http.ListenAndServe(":"+port, nil)
+	http.Handle("/", health.LivenessHandler())
+	http.Handle("/health", health.LivenessHandler())
+	http.Handle("/ready", health.ReadinessHandler())
+	if tap != nil {
+		http.Handle("/tap", tap)
+	}
+	if pushReceiver != nil {
+		http.Handle("/v1/metrics", pushReceiver)
+	}
+	err := http.ListenAndServe(":"+port, nil)
+	if err != nil {
+		logger.Error("Error running server", err, nozzlelogger.Fields{"port": port})
+	}
 }
 
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
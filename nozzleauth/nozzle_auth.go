@@ -0,0 +1,26 @@
+// Package nozzleauth checks the bearer token that guards the nozzle's own
+// HTTP endpoints, such as /tap and /v1/metrics.
+package nozzleauth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Authorized reports whether req carries token as its bearer token. An empty
+// token authorizes nothing.
+func Authorized(req *http.Request, token string) bool {
+	header := req.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	presented := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// Unauthorized answers a request that is not Authorized.
+func Unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
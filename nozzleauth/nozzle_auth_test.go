@@ -0,0 +1,42 @@
+package nozzleauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzleauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NozzleAuth", func() {
+	request := func(authorization string) *http.Request {
+		req := httptest.NewRequest("GET", "/tap", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return req
+	}
+
+	It("accepts the token as a bearer token", func() {
+		Expect(nozzleauth.Authorized(request("Bearer secret"), "secret")).To(BeTrue())
+	})
+
+	It("rejects a missing or wrong token", func() {
+		Expect(nozzleauth.Authorized(request(""), "secret")).To(BeFalse())
+		Expect(nozzleauth.Authorized(request("Bearer wrong"), "secret")).To(BeFalse())
+		Expect(nozzleauth.Authorized(request("Basic secret"), "secret")).To(BeFalse())
+	})
+
+	It("authorizes nothing without a token", func() {
+		Expect(nozzleauth.Authorized(request("Bearer "), "")).To(BeFalse())
+	})
+
+	It("asks for a bearer token", func() {
+		recorder := httptest.NewRecorder()
+		nozzleauth.Unauthorized(recorder)
+
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(recorder.Header().Get("WWW-Authenticate")).To(Equal("Bearer"))
+	})
+})
@@ -0,0 +1,13 @@
+package nozzleauth_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNozzleAuth(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nozzle Auth Suite")
+}
@@ -1,59 +1,574 @@
 package nozzleconfig
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	"gopkg.in/yaml.v2"
 )
 
 type NozzleConfig struct {
+	UAAURL                  string
+	Username                string
+	Password                string
+	TrafficControllerURL    string
+	RLPGatewayURL           string
+	FirehoseSubscriptionID  string
+	RiemannHost             string
+	RiemannPort             string
+	RiemannEndpoints        []string
+	RiemannBalancing        string
+	RiemannTransport        string
+	RiemannMaxRetries       uint32
+	RiemannRetryBackoffMs   uint32
+	RiemannMaxBackoffMs     uint32
+	CanaryIntervalSeconds   uint32
+	CanaryTimeoutSeconds    uint32
+	MaxSeries               uint32
+	MaxSeriesPerOrigin      uint32
+	SeriesOverflow          string
+	Rollups                 []riemannclient.RollupRule
+	MaxClockSkewSeconds     uint32
+	AllowedTags             []string
+	DeniedTags              []string
+	StaticAttributes        map[string]string
+	ClockSkewAction         string
+	FlushDurationSeconds    uint32
+	IngestQueueSize         uint32
+	AggregationWorkers      uint32
+	SlowConsumerQueueDepth  uint32
+	SlowConsumerHoldSeconds uint32
+	ReadyFlushIntervals     uint32
+	DryRun                  bool
+	DebugSinkPath           string
+	DebugSinkMaxMB          uint32
+	DebugSinkMaxFiles       uint32
+	TapToken                string
+	TapRatePerSecond        uint32
+	TapMaxClients           uint32
+	PushToken               string
+	PushMaxBytes            uint32
+	SyslogListenAddress     string
+	SyslogTLSCert           string
+	SyslogTLSKey            string
+	InsecureSSLSkipVerify   bool
+	CACert                  string
+	MetricPrefix            string
+	Deployment              string
+	InstanceIndex           string
+	DisableAccessControl    bool
+	IdleTimeoutSeconds      uint32
+	VCAPServiceName         string
+	VCAPServiceTag          string
+	LogLevel                string
+	LogFormat               string
+	Foundations             []FoundationConfig
+}
+
+// FoundationConfig describes one Cloud Foundry foundation whose firehose the
+// nozzle reads. An empty FirehoseSubscriptionID means the nozzle-wide one.
+// With RLPGatewayURL set the nozzle reads V2 envelopes from the Reverse Log
+// Proxy gateway instead of the V1 firehose at TrafficControllerURL.
+type FoundationConfig struct {
+	Name                   string
 	UAAURL                 string
 	Username               string
 	Password               string
 	TrafficControllerURL   string
+	RLPGatewayURL          string
 	FirehoseSubscriptionID string
-	RiemannHost            string
-	RiemannPort            string
-	RiemannTransport       string
-	FlushDurationSeconds   uint32
-	InsecureSSLSkipVerify  bool
-	MetricPrefix           string
-	Deployment             string
 	DisableAccessControl   bool
-	IdleTimeoutSeconds     uint32
 }
 
-func Parse(configPath string) (*NozzleConfig, error) {
-	configBytes, err := ioutil.ReadFile(configPath)
-	var config NozzleConfig
-	if err != nil {
-		return nil, fmt.Errorf("Can not read config file [%s]: %s", configPath, err)
+// ValidationErrors collects every problem found in a config so they can all
+// be reported at once.
+type ValidationErrors []error
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Default returns the values used for any setting that the config file and
+// environment leave unset.
+func Default() *NozzleConfig {
+	return &NozzleConfig{
+		FirehoseSubscriptionID:  "riemann-firehose-nozzle",
+		RiemannPort:             "5555",
+		RiemannBalancing:        riemannclient.BalanceFailover,
+		RiemannTransport:        "tcp",
+		RiemannMaxRetries:       3,
+		RiemannRetryBackoffMs:   100,
+		RiemannMaxBackoffMs:     5000,
+		CanaryTimeoutSeconds:    10,
+		SeriesOverflow:          "collapse",
+		ClockSkewAction:         riemannclient.SkewClamp,
+		FlushDurationSeconds:    15,
+		IngestQueueSize:         10000,
+		AggregationWorkers:      1,
+		SlowConsumerQueueDepth:  5000,
+		SlowConsumerHoldSeconds: 60,
+		ReadyFlushIntervals:     3,
+		DebugSinkMaxMB:          100,
+		DebugSinkMaxFiles:       5,
+		TapRatePerSecond:        100,
+		TapMaxClients:           10,
+		PushMaxBytes:            1 << 20,
+		IdleTimeoutSeconds:      60,
+		InstanceIndex:           "0",
+		LogLevel:                "info",
+		LogFormat:               nozzlelogger.FormatJSON,
+	}
+}
+
+// Parse reads each config file in order on top of the defaults, so later
+// files only need to contain the settings they change. It then applies
+// credentials from a bound Cloud Foundry service, if one is selected, and
+// finally the NOZZLE_* environment overrides. Files ending in .yml or .yaml
+// are read as YAML, anything else as JSON.
+func Parse(configPaths ...string) (*NozzleConfig, error) {
+	config := Default()
+	for _, configPath := range configPaths {
+		err := parseFile(configPath, config)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = json.Unmarshal(configBytes, &config)
+	overrideWithEnvVar("NOZZLE_VCAPSERVICENAME", &config.VCAPServiceName)
+	overrideWithEnvVar("NOZZLE_VCAPSERVICETAG", &config.VCAPServiceTag)
+	err := applyVCAPServices(config)
 	if err != nil {
-		return nil, fmt.Errorf("Can not parse config file %s: %s", configPath, err)
+		return nil, err
 	}
 
+	var errs ValidationErrors
 	overrideWithEnvVar("NOZZLE_UAAURL", &config.UAAURL)
 	overrideWithEnvVar("NOZZLE_USERNAME", &config.Username)
 	overrideWithEnvVar("NOZZLE_PASSWORD", &config.Password)
 	overrideWithEnvVar("NOZZLE_TRAFFICCONTROLLERURL", &config.TrafficControllerURL)
+	overrideWithEnvVar("NOZZLE_RLPGATEWAYURL", &config.RLPGatewayURL)
 	overrideWithEnvVar("NOZZLE_FIREHOSESUBSCRIPTIONID", &config.FirehoseSubscriptionID)
 	overrideWithEnvVar("NOZZLE_RIEMANN_HOST", &config.RiemannHost)
 	overrideWithEnvVar("NOZZLE_RIEMANN_PORT", &config.RiemannPort)
+	overrideWithEnvList("NOZZLE_RIEMANN_ENDPOINTS", &config.RiemannEndpoints)
+	overrideWithEnvVar("NOZZLE_RIEMANN_BALANCING", &config.RiemannBalancing)
 	overrideWithEnvVar("NOZZLE_RIEMANN_TRANSPORT", &config.RiemannTransport)
 	overrideWithEnvVar("NOZZLE_METRICPREFIX", &config.MetricPrefix)
 	overrideWithEnvVar("NOZZLE_DEPLOYMENT", &config.Deployment)
+	overrideWithEnvVar("CF_INSTANCE_INDEX", &config.InstanceIndex)
+	overrideWithEnvVar("NOZZLE_INSTANCEINDEX", &config.InstanceIndex)
+	overrideWithEnvVar("NOZZLE_SERIESOVERFLOW", &config.SeriesOverflow)
+	overrideWithEnvVar("NOZZLE_CLOCKSKEWACTION", &config.ClockSkewAction)
+	overrideWithEnvList("NOZZLE_ALLOWEDTAGS", &config.AllowedTags)
+	overrideWithEnvList("NOZZLE_DENIEDTAGS", &config.DeniedTags)
+	overrideWithEnvVar("NOZZLE_DEBUGSINKPATH", &config.DebugSinkPath)
+	overrideWithEnvVar("NOZZLE_TAPTOKEN", &config.TapToken)
+	overrideWithEnvVar("NOZZLE_PUSHTOKEN", &config.PushToken)
+	overrideWithEnvVar("NOZZLE_SYSLOGLISTENADDRESS", &config.SyslogListenAddress)
+	overrideWithEnvVar("NOZZLE_SYSLOGTLSCERT", &config.SyslogTLSCert)
+	overrideWithEnvVar("NOZZLE_SYSLOGTLSKEY", &config.SyslogTLSKey)
+	overrideWithEnvVar("NOZZLE_CACERT", &config.CACert)
+	overrideWithEnvVar("NOZZLE_LOGLEVEL", &config.LogLevel)
+	overrideWithEnvVar("NOZZLE_LOGFORMAT", &config.LogFormat)
+
+	errs = overrideWithEnvMap("NOZZLE_STATICATTRIBUTES", &config.StaticAttributes, errs)
+	errs = overrideWithEnvUint32("NOZZLE_MAXSERIES", &config.MaxSeries, errs)
+	errs = overrideWithEnvUint32("NOZZLE_MAXSERIESPERORIGIN", &config.MaxSeriesPerOrigin, errs)
+	errs = overrideWithEnvUint32("NOZZLE_MAXCLOCKSKEWSECONDS", &config.MaxClockSkewSeconds, errs)
+	errs = overrideWithEnvUint32("NOZZLE_FLUSHDURATIONSECONDS", &config.FlushDurationSeconds, errs)
+	errs = overrideWithEnvUint32("NOZZLE_READYFLUSHINTERVALS", &config.ReadyFlushIntervals, errs)
+	errs = overrideWithEnvUint32("NOZZLE_INGESTQUEUESIZE", &config.IngestQueueSize, errs)
+	errs = overrideWithEnvUint32("NOZZLE_AGGREGATIONWORKERS", &config.AggregationWorkers, errs)
+	errs = overrideWithEnvUint32("NOZZLE_SLOWCONSUMERQUEUEDEPTH", &config.SlowConsumerQueueDepth, errs)
+	errs = overrideWithEnvUint32("NOZZLE_SLOWCONSUMERHOLDSECONDS", &config.SlowConsumerHoldSeconds, errs)
+	errs = overrideWithEnvUint32("NOZZLE_DEBUGSINKMAXMB", &config.DebugSinkMaxMB, errs)
+	errs = overrideWithEnvUint32("NOZZLE_DEBUGSINKMAXFILES", &config.DebugSinkMaxFiles, errs)
+	errs = overrideWithEnvUint32("NOZZLE_TAPRATEPERSECOND", &config.TapRatePerSecond, errs)
+	errs = overrideWithEnvUint32("NOZZLE_TAPMAXCLIENTS", &config.TapMaxClients, errs)
+	errs = overrideWithEnvUint32("NOZZLE_PUSHMAXBYTES", &config.PushMaxBytes, errs)
+	errs = overrideWithEnvUint32("NOZZLE_RIEMANN_MAXRETRIES", &config.RiemannMaxRetries, errs)
+	errs = overrideWithEnvUint32("NOZZLE_RIEMANN_RETRYBACKOFFMS", &config.RiemannRetryBackoffMs, errs)
+	errs = overrideWithEnvUint32("NOZZLE_RIEMANN_MAXBACKOFFMS", &config.RiemannMaxBackoffMs, errs)
+	errs = overrideWithEnvUint32("NOZZLE_CANARYINTERVALSECONDS", &config.CanaryIntervalSeconds, errs)
+	errs = overrideWithEnvUint32("NOZZLE_CANARYTIMEOUTSECONDS", &config.CanaryTimeoutSeconds, errs)
+
+	errs = overrideWithEnvBool("NOZZLE_INSECURESSLSKIPVERIFY", &config.InsecureSSLSkipVerify, errs)
+	errs = overrideWithEnvBool("NOZZLE_DISABLEACCESSCONTROL", &config.DisableAccessControl, errs)
+	errs = overrideWithEnvBool("NOZZLE_DRYRUN", &config.DryRun, errs)
+	errs = overrideWithEnvUint32("NOZZLE_IDLETIMEOUTSECONDS", &config.IdleTimeoutSeconds, errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+func parseFile(configPath string, config *NozzleConfig) error {
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("Can not read config file [%s]: %s", configPath, err)
+	}
+
+	extension := strings.ToLower(filepath.Ext(configPath))
+	if extension == ".yml" || extension == ".yaml" {
+		configBytes, err = yamlToJSON(configBytes)
+		if err != nil {
+			return fmt.Errorf("Can not parse config file %s: %s", configPath, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(configBytes))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("Can not parse config file %s: %s", configPath, err)
+	}
+	return nil
+}
+
+// yamlToJSON converts a YAML document to JSON so that both formats go through
+// the same strict decoder and accept the same keys. Bare numbers and booleans
+// under string fields, such as RiemannPort: 5555, become strings, since YAML
+// written for BOSH or CF rarely quotes them.
+func yamlToJSON(yamlBytes []byte) ([]byte, error) {
+	var document interface{}
+	err := yaml.Unmarshal(yamlBytes, &document)
+	if err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return []byte("{}"), nil
+	}
+
+	document, err = convertYAML(document, reflect.TypeOf(NozzleConfig{}))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// convertYAML turns the maps YAML decodes into ones JSON can encode and
+// scalars under string fields of target into strings. target is nil where
+// the document has keys the config does not, which the decoder rejects.
+func convertYAML(value interface{}, target reflect.Type) (interface{}, error) {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(typed))
+		for key, element := range typed {
+			stringKey, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			convertedElement, err := convertYAML(element, elementType(target, stringKey))
+			if err != nil {
+				return nil, err
+			}
+			converted[stringKey] = convertedElement
+		}
+		return converted, nil
+	case []interface{}:
+		var element reflect.Type
+		if target != nil && target.Kind() == reflect.Slice {
+			element = target.Elem()
+		}
+		for i, item := range typed {
+			convertedItem, err := convertYAML(item, element)
+			if err != nil {
+				return nil, err
+			}
+			typed[i] = convertedItem
+		}
+		return typed, nil
+	case int, int64, uint64, float64, bool:
+		if target != nil && target.Kind() == reflect.String {
+			return fmt.Sprint(typed), nil
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
+
+// elementType is the type of key within target, matching struct fields
+// without regard to case as the JSON decoder does.
+func elementType(target reflect.Type, key string) reflect.Type {
+	if target == nil {
+		return nil
+	}
+	switch target.Kind() {
+	case reflect.Map:
+		return target.Elem()
+	case reflect.Struct:
+		for i := 0; i < target.NumField(); i++ {
+			if strings.EqualFold(target.Field(i).Name, key) {
+				return target.Field(i).Type
+			}
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with secrets masked, suitable for
+// printing.
+func (c *NozzleConfig) Redacted() *NozzleConfig {
+	redacted := *c
+	redactString(&redacted.Password)
+	redactString(&redacted.TapToken)
+	redactString(&redacted.PushToken)
+	redactString(&redacted.SyslogTLSKey)
+	redacted.Foundations = make([]FoundationConfig, len(c.Foundations))
+	for i, foundation := range c.Foundations {
+		redactString(&foundation.Password)
+		redacted.Foundations[i] = foundation
+	}
+	return &redacted
+}
+
+func redactString(value *string) {
+	if *value != "" {
+		*value = "REDACTED"
+	}
+}
+
+// Logger builds the logger described by LogLevel and LogFormat.
+func (c *NozzleConfig) Logger(out io.Writer) (*nozzlelogger.Logger, error) {
+	level, err := nozzlelogger.ParseLevel(c.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	return nozzlelogger.New(out, level, c.LogFormat), nil
+}
+
+// DebugSinkOnStdout reports whether the debug sink writes its JSON lines to
+// stdout, as it does on a dry run without a DebugSinkPath. Logs then go to
+// stderr so the two do not mix.
+func (c *NozzleConfig) DebugSinkOnStdout() bool {
+	return c.DebugSinkPath == "stdout" || (c.DebugSinkPath == "" && c.DryRun)
+}
+
+// TLSConfig returns the client TLS settings for connections to the UAA and
+// the traffic controller. CACert, when set, replaces the system roots.
+func (c *NozzleConfig) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSSLSkipVerify}
+	if c.CACert != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(c.CACert)) {
+			return nil, fmt.Errorf("CACert does not contain a PEM encoded certificate")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// SyslogTLSConfig returns the server TLS settings for the syslog listener,
+// or nil if it takes plain TCP.
+func (c *NozzleConfig) SyslogTLSConfig() (*tls.Config, error) {
+	if c.SyslogTLSCert == "" && c.SyslogTLSKey == "" {
+		return nil, nil
+	}
+	certificate, err := tls.X509KeyPair([]byte(c.SyslogTLSCert), []byte(c.SyslogTLSKey))
+	if err != nil {
+		return nil, fmt.Errorf("SyslogTLSCert and SyslogTLSKey are not a valid key pair: %s", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}, nil
+}
+
+// Validate checks the settings the nozzle needs to start and returns every
+// problem it finds as ValidationErrors, or nil if the config is usable.
+func (c *NozzleConfig) Validate() error {
+	var errs ValidationErrors
+
+	// A dry run never contacts Riemann, so it does not need to know where
+	// it is.
+	if len(c.RiemannEndpoints) > 0 {
+		for i, endpoint := range c.RiemannEndpoints {
+			host, port, err := net.SplitHostPort(endpoint)
+			if err != nil || host == "" || !isPort(port) {
+				errs = append(errs, fmt.Errorf("RiemannEndpoints[%d] must be a host:port, got %q", i, endpoint))
+			}
+		}
+	} else if !c.DryRun {
+		if c.RiemannHost == "" {
+			errs = append(errs, fmt.Errorf("RiemannHost is required unless RiemannEndpoints or DryRun is set"))
+		}
+		if !isPort(c.RiemannPort) {
+			errs = append(errs, fmt.Errorf("RiemannPort must be a port number between 1 and 65535, got %q", c.RiemannPort))
+		}
+	}
+	if !riemannclient.IsBalancing(c.RiemannBalancing) {
+		errs = append(errs, fmt.Errorf("RiemannBalancing must be %q, %q or %q, got %q", riemannclient.BalanceFailover, riemannclient.BalanceRoundRobin, riemannclient.BalanceHash, c.RiemannBalancing))
+	}
+	if c.RiemannTransport != "tcp" && c.RiemannTransport != "udp" {
+		errs = append(errs, fmt.Errorf("RiemannTransport must be \"tcp\" or \"udp\", got %q", c.RiemannTransport))
+	}
+	if c.RiemannRetryBackoffMs > c.RiemannMaxBackoffMs {
+		errs = append(errs, fmt.Errorf("RiemannRetryBackoffMs (%d) must not exceed RiemannMaxBackoffMs (%d)", c.RiemannRetryBackoffMs, c.RiemannMaxBackoffMs))
+	}
+	if c.CanaryIntervalSeconds > 0 && (c.CanaryTimeoutSeconds == 0 || c.CanaryTimeoutSeconds > c.CanaryIntervalSeconds) {
+		errs = append(errs, fmt.Errorf("CanaryTimeoutSeconds must be between 1 and CanaryIntervalSeconds (%d), got %d", c.CanaryIntervalSeconds, c.CanaryTimeoutSeconds))
+	}
+	if c.SeriesOverflow != "collapse" && c.SeriesOverflow != "drop" {
+		errs = append(errs, fmt.Errorf("SeriesOverflow must be \"collapse\" or \"drop\", got %q", c.SeriesOverflow))
+	}
+	if c.ClockSkewAction != riemannclient.SkewClamp && c.ClockSkewAction != riemannclient.SkewDrop {
+		errs = append(errs, fmt.Errorf("ClockSkewAction must be %q or %q, got %q", riemannclient.SkewClamp, riemannclient.SkewDrop, c.ClockSkewAction))
+	}
+	for name := range c.StaticAttributes {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("StaticAttributes must not have an empty name"))
+		}
+	}
+	for i, rule := range c.Rollups {
+		if err := rule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("Rollups[%d]: %s", i, err))
+		}
+	}
+	if c.FlushDurationSeconds == 0 {
+		errs = append(errs, fmt.Errorf("FlushDurationSeconds must be greater than 0"))
+	}
+	if c.ReadyFlushIntervals == 0 {
+		errs = append(errs, fmt.Errorf("ReadyFlushIntervals must be greater than 0"))
+	}
+	if c.AggregationWorkers == 0 {
+		errs = append(errs, fmt.Errorf("AggregationWorkers must be greater than 0"))
+	}
+	if c.SlowConsumerQueueDepth > c.IngestQueueSize {
+		errs = append(errs, fmt.Errorf("SlowConsumerQueueDepth (%d) must not exceed IngestQueueSize (%d)", c.SlowConsumerQueueDepth, c.IngestQueueSize))
+	}
+	if c.TapToken != "" && c.TapRatePerSecond == 0 {
+		errs = append(errs, fmt.Errorf("TapRatePerSecond must be greater than 0 when TapToken is set"))
+	}
+	if c.TapToken != "" && c.TapMaxClients == 0 {
+		errs = append(errs, fmt.Errorf("TapMaxClients must be greater than 0 when TapToken is set"))
+	}
+	if c.PushToken != "" && c.PushMaxBytes == 0 {
+		errs = append(errs, fmt.Errorf("PushMaxBytes must be greater than 0 when PushToken is set"))
+	}
+
+	if _, err := nozzlelogger.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LogLevel: %s", err))
+	}
+	if c.LogFormat != nozzlelogger.FormatJSON && c.LogFormat != nozzlelogger.FormatLogfmt {
+		errs = append(errs, fmt.Errorf("LogFormat must be %q or %q, got %q", nozzlelogger.FormatJSON, nozzlelogger.FormatLogfmt, c.LogFormat))
+	}
+	if c.SyslogListenAddress != "" {
+		_, port, err := net.SplitHostPort(c.SyslogListenAddress)
+		if err != nil || !isPort(port) {
+			errs = append(errs, fmt.Errorf("SyslogListenAddress must be a host:port, got %q", c.SyslogListenAddress))
+		}
+		if _, err := c.SyslogTLSConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.CACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(c.CACert)) {
+		errs = append(errs, fmt.Errorf("CACert does not contain a PEM encoded certificate"))
+	}
+
+	if len(c.Foundations) == 0 {
+		errs = validateFoundation("", c.FoundationConfigs()[0], errs)
+	}
+	names := make(map[string]bool, len(c.Foundations))
+	for i, foundation := range c.Foundations {
+		prefix := fmt.Sprintf("Foundations[%d].", i)
+		if foundation.Name == "" {
+			errs = append(errs, fmt.Errorf("%sName is required", prefix))
+		} else if names[foundation.Name] {
+			errs = append(errs, fmt.Errorf("%sName %q is used by another foundation", prefix, foundation.Name))
+		}
+		names[foundation.Name] = true
+		errs = validateFoundation(prefix, foundation, errs)
+	}
 
-	overrideWithEnvUint32("NOZZLE_FLUSHDURATIONSECONDS", &config.FlushDurationSeconds)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// FoundationConfigs returns the foundations to read from: Foundations if
+// set, otherwise a single unnamed one made of the top-level settings.
+func (c *NozzleConfig) FoundationConfigs() []FoundationConfig {
+	if len(c.Foundations) > 0 {
+		foundations := make([]FoundationConfig, len(c.Foundations))
+		for i, foundation := range c.Foundations {
+			if foundation.FirehoseSubscriptionID == "" {
+				foundation.FirehoseSubscriptionID = c.FirehoseSubscriptionID
+			}
+			foundations[i] = foundation
+		}
+		return foundations
+	}
+	return []FoundationConfig{{
+		UAAURL:                 c.UAAURL,
+		Username:               c.Username,
+		Password:               c.Password,
+		TrafficControllerURL:   c.TrafficControllerURL,
+		RLPGatewayURL:          c.RLPGatewayURL,
+		FirehoseSubscriptionID: c.FirehoseSubscriptionID,
+		DisableAccessControl:   c.DisableAccessControl,
+	}}
+}
+
+func validateFoundation(prefix string, foundation FoundationConfig, errs ValidationErrors) ValidationErrors {
+	if foundation.RLPGatewayURL != "" {
+		errs = validateURL(prefix+"RLPGatewayURL", foundation.RLPGatewayURL, []string{"http", "https"}, errs)
+	} else {
+		errs = validateURL(prefix+"TrafficControllerURL", foundation.TrafficControllerURL, []string{"ws", "wss"}, errs)
+	}
+	if !foundation.DisableAccessControl {
+		errs = validateURL(prefix+"UAAURL", foundation.UAAURL, []string{"http", "https"}, errs)
+		if foundation.Username == "" {
+			errs = append(errs, fmt.Errorf("%sUsername is required unless DisableAccessControl is set", prefix))
+		}
+	}
+	return errs
+}
+
+// RiemannAddresses returns the host:port of every Riemann server to send
+// to: RiemannEndpoints if set, otherwise RiemannHost and RiemannPort.
+func (c *NozzleConfig) RiemannAddresses() []string {
+	if len(c.RiemannEndpoints) > 0 {
+		return c.RiemannEndpoints
+	}
+	return []string{net.JoinHostPort(c.RiemannHost, c.RiemannPort)}
+}
 
-	overrideWithEnvBool("NOZZLE_INSECURESSLSKIPVERIFY", &config.InsecureSSLSkipVerify)
-	overrideWithEnvBool("NOZZLE_DISABLEACCESSCONTROL", &config.DisableAccessControl)
-	overrideWithEnvUint32("NOZZLE_IDLETIMEOUTSECONDS", &config.IdleTimeoutSeconds)
-	return &config, nil
+func isPort(value string) bool {
+	port, err := strconv.Atoi(value)
+	return err == nil && port >= 1 && port <= 65535
+}
+
+func validateURL(name string, value string, schemes []string, errs ValidationErrors) ValidationErrors {
+	if value == "" {
+		return append(errs, fmt.Errorf("%s is required", name))
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return append(errs, fmt.Errorf("%s is not a valid URL: %s", name, err))
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			return errs
+		}
+	}
+	return append(errs, fmt.Errorf("%s must use one of the schemes %s, got %q", name, strings.Join(schemes, ", "), value))
 }
 
 func overrideWithEnvVar(name string, value *string) {
@@ -63,24 +578,63 @@ func overrideWithEnvVar(name string, value *string) {
 	}
 }
 
-func overrideWithEnvUint32(name string, value *uint32) {
+// overrideWithEnvList reads a comma separated list, ignoring blank entries.
+func overrideWithEnvList(name string, value *[]string) {
+	envValue := os.Getenv(name)
+	if envValue == "" {
+		return
+	}
+	var list []string
+	for _, element := range strings.Split(envValue, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	*value = list
+}
+
+// overrideWithEnvMap reads a comma separated list of name=value pairs,
+// ignoring blank entries.
+func overrideWithEnvMap(name string, value *map[string]string, errs ValidationErrors) ValidationErrors {
+	envValue := os.Getenv(name)
+	if envValue == "" {
+		return errs
+	}
+	pairs := make(map[string]string)
+	for _, element := range strings.Split(envValue, ",") {
+		if element = strings.TrimSpace(element); element == "" {
+			continue
+		}
+		equals := strings.IndexByte(element, '=')
+		if equals <= 0 {
+			return append(errs, fmt.Errorf("%s must be a comma separated list of name=value pairs, got %q", name, envValue))
+		}
+		pairs[element[:equals]] = element[equals+1:]
+	}
+	*value = pairs
+	return errs
+}
+
+func overrideWithEnvUint32(name string, value *uint32, errs ValidationErrors) ValidationErrors {
 	envValue := os.Getenv(name)
 	if envValue != "" {
-		tmpValue, err := strconv.Atoi(envValue)
+		tmpValue, err := strconv.ParseUint(envValue, 10, 32)
 		if err != nil {
-			panic(err)
+			return append(errs, fmt.Errorf("%s must be a non-negative integer, got %q", name, envValue))
 		}
 		*value = uint32(tmpValue)
 	}
+	return errs
 }
 
-func overrideWithEnvBool(name string, value *bool) {
+func overrideWithEnvBool(name string, value *bool, errs ValidationErrors) ValidationErrors {
 	envValue := os.Getenv(name)
 	if envValue != "" {
-		var err error
-		*value, err = strconv.ParseBool(envValue)
+		tmpValue, err := strconv.ParseBool(envValue)
 		if err != nil {
-			panic(err)
+			return append(errs, fmt.Errorf("%s must be true or false, got %q", name, envValue))
 		}
+		*value = tmpValue
 	}
+	return errs
 }
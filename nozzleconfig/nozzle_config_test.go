@@ -1,10 +1,12 @@
 package nozzleconfig_test
 
 import (
-	"github.com/18F/influxdb-firehose-nozzle/nozzleconfig"
+	"github.com/18F/riemann-firehose-nozzle/nozzleconfig"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 var _ = Describe("NozzleConfig", func() {
@@ -13,46 +15,509 @@ var _ = Describe("NozzleConfig", func() {
 	})
 
 	It("successfully parses a valid config", func() {
-		conf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		conf, err := nozzleconfig.Parse("../config/riemann-firehose-nozzle.json")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(conf.UAAURL).To(Equal("https://uaa.walnut.cf-app.com"))
-		Expect(conf.Username).To(Equal("user"))
-		Expect(conf.Password).To(Equal("user_password"))
-		Expect(conf.DataDogURL).To(Equal("https://app.datadoghq.com/api/v1/series"))
-		Expect(conf.DataDogAPIKey).To(Equal("<enter api key>"))
+		Expect(conf.UAAURL).To(Equal("https://uaa.on18F.rocks"))
+		Expect(conf.Username).To(Equal("riemann-firehose-nozzle"))
+		Expect(conf.Password).To(Equal("c1oudc0w"))
+		Expect(conf.RiemannHost).To(Equal("localhost"))
+		Expect(conf.RiemannPort).To(Equal("5555"))
+		Expect(conf.RiemannTransport).To(Equal("tcp"))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
 		Expect(conf.InsecureSSLSkipVerify).To(Equal(true))
-		Expect(conf.MetricPrefix).To(Equal("datadogclient"))
-		Expect(conf.Deployment).To(Equal("deployment-name"))
+		Expect(conf.MetricPrefix).To(Equal("cf"))
+		Expect(conf.Deployment).To(Equal("cf-ops"))
 		Expect(conf.DisableAccessControl).To(Equal(false))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(60))
+		Expect(conf.Validate()).To(Succeed())
 	})
 
 	It("successfully overwrites file config values with environmental variables", func() {
 		os.Setenv("NOZZLE_UAAURL", "https://uaa.walnut-env.cf-app.com")
 		os.Setenv("NOZZLE_USERNAME", "env-user")
 		os.Setenv("NOZZLE_PASSWORD", "env-user-password")
-		os.Setenv("NOZZLE_DATADOGURL", "https://app.datadoghq-env.com/api/v1/series")
-		os.Setenv("NOZZLE_DATADOGAPIKEY", "envapi-key>")
+		os.Setenv("NOZZLE_RIEMANN_HOST", "riemann.example.com")
+		os.Setenv("NOZZLE_RIEMANN_PORT", "5556")
+		os.Setenv("NOZZLE_RIEMANN_TRANSPORT", "udp")
 		os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "25")
 		os.Setenv("NOZZLE_INSECURESSLSKIPVERIFY", "false")
-		os.Setenv("NOZZLE_METRICPREFIX", "env-datadogclient")
+		os.Setenv("NOZZLE_METRICPREFIX", "env-riemannclient")
 		os.Setenv("NOZZLE_DEPLOYMENT", "env-deployment-name")
 		os.Setenv("NOZZLE_DISABLEACCESSCONTROL", "true")
 		os.Setenv("NOZZLE_IDLETIMEOUTSECONDS", "30")
+		os.Setenv("CF_INSTANCE_INDEX", "2")
 
-		conf, err := nozzleconfig.Parse("../config/datadog-firehose-nozzle.json")
+		conf, err := nozzleconfig.Parse("../config/riemann-firehose-nozzle.json")
 		Expect(err).ToNot(HaveOccurred())
 		Expect(conf.UAAURL).To(Equal("https://uaa.walnut-env.cf-app.com"))
 		Expect(conf.Username).To(Equal("env-user"))
 		Expect(conf.Password).To(Equal("env-user-password"))
-		Expect(conf.DataDogURL).To(Equal("https://app.datadoghq-env.com/api/v1/series"))
-		Expect(conf.DataDogAPIKey).To(Equal("envapi-key>"))
+		Expect(conf.RiemannHost).To(Equal("riemann.example.com"))
+		Expect(conf.RiemannPort).To(Equal("5556"))
+		Expect(conf.RiemannTransport).To(Equal("udp"))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(25))
 		Expect(conf.InsecureSSLSkipVerify).To(Equal(false))
-		Expect(conf.MetricPrefix).To(Equal("env-datadogclient"))
+		Expect(conf.MetricPrefix).To(Equal("env-riemannclient"))
 		Expect(conf.Deployment).To(Equal("env-deployment-name"))
 		Expect(conf.DisableAccessControl).To(Equal(true))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(30))
+		Expect(conf.InstanceIndex).To(Equal("2"))
+	})
+
+	Context("with a hand-written config file", func() {
+		var dir string
+		var configPath string
+
+		writeFile := func(name string, contents string) string {
+			path := filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+			return path
+		}
+
+		writeConfig := func(contents string) {
+			writeFile("config.json", contents)
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "nozzleconfig")
+			Expect(err).ToNot(HaveOccurred())
+			configPath = filepath.Join(dir, "config.json")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("reads YAML files by extension", func() {
+			path := writeFile("config.yml", `
+RiemannHost: riemann.example.com
+RiemannPort: 5556
+FlushDurationSeconds: 30
+DisableAccessControl: true
+`)
+
+			conf, err := nozzleconfig.Parse(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.RiemannHost).To(Equal("riemann.example.com"))
+			Expect(conf.RiemannPort).To(Equal("5556"))
+			Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(30))
+			Expect(conf.DisableAccessControl).To(BeTrue())
+		})
+
+		It("reads bare numbers and booleans under string fields as strings", func() {
+			path := writeFile("config.yml", `
+RiemannPort: 5555
+Deployment: 2
+MetricPrefix: true
+`)
+
+			conf, err := nozzleconfig.Parse(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.RiemannPort).To(Equal("5555"))
+			Expect(conf.Deployment).To(Equal("2"))
+			Expect(conf.MetricPrefix).To(Equal("true"))
+		})
+
+		It("still rejects strings under number fields", func() {
+			path := writeFile("config.yml", `FlushDurationSeconds: soon`)
+
+			_, err := nozzleconfig.Parse(path)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reads rollup rules", func() {
+			path := writeFile("config.yml", `
+Rollups:
+- Match: gorouter.*
+  Aggregations: [mean, p99]
+- Match: "*"
+  Aggregations: [last]
+`)
+
+			conf, err := nozzleconfig.Parse(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Rollups).To(HaveLen(2))
+			Expect(conf.Rollups[0].Match).To(Equal("gorouter.*"))
+			Expect(conf.Rollups[0].Aggregations).To(Equal([]string{"mean", "p99"}))
+		})
+
+		It("rejects unknown aggregations", func() {
+			writeConfig(`{"Rollups": [{"Match": "*", "Aggregations": ["median"]}]}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Validate().Error()).To(ContainSubstring(`Rollups[0]: unknown aggregation "median"`))
+		})
+
+		It("rejects unknown keys in YAML files", func() {
+			path := writeFile("config.yaml", "RiemannHots: localhost\n")
+
+			_, err := nozzleconfig.Parse(path)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("RiemannHots"))
+		})
+
+		It("merges several files in order, with the environment on top", func() {
+			base := writeFile("base.json", `{"RiemannHost": "base", "Deployment": "base", "MetricPrefix": "cf."}`)
+			overlay := writeFile("overlay.yml", "RiemannHost: overlay\nDeployment: overlay\n")
+			os.Setenv("NOZZLE_DEPLOYMENT", "env")
+
+			conf, err := nozzleconfig.Parse(base, overlay)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.MetricPrefix).To(Equal("cf."))
+			Expect(conf.RiemannHost).To(Equal("overlay"))
+			Expect(conf.Deployment).To(Equal("env"))
+		})
+
+		It("redacts secrets when dumping the config", func() {
+			writeConfig(`{"Username": "user", "Password": "secret", "TapToken": "tap-secret"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Redacted().Password).To(Equal("REDACTED"))
+			Expect(conf.Redacted().TapToken).To(Equal("REDACTED"))
+			Expect(conf.Redacted().Username).To(Equal("user"))
+			Expect(conf.Password).To(Equal("secret"))
+		})
+
+		Context("when a service is bound in VCAP_SERVICES", func() {
+			BeforeEach(func() {
+				os.Setenv("VCAP_SERVICES", `{
+					"user-provided": [
+						{"name": "other", "tags": [], "credentials": {"username": "wrong"}},
+						{
+							"name": "riemann-nozzle-creds",
+							"tags": ["riemann-nozzle"],
+							"credentials": {
+								"username": "vcap-user",
+								"password": "vcap-password",
+								"riemann_host": "riemann.vcap.example.com",
+								"riemann_port": 5557
+							}
+						}
+					]
+				}`)
+				writeConfig(`{"Username": "file-user", "Password": "file-password", "RiemannHost": "file-host", "VCAPServiceName": "riemann-nozzle-creds"}`)
+			})
+
+			It("prefers the bound credentials over the config file", func() {
+				conf, err := nozzleconfig.Parse(configPath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conf.Username).To(Equal("vcap-user"))
+				Expect(conf.Password).To(Equal("vcap-password"))
+				Expect(conf.RiemannHost).To(Equal("riemann.vcap.example.com"))
+				Expect(conf.RiemannPort).To(Equal("5557"))
+			})
+
+			It("lets explicit environment variables win over the binding", func() {
+				os.Setenv("NOZZLE_PASSWORD", "env-password")
+
+				conf, err := nozzleconfig.Parse(configPath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conf.Username).To(Equal("vcap-user"))
+				Expect(conf.Password).To(Equal("env-password"))
+			})
+
+			It("finds the service by tag", func() {
+				writeConfig(`{"VCAPServiceTag": "riemann-nozzle"}`)
+
+				conf, err := nozzleconfig.Parse(configPath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conf.Username).To(Equal("vcap-user"))
+			})
+
+			It("returns an error when no bound service matches", func() {
+				os.Setenv("NOZZLE_VCAPSERVICENAME", "missing")
+
+				_, err := nozzleconfig.Parse(configPath)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`named "missing"`))
+			})
+		})
+
+		It("fills in defaults for settings that are not given", func() {
+			writeConfig(`{"RiemannHost": "localhost"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.RiemannPort).To(Equal("5555"))
+			Expect(conf.RiemannTransport).To(Equal("tcp"))
+			Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
+			Expect(conf.ReadyFlushIntervals).To(BeEquivalentTo(3))
+			Expect(conf.InstanceIndex).To(Equal("0"))
+			Expect(conf.MaxSeries).To(BeZero())
+			Expect(conf.SeriesOverflow).To(Equal("collapse"))
+		})
+
+		It("rejects unknown keys", func() {
+			writeConfig(`{"RiemannHots": "localhost"}`)
+
+			_, err := nozzleconfig.Parse(configPath)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("RiemannHots"))
+		})
+
+		It("returns an error instead of panicking on bad environment values", func() {
+			writeConfig(`{}`)
+			os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "soon")
+			os.Setenv("NOZZLE_DISABLEACCESSCONTROL", "maybe")
+
+			_, err := nozzleconfig.Parse(configPath)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(nozzleconfig.ValidationErrors)).To(HaveLen(2))
+			Expect(err.Error()).To(ContainSubstring("NOZZLE_FLUSHDURATIONSECONDS"))
+			Expect(err.Error()).To(ContainSubstring("NOZZLE_DISABLEACCESSCONTROL"))
+		})
+
+		It("reads a list of Riemann endpoints from the environment", func() {
+			writeConfig(`{"RiemannHost": "ignored", "RiemannBalancing": "hash"}`)
+			os.Setenv("NOZZLE_RIEMANN_ENDPOINTS", "riemann-1:5555, riemann-2:5556,")
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.RiemannEndpoints).To(Equal([]string{"riemann-1:5555", "riemann-2:5556"}))
+			Expect(conf.RiemannAddresses()).To(Equal(conf.RiemannEndpoints))
+			Expect(conf.RiemannBalancing).To(Equal("hash"))
+		})
+
+		It("reads tag filters and static attributes from the environment", func() {
+			writeConfig(`{"StaticAttributes": {"environment": "file"}, "DeniedTags": ["instance_id"]}`)
+			os.Setenv("NOZZLE_ALLOWEDTAGS", "source_id, zone")
+			os.Setenv("NOZZLE_STATICATTRIBUTES", "environment=production, region=us-east-1,")
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.AllowedTags).To(Equal([]string{"source_id", "zone"}))
+			Expect(conf.DeniedTags).To(Equal([]string{"instance_id"}))
+			Expect(conf.StaticAttributes).To(Equal(map[string]string{"environment": "production", "region": "us-east-1"}))
+
+			os.Setenv("NOZZLE_STATICATTRIBUTES", "production")
+			_, err = nozzleconfig.Parse(configPath)
+			Expect(err).To(MatchError(ContainSubstring("NOZZLE_STATICATTRIBUTES must be a comma separated list of name=value pairs")))
+		})
+
+		It("falls back to RiemannHost and RiemannPort without endpoints", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.RiemannAddresses()).To(Equal([]string{"riemann.example.com:5555"}))
+			Expect(conf.RiemannBalancing).To(Equal("failover"))
+		})
+
+		It("validates Riemann endpoints and balancing", func() {
+			writeConfig(`{"RiemannEndpoints": ["riemann-1:5555", "riemann-2"], "RiemannBalancing": "random"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = conf.Validate()
+			Expect(err.Error()).To(ContainSubstring(`RiemannEndpoints[1] must be a host:port, got "riemann-2"`))
+			Expect(err.Error()).To(ContainSubstring(`RiemannBalancing must be "failover", "round-robin" or "hash", got "random"`))
+			Expect(err.Error()).NotTo(ContainSubstring("RiemannHost is required"))
+		})
+
+		It("reads several foundations", func() {
+			writeConfig(`{"FirehoseSubscriptionID": "riemann-nozzle", "Foundations": [
+				{"Name": "east", "UAAURL": "https://uaa.east.example.com", "Username": "nozzle", "Password": "secret", "TrafficControllerURL": "wss://doppler.east.example.com"},
+				{"Name": "west", "TrafficControllerURL": "wss://doppler.west.example.com", "FirehoseSubscriptionID": "west-nozzle", "DisableAccessControl": true}
+			]}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			foundations := conf.FoundationConfigs()
+			Expect(foundations).To(HaveLen(2))
+			Expect(foundations[0].Name).To(Equal("east"))
+			Expect(foundations[0].Password).To(Equal("secret"))
+			Expect(foundations[0].FirehoseSubscriptionID).To(Equal("riemann-nozzle"))
+			Expect(foundations[1].FirehoseSubscriptionID).To(Equal("west-nozzle"))
+			Expect(foundations[1].DisableAccessControl).To(BeTrue())
+			Expect(conf.Redacted().Foundations[0].Password).To(Equal("REDACTED"))
+			Expect(conf.Foundations[0].Password).To(Equal("secret"))
+		})
+
+		It("makes a single unnamed foundation of the top-level settings", func() {
+			writeConfig(`{"UAAURL": "https://uaa.example.com", "TrafficControllerURL": "wss://doppler.example.com", "FirehoseSubscriptionID": "riemann-nozzle"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.FoundationConfigs()).To(Equal([]nozzleconfig.FoundationConfig{{
+				UAAURL:                 "https://uaa.example.com",
+				Username:               conf.Username,
+				Password:               conf.Password,
+				TrafficControllerURL:   "wss://doppler.example.com",
+				FirehoseSubscriptionID: "riemann-nozzle",
+			}}))
+		})
+
+		It("validates each foundation", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com", "Foundations": [
+				{"Name": "east", "TrafficControllerURL": "https://doppler.east.example.com", "DisableAccessControl": true},
+				{"Name": "east", "TrafficControllerURL": "wss://doppler.west.example.com", "UAAURL": "https://uaa.west.example.com"},
+				{"TrafficControllerURL": "wss://doppler.north.example.com", "DisableAccessControl": true}
+			]}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = conf.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Foundations[0].TrafficControllerURL"))
+			Expect(err.Error()).To(ContainSubstring(`Foundations[1].Name "east" is used by another foundation`))
+			Expect(err.Error()).To(ContainSubstring("Foundations[1].Username is required"))
+			Expect(err.Error()).To(ContainSubstring("Foundations[2].Name is required"))
+			Expect(err.Error()).NotTo(ContainSubstring(" UAAURL"))
+		})
+
+		It("reads from an RLP gateway in place of the traffic controller", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com", "DisableAccessControl": true, "RLPGatewayURL": "wss://log-stream.example.com"}`)
+			os.Setenv("NOZZLE_RLPGATEWAYURL", "https://log-stream.example.com")
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.FoundationConfigs()[0].RLPGatewayURL).To(Equal("https://log-stream.example.com"))
+			Expect(conf.Validate()).To(Succeed())
+
+			conf.RLPGatewayURL = "wss://log-stream.example.com"
+			err = conf.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("RLPGatewayURL"))
+			Expect(err.Error()).NotTo(ContainSubstring("TrafficControllerURL"))
+		})
+
+		It("validates the syslog listener settings", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com", "DisableAccessControl": true, "TrafficControllerURL": "wss://doppler.example.com",
+				"SyslogListenAddress": ":6514", "SyslogTLSCert": "not a certificate", "SyslogTLSKey": "not a key"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Redacted().SyslogTLSKey).To(Equal("REDACTED"))
+
+			err = conf.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("SyslogTLSCert and SyslogTLSKey are not a valid key pair"))
+			Expect(err.Error()).NotTo(ContainSubstring("SyslogListenAddress"))
+
+			conf.SyslogTLSCert = ""
+			conf.SyslogTLSKey = ""
+			Expect(conf.Validate()).To(Succeed())
+			Expect(conf.SyslogTLSConfig()).To(BeNil())
+
+			conf.SyslogListenAddress = "6514"
+			Expect(conf.Validate()).To(MatchError(ContainSubstring(`SyslogListenAddress must be a host:port, got "6514"`)))
+		})
+
+		It("keeps the slow consumer queue depth within the ingest queue", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com", "DisableAccessControl": true, "TrafficControllerURL": "wss://doppler.example.com"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.IngestQueueSize).To(Equal(uint32(10000)))
+			Expect(conf.SlowConsumerQueueDepth).To(Equal(uint32(5000)))
+			Expect(conf.SlowConsumerHoldSeconds).To(Equal(uint32(60)))
+			Expect(conf.Validate()).To(Succeed())
+
+			conf.IngestQueueSize = 1000
+			Expect(conf.Validate()).To(MatchError(ContainSubstring("SlowConsumerQueueDepth (5000) must not exceed IngestQueueSize (1000)")))
+		})
+
+		It("aggregates in the main loop unless told to use more workers", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com", "DisableAccessControl": true, "TrafficControllerURL": "wss://doppler.example.com"}`)
+			os.Setenv("NOZZLE_AGGREGATIONWORKERS", "0")
+			defer os.Unsetenv("NOZZLE_AGGREGATIONWORKERS")
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.AggregationWorkers).To(Equal(uint32(0)))
+			Expect(conf.Validate()).To(MatchError(ContainSubstring("AggregationWorkers must be greater than 0")))
+
+			os.Unsetenv("NOZZLE_AGGREGATIONWORKERS")
+			conf, err = nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.AggregationWorkers).To(Equal(uint32(1)))
+		})
+
+		It("validates the clock skew action", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com", "DisableAccessControl": true, "TrafficControllerURL": "wss://doppler.example.com",
+				"MaxClockSkewSeconds": 300}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.MaxClockSkewSeconds).To(Equal(uint32(300)))
+			Expect(conf.ClockSkewAction).To(Equal("clamp"))
+			Expect(conf.Validate()).To(Succeed())
+
+			conf.ClockSkewAction = "ignore"
+			Expect(conf.Validate()).To(MatchError(ContainSubstring(`ClockSkewAction must be "clamp" or "drop", got "ignore"`)))
+		})
+
+		It("redacts and validates the push settings", func() {
+			writeConfig(`{"RiemannHost": "riemann.example.com", "DisableAccessControl": true, "TrafficControllerURL": "wss://doppler.example.com",
+				"PushToken": "secret"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.PushMaxBytes).To(Equal(uint32(1 << 20)))
+			Expect(conf.Redacted().PushToken).To(Equal("REDACTED"))
+			Expect(conf.Validate()).To(Succeed())
+
+			conf.PushMaxBytes = 0
+			Expect(conf.Validate()).To(MatchError(ContainSubstring("PushMaxBytes must be greater than 0 when PushToken is set")))
+		})
+
+		It("limits tap clients when the tap is on", func() {
+			writeConfig(`{"TapToken": "tap-secret", "DryRun": true}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.TapMaxClients).To(Equal(uint32(10)))
+
+			conf.TapMaxClients = 0
+			Expect(conf.Validate()).To(MatchError(ContainSubstring("TapMaxClients must be greater than 0 when TapToken is set")))
+		})
+
+		It("does not require Riemann settings for a dry run", func() {
+			writeConfig(`{"DryRun": true, "DisableAccessControl": true, "TrafficControllerURL": "wss://doppler.example.com"}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Validate()).To(Succeed())
+		})
+
+		It("writes the debug sink to stdout on a dry run without a path", func() {
+			writeConfig(`{"DryRun": true}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.DebugSinkOnStdout()).To(BeTrue())
+
+			conf.DebugSinkPath = "/var/log/events.jsonl"
+			Expect(conf.DebugSinkOnStdout()).To(BeFalse())
+
+			conf.DryRun = false
+			conf.DebugSinkPath = "stdout"
+			Expect(conf.DebugSinkOnStdout()).To(BeTrue())
+		})
+
+		It("reports every validation error at once", func() {
+			writeConfig(`{"RiemannTransport": "http", "FlushDurationSeconds": 0, "ReadyFlushIntervals": 0, "SeriesOverflow": "keep", "CanaryIntervalSeconds": 5, "CanaryTimeoutSeconds": 30}`)
+
+			conf, err := nozzleconfig.Parse(configPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = conf.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("RiemannHost is required"))
+			Expect(err.Error()).To(ContainSubstring("RiemannTransport"))
+			Expect(err.Error()).To(ContainSubstring("FlushDurationSeconds"))
+			Expect(err.Error()).To(ContainSubstring("ReadyFlushIntervals"))
+			Expect(err.Error()).To(ContainSubstring("SeriesOverflow"))
+			Expect(err.Error()).To(ContainSubstring("CanaryTimeoutSeconds"))
+			Expect(err.Error()).To(ContainSubstring("TrafficControllerURL is required"))
+			Expect(err.Error()).To(ContainSubstring("UAAURL is required"))
+			Expect(err.Error()).To(ContainSubstring("Username is required"))
+		})
 	})
 })
@@ -0,0 +1,99 @@
+package nozzleconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type vcapService struct {
+	Name        string                 `json:"name"`
+	Tags        []string               `json:"tags"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// applyVCAPServices fills credentials and the Riemann endpoint from the
+// service bound to the app whose name is VCAPServiceName or whose tags
+// include VCAPServiceTag. Credentials keys that are missing leave the
+// existing values alone.
+func applyVCAPServices(config *NozzleConfig) error {
+	if config.VCAPServiceName == "" && config.VCAPServiceTag == "" {
+		return nil
+	}
+
+	service, err := findVCAPService(os.Getenv("VCAP_SERVICES"), config.VCAPServiceName, config.VCAPServiceTag)
+	if err != nil {
+		return err
+	}
+
+	credentials := service.Credentials
+	setFromCredentials(credentials, &config.Username, "username", "client_id")
+	setFromCredentials(credentials, &config.Password, "password", "client_secret")
+	setFromCredentials(credentials, &config.UAAURL, "uaa_url")
+	setFromCredentials(credentials, &config.RiemannHost, "riemann_host")
+	setFromCredentials(credentials, &config.RiemannPort, "riemann_port")
+	setFromCredentials(credentials, &config.CACert, "ca_cert")
+	return nil
+}
+
+func findVCAPService(vcapServices string, name string, tag string) (*vcapService, error) {
+	if vcapServices == "" {
+		return nil, fmt.Errorf("VCAP_SERVICES is not set, but a bound service %s was requested", describeSelector(name, tag))
+	}
+
+	var services map[string][]vcapService
+	err := json.Unmarshal([]byte(vcapServices), &services)
+	if err != nil {
+		return nil, fmt.Errorf("Can not parse VCAP_SERVICES: %s", err)
+	}
+
+	for _, instances := range services {
+		for i := range instances {
+			if instances[i].matches(name, tag) {
+				return &instances[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No service %s is bound in VCAP_SERVICES", describeSelector(name, tag))
+}
+
+func (s *vcapService) matches(name string, tag string) bool {
+	if name != "" && s.Name == name {
+		return true
+	}
+	if tag != "" {
+		for _, serviceTag := range s.Tags {
+			if serviceTag == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeSelector(name string, tag string) string {
+	switch {
+	case name != "" && tag != "":
+		return fmt.Sprintf("named %q or tagged %q", name, tag)
+	case name != "":
+		return fmt.Sprintf("named %q", name)
+	default:
+		return fmt.Sprintf("tagged %q", tag)
+	}
+}
+
+func setFromCredentials(credentials map[string]interface{}, value *string, keys ...string) {
+	for _, key := range keys {
+		switch credential := credentials[key].(type) {
+		case string:
+			if credential != "" {
+				*value = credential
+				return
+			}
+		case float64:
+			*value = strconv.FormatFloat(credential, 'f', -1, 64)
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package nozzlehealth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Names of the components the nozzle reports on.
+const (
+	Firehose = "firehose"
+	Riemann  = "riemann"
+	UAA      = "uaa"
+	Canary   = "canary"
+	Syslog   = "syslog"
+	Loop     = "loop"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// ComponentStatus is the state of one component as shown in a Report.
+type ComponentStatus struct {
+	Healthy       bool       `json:"healthy"`
+	Reason        string     `json:"reason,omitempty"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Report is the JSON body served by the health endpoints.
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+func (r Report) Healthy() bool {
+	return r.Status == StatusOK
+}
+
+type component struct {
+	maxAge       time.Duration
+	registeredAt time.Time
+	lastSuccess  time.Time
+	lastFailure  time.Time
+	lastError    string
+}
+
+// Tracker records successes and failures reported by the nozzle and turns
+// them into liveness and readiness reports. The loop component backs
+// liveness; every other registered component backs readiness.
+type Tracker struct {
+	lock       sync.Mutex
+	loop       *component
+	components map[string]*component
+}
+
+// New returns a tracker whose liveness check fails once Heartbeat has not
+// been called for loopMaxAge.
+func New(loopMaxAge time.Duration) *Tracker {
+	return &Tracker{
+		loop:       &component{maxAge: loopMaxAge, registeredAt: time.Now()},
+		components: make(map[string]*component),
+	}
+}
+
+// Register adds a component to the readiness check. A component with a
+// maxAge must succeed at least that often; until its first attempt it is
+// given maxAge to get going. A component without one is ready from its first
+// success until its next failure.
+func (t *Tracker) Register(name string, maxAge time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.components[name] = &component{maxAge: maxAge, registeredAt: time.Now()}
+}
+
+// Unregister removes a component from the readiness check.
+func (t *Tracker) Unregister(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.components, name)
+}
+
+func (t *Tracker) Succeeded(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if c, ok := t.components[name]; ok {
+		c.lastSuccess = time.Now()
+	}
+}
+
+func (t *Tracker) Failed(name string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if c, ok := t.components[name]; ok {
+		c.lastFailure = time.Now()
+		c.lastError = err.Error()
+	}
+}
+
+// Heartbeat marks the nozzle's main loop as alive.
+func (t *Tracker) Heartbeat() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.loop.lastSuccess = time.Now()
+}
+
+func (t *Tracker) Liveness() Report {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return buildReport(map[string]*component{Loop: t.loop}, time.Now())
+}
+
+func (t *Tracker) Readiness() Report {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return buildReport(t.components, time.Now())
+}
+
+func (t *Tracker) LivenessHandler() http.Handler {
+	return reportHandler(t.Liveness)
+}
+
+func (t *Tracker) ReadinessHandler() http.Handler {
+	return reportHandler(t.Readiness)
+}
+
+func reportHandler(report func() Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := report()
+		w.Header().Set("Content-Type", "application/json")
+		if !current.Healthy() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(current)
+	})
+}
+
+func buildReport(components map[string]*component, now time.Time) Report {
+	report := Report{Status: StatusOK, Components: make(map[string]ComponentStatus, len(components))}
+	for name, c := range components {
+		status := c.status(now)
+		if !status.Healthy {
+			report.Status = StatusUnavailable
+		}
+		report.Components[name] = status
+	}
+	return report
+}
+
+func (c *component) status(now time.Time) ComponentStatus {
+	status := ComponentStatus{LastError: c.lastError}
+	if !c.lastSuccess.IsZero() {
+		lastSuccess := c.lastSuccess
+		status.LastSuccessAt = &lastSuccess
+	}
+	if !c.lastFailure.IsZero() {
+		lastFailure := c.lastFailure
+		status.LastErrorAt = &lastFailure
+	}
+
+	switch {
+	case !c.lastFailure.IsZero() && !c.lastFailure.Before(c.lastSuccess):
+		status.Reason = "last attempt failed"
+	case c.lastSuccess.IsZero() && c.maxAge == 0:
+		status.Reason = "not yet succeeded"
+	case c.lastSuccess.IsZero() && now.Sub(c.registeredAt) > c.maxAge:
+		status.Reason = fmt.Sprintf("not succeeded within %s of starting", c.maxAge)
+	case !c.lastSuccess.IsZero() && c.maxAge > 0 && now.Sub(c.lastSuccess) > c.maxAge:
+		status.Reason = fmt.Sprintf("no success in the last %s", c.maxAge)
+	default:
+		status.Healthy = true
+	}
+	return status
+}
@@ -0,0 +1,103 @@
+package nozzlehealth_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlehealth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NozzleHealth", func() {
+	var tracker *nozzlehealth.Tracker
+
+	BeforeEach(func() {
+		tracker = nozzlehealth.New(100 * time.Millisecond)
+	})
+
+	serve := func(handler http.Handler) (int, nozzlehealth.Report) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+		var report nozzlehealth.Report
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).To(Succeed())
+		return recorder.Code, report
+	}
+
+	Describe("liveness", func() {
+		It("is live while the loop keeps beating", func() {
+			code, report := serve(tracker.LivenessHandler())
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(report.Status).To(Equal(nozzlehealth.StatusOK))
+
+			time.Sleep(60 * time.Millisecond)
+			tracker.Heartbeat()
+			time.Sleep(60 * time.Millisecond)
+			Expect(tracker.Liveness().Healthy()).To(BeTrue())
+		})
+
+		It("fails when the loop stops beating", func() {
+			tracker.Heartbeat()
+			time.Sleep(150 * time.Millisecond)
+
+			code, report := serve(tracker.LivenessHandler())
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(report.Components[nozzlehealth.Loop].Reason).To(ContainSubstring("no success"))
+		})
+	})
+
+	Describe("readiness", func() {
+		BeforeEach(func() {
+			tracker.Register(nozzlehealth.Firehose, 0)
+			tracker.Register(nozzlehealth.Riemann, 100*time.Millisecond)
+		})
+
+		It("is not ready until the firehose connects", func() {
+			code, report := serve(tracker.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(report.Components[nozzlehealth.Firehose].Healthy).To(BeFalse())
+			Expect(report.Components[nozzlehealth.Riemann].Healthy).To(BeTrue())
+
+			tracker.Succeeded(nozzlehealth.Firehose)
+			code, report = serve(tracker.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(report.Components[nozzlehealth.Firehose].LastSuccessAt).NotTo(BeNil())
+		})
+
+		It("reports the last error and recovers on the next success", func() {
+			tracker.Succeeded(nozzlehealth.Firehose)
+			tracker.Failed(nozzlehealth.Riemann, errors.New("connection refused"))
+
+			code, report := serve(tracker.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(report.Components[nozzlehealth.Riemann].LastError).To(Equal("connection refused"))
+			Expect(report.Components[nozzlehealth.Riemann].LastErrorAt).NotTo(BeNil())
+
+			tracker.Succeeded(nozzlehealth.Riemann)
+			Expect(tracker.Readiness().Healthy()).To(BeTrue())
+		})
+
+		It("stops being ready when flushes stop succeeding", func() {
+			tracker.Succeeded(nozzlehealth.Firehose)
+			tracker.Succeeded(nozzlehealth.Riemann)
+			Expect(tracker.Readiness().Healthy()).To(BeTrue())
+
+			time.Sleep(150 * time.Millisecond)
+			report := tracker.Readiness()
+			Expect(report.Healthy()).To(BeFalse())
+			Expect(report.Components[nozzlehealth.Riemann].Reason).To(ContainSubstring("no success"))
+		})
+
+		It("ignores components that were never registered", func() {
+			tracker.Succeeded(nozzlehealth.Firehose)
+			tracker.Failed(nozzlehealth.UAA, errors.New("401"))
+
+			Expect(tracker.Readiness().Healthy()).To(BeTrue())
+			Expect(tracker.Readiness().Components).NotTo(HaveKey(nozzlehealth.UAA))
+		})
+	})
+})
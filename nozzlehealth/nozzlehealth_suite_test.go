@@ -0,0 +1,13 @@
+package nozzlehealth_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNozzleHealth(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nozzle Health Suite")
+}
@@ -0,0 +1,205 @@
+package nozzlelogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a config value such as "info" to a Level.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Fields are key/value pairs attached to a log line.
+type Fields map[string]interface{}
+
+// Logger writes one structured line per call, as JSON or logfmt. Loggers
+// derived with With share the writer and its lock. A nil *Logger discards
+// everything, so components can be built without one in tests.
+type Logger struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	level  Level
+	format string
+	fields Fields
+}
+
+func New(out io.Writer, level Level, format string) *Logger {
+	return &Logger{
+		out:    out,
+		lock:   &sync.Mutex{},
+		level:  level,
+		format: format,
+	}
+}
+
+// With returns a logger that adds fields to every line it writes.
+func (l *Logger) With(fields Fields) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	merged := make(Fields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	child := *l
+	child.fields = merged
+	return &child
+}
+
+func (l *Logger) Debug(message string, fields ...Fields) {
+	l.log(Debug, message, fields)
+}
+
+func (l *Logger) Info(message string, fields ...Fields) {
+	l.log(Info, message, fields)
+}
+
+func (l *Logger) Warn(message string, fields ...Fields) {
+	l.log(Warn, message, fields)
+}
+
+func (l *Logger) Error(message string, err error, fields ...Fields) {
+	if err != nil {
+		fields = append(fields, Fields{"error": err.Error()})
+	}
+	l.log(Error, message, fields)
+}
+
+func (l *Logger) log(level Level, message string, extra []Fields) {
+	if l == nil || level < l.level {
+		return
+	}
+
+	line := make(Fields, len(l.fields)+3)
+	for key, value := range l.fields {
+		line[key] = value
+	}
+	for _, fields := range extra {
+		for key, value := range fields {
+			line[key] = value
+		}
+	}
+	line["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["message"] = message
+
+	var encoded []byte
+	if l.format == FormatLogfmt {
+		encoded = encodeLogfmt(line)
+	} else {
+		encoded = encodeJSON(line)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(encoded)
+}
+
+// encodeJSON writes timestamp, level and message first, then the remaining
+// fields in key order, so both encodings read the same way.
+func encodeJSON(line Fields) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, key := range orderedKeys(line) {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		value := line[key]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		encodedValue, err := json.Marshal(value)
+		if err != nil {
+			encodedValue, _ = json.Marshal(fmt.Sprint(value))
+		}
+		encodedKey, _ := json.Marshal(key)
+		buffer.Write(encodedKey)
+		buffer.WriteByte(':')
+		buffer.Write(encodedValue)
+	}
+	buffer.WriteString("}\n")
+	return buffer.Bytes()
+}
+
+func encodeLogfmt(line Fields) []byte {
+	var buffer bytes.Buffer
+	for i, key := range orderedKeys(line) {
+		if i > 0 {
+			buffer.WriteByte(' ')
+		}
+		buffer.WriteString(key)
+		buffer.WriteByte('=')
+		buffer.WriteString(logfmtValue(line[key]))
+	}
+	buffer.WriteByte('\n')
+	return buffer.Bytes()
+}
+
+func orderedKeys(line Fields) []string {
+	keys := make([]string, 0, len(line))
+	for key := range line {
+		if key != "timestamp" && key != "level" && key != "message" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return append([]string{"timestamp", "level", "message"}, keys...)
+}
+
+func logfmtValue(value interface{}) string {
+	var text string
+	switch typed := value.(type) {
+	case string:
+		text = typed
+	case error:
+		text = typed.Error()
+	default:
+		text = fmt.Sprint(typed)
+	}
+
+	if text == "" || strings.ContainsAny(text, " =\"\n\t") {
+		return strconv.Quote(text)
+	}
+	return text
+}
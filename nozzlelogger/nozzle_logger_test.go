@@ -0,0 +1,81 @@
+package nozzlelogger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NozzleLogger", func() {
+	var output *bytes.Buffer
+
+	BeforeEach(func() {
+		output = &bytes.Buffer{}
+	})
+
+	It("writes JSON lines with level, message and fields", func() {
+		logger := nozzlelogger.New(output, nozzlelogger.Info, nozzlelogger.FormatJSON)
+
+		logger.Error("Error posting metrics", errors.New("connection refused"), nozzlelogger.Fields{"sink": "riemann", "batch_size": 12})
+
+		var line map[string]interface{}
+		Expect(json.Unmarshal(output.Bytes(), &line)).To(Succeed())
+		Expect(line["level"]).To(Equal("error"))
+		Expect(line["message"]).To(Equal("Error posting metrics"))
+		Expect(line["error"]).To(Equal("connection refused"))
+		Expect(line["sink"]).To(Equal("riemann"))
+		Expect(line["batch_size"]).To(BeEquivalentTo(12))
+		Expect(line).To(HaveKey("timestamp"))
+	})
+
+	It("writes logfmt lines with sorted fields", func() {
+		logger := nozzlelogger.New(output, nozzlelogger.Info, nozzlelogger.FormatLogfmt)
+
+		logger.Info("Starting server", nozzlelogger.Fields{"port": "8000", "component": "http server"})
+
+		line := output.String()
+		Expect(line).To(MatchRegexp(`^timestamp=\S+ level=info message="Starting server" component="http server" port=8000\n$`))
+	})
+
+	It("drops lines below the configured level", func() {
+		logger := nozzlelogger.New(output, nozzlelogger.Info, nozzlelogger.FormatJSON)
+
+		logger.Debug("Posting metrics")
+		Expect(output.Len()).To(Equal(0))
+
+		logger.Warn("Retrying")
+		Expect(output.String()).To(ContainSubstring(`"level":"warn"`))
+	})
+
+	It("adds fields from With to every line", func() {
+		logger := nozzlelogger.New(output, nozzlelogger.Debug, nozzlelogger.FormatJSON).With(nozzlelogger.Fields{"sink": "riemann"})
+
+		logger.Debug("one")
+		logger.Debug("two", nozzlelogger.Fields{"attempt": 2})
+
+		lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).To(ContainSubstring(`"sink":"riemann"`))
+		Expect(lines[1]).To(ContainSubstring(`"sink":"riemann"`))
+		Expect(lines[1]).To(ContainSubstring(`"attempt":2`))
+	})
+
+	It("does nothing when nil", func() {
+		var logger *nozzlelogger.Logger
+		logger.With(nozzlelogger.Fields{"a": 1}).Info("ignored")
+	})
+
+	It("parses level names", func() {
+		level, err := nozzlelogger.ParseLevel("DEBUG")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(level).To(Equal(nozzlelogger.Debug))
+
+		_, err = nozzlelogger.ParseLevel("verbose")
+		Expect(err).To(HaveOccurred())
+	})
+})
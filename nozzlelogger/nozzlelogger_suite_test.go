@@ -0,0 +1,13 @@
+package nozzlelogger_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNozzleLogger(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nozzle Logger Suite")
+}
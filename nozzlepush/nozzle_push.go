@@ -0,0 +1,199 @@
+// Package nozzlepush accepts custom metrics pushed over HTTP, such as
+// backup durations reported by platform scripts, and hands them to the
+// nozzle to be sent to Riemann with everything else.
+package nozzlepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzleauth"
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+)
+
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+
+	// DefaultOrigin names the series of points that do not give an origin.
+	DefaultOrigin = "custom"
+
+	maxPoints     = 1000
+	maxAttributes = 32
+
+	// acceptTimeout is how long a request waits for the nozzle to take its
+	// points before giving up, which it only needs to while the nozzle is
+	// starting or stuck.
+	acceptTimeout = 5 * time.Second
+
+	// maxTimestamp is the latest timestamp that still fits in nanoseconds,
+	// as the nozzle keeps them, in the year 2262.
+	maxTimestamp = math.MaxInt64 / int64(time.Second)
+)
+
+// Point is one metric in the body of a push, which is a JSON array of them.
+// Timestamp is in seconds since the epoch; zero means the time it arrived.
+type Point struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Value      *float64          `json:"value"`
+	Origin     string            `json:"origin,omitempty"`
+	Timestamp  int64             `json:"timestamp,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Receiver serves POST /v1/metrics. Requests must carry the token as a
+// bearer token and a body of at most maxBytes. A request is taken whole or
+// not at all: if any point is invalid, none are kept.
+type Receiver struct {
+	token    string
+	maxBytes int64
+	maxSkew  time.Duration
+	metrics  chan []riemannclient.CustomMetric
+}
+
+func New(token string, maxBytes int64) *Receiver {
+	return &Receiver{
+		token:    token,
+		maxBytes: maxBytes,
+		metrics:  make(chan []riemannclient.CustomMetric),
+	}
+}
+
+// SetMaxSkew makes the receiver refuse points timestamped further than
+// maxSkew from its clock. Zero, the default, only refuses timestamps too
+// large to keep.
+func (r *Receiver) SetMaxSkew(maxSkew time.Duration) {
+	r.maxSkew = maxSkew
+}
+
+// Metrics delivers the points of each accepted request.
+func (r *Receiver) Metrics() <-chan []riemannclient.CustomMetric {
+	return r.metrics
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !nozzleauth.Authorized(req, r.token) {
+		nozzleauth.Unauthorized(w)
+		return
+	}
+
+	var points []Point
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, r.maxBytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&points)
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			http.Error(w, fmt.Sprintf("Body is larger than %d bytes", r.maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Body must be a JSON array of points: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics, problems := convert(points, time.Now(), r.maxSkew)
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case r.metrics <- metrics:
+	case <-req.Context().Done():
+		return
+	case <-time.After(acceptTimeout):
+		http.Error(w, "The nozzle is not accepting metrics", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"accepted": len(metrics)})
+}
+
+// convert validates points and returns them as metrics, or every problem
+// found. With maxSkew set, timestamps must be within it of now.
+func convert(points []Point, now time.Time, maxSkew time.Duration) ([]riemannclient.CustomMetric, []string) {
+	if len(points) == 0 {
+		return nil, []string{"No points given"}
+	}
+	if len(points) > maxPoints {
+		return nil, []string{fmt.Sprintf("At most %d points may be pushed at once, got %d", maxPoints, len(points))}
+	}
+
+	var problems []string
+	metrics := make([]riemannclient.CustomMetric, 0, len(points))
+	for i, point := range points {
+		prefix := fmt.Sprintf("points[%d]: ", i)
+		if point.Name == "" {
+			problems = append(problems, prefix+"name is required")
+		}
+		if point.Type != TypeGauge && point.Type != TypeCounter {
+			problems = append(problems, fmt.Sprintf("%stype must be %q or %q, got %q", prefix, TypeGauge, TypeCounter, point.Type))
+		}
+		if point.Value == nil {
+			problems = append(problems, prefix+"value is required")
+		} else if math.IsNaN(*point.Value) || math.IsInf(*point.Value, 0) {
+			problems = append(problems, prefix+"value must be a finite number")
+		} else if point.Type == TypeCounter && *point.Value < 0 {
+			problems = append(problems, prefix+"counter value must not be negative")
+		}
+		if point.Timestamp < 0 {
+			problems = append(problems, prefix+"timestamp must not be negative")
+		} else if point.Timestamp > maxTimestamp {
+			problems = append(problems, fmt.Sprintf("%stimestamp must be seconds since the epoch no later than %d", prefix, maxTimestamp))
+		} else if point.Timestamp != 0 && maxSkew > 0 && skew(point.Timestamp, now) > maxSkew {
+			problems = append(problems, fmt.Sprintf("%stimestamp must be within %s of the nozzle's clock", prefix, maxSkew))
+		}
+		if len(point.Attributes) > maxAttributes {
+			problems = append(problems, fmt.Sprintf("%sat most %d attributes are allowed", prefix, maxAttributes))
+		}
+		for name := range point.Attributes {
+			if name == "" {
+				problems = append(problems, prefix+"attribute names must not be empty")
+				break
+			}
+			if riemannclient.IsReservedAttribute(name) {
+				problems = append(problems, fmt.Sprintf("%sattribute %q is set by the nozzle", prefix, name))
+			}
+		}
+		if len(problems) > 0 {
+			continue
+		}
+
+		metric := riemannclient.CustomMetric{
+			Origin:     point.Origin,
+			Name:       point.Name,
+			Counter:    point.Type == TypeCounter,
+			Value:      *point.Value,
+			Timestamp:  point.Timestamp,
+			Attributes: point.Attributes,
+		}
+		if metric.Origin == "" {
+			metric.Origin = DefaultOrigin
+		}
+		if metric.Timestamp == 0 {
+			metric.Timestamp = now.Unix()
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, problems
+}
+
+// skew is how far timestamp, in seconds, is from now.
+func skew(timestamp int64, now time.Time) time.Duration {
+	difference := time.Unix(timestamp, 0).Sub(now)
+	if difference < 0 {
+		return -difference
+	}
+	return difference
+}
@@ -0,0 +1,162 @@
+package nozzlepush_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlepush"
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NozzlePush", func() {
+	var (
+		receiver *nozzlepush.Receiver
+		server   *httptest.Server
+	)
+
+	BeforeEach(func() {
+		receiver = nozzlepush.New("secret", 1024)
+		server = httptest.NewServer(receiver)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	post := func(body string, token string) (int, string) {
+		request, err := http.NewRequest("POST", server.URL+"/v1/metrics", strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).ToNot(HaveOccurred())
+		defer response.Body.Close()
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(responseBody)
+	}
+
+	// accept takes the next batch of points as the nozzle would.
+	accept := func() <-chan []riemannclient.CustomMetric {
+		accepted := make(chan []riemannclient.CustomMetric, 1)
+		go func() {
+			accepted <- <-receiver.Metrics()
+		}()
+		return accepted
+	}
+
+	It("rejects requests without the token", func() {
+		status, _ := post(`[]`, "")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+
+		status, _ = post(`[]`, "wrong")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("only accepts POST", func() {
+		response, err := http.Get(server.URL + "/v1/metrics")
+		Expect(err).ToNot(HaveOccurred())
+		response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("hands valid points to the nozzle", func() {
+		accepted := accept()
+
+		status, body := post(`[
+			{"name": "backup.duration", "type": "gauge", "value": 312.5, "origin": "backup", "timestamp": 1580428783, "attributes": {"database": "ccdb"}},
+			{"name": "certs.expiring", "type": "counter", "value": 3}
+		]`, "secret")
+		Expect(status).To(Equal(http.StatusAccepted))
+		Expect(body).To(MatchJSON(`{"accepted": 2}`))
+
+		var metrics []riemannclient.CustomMetric
+		Eventually(accepted).Should(Receive(&metrics))
+		Expect(metrics).To(HaveLen(2))
+		Expect(metrics[0]).To(Equal(riemannclient.CustomMetric{
+			Origin:     "backup",
+			Name:       "backup.duration",
+			Value:      312.5,
+			Timestamp:  1580428783,
+			Attributes: map[string]string{"database": "ccdb"},
+		}))
+		Expect(metrics[1].Origin).To(Equal(nozzlepush.DefaultOrigin))
+		Expect(metrics[1].Counter).To(BeTrue())
+		Expect(metrics[1].Timestamp).To(BeNumerically("~", time.Now().Unix(), 5))
+	})
+
+	It("rejects the whole request if any point is invalid", func() {
+		status, body := post(`[
+			{"name": "ok", "type": "gauge", "value": 1},
+			{"type": "histogram", "value": 1},
+			{"name": "negative", "type": "counter", "value": -1},
+			{"name": "missing", "type": "gauge"}
+		]`, "secret")
+
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(ContainSubstring("points[1]: name is required"))
+		Expect(body).To(ContainSubstring(`points[1]: type must be "gauge" or "counter", got "histogram"`))
+		Expect(body).To(ContainSubstring("points[2]: counter value must not be negative"))
+		Expect(body).To(ContainSubstring("points[3]: value is required"))
+		Expect(receiver.Metrics()).NotTo(Receive())
+	})
+
+	It("rejects timestamps too large to keep", func() {
+		status, body := post(`[{"name": "far", "type": "gauge", "value": 1, "timestamp": 9223372037}]`, "secret")
+
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(ContainSubstring("points[0]: timestamp must be seconds since the epoch"))
+		Expect(receiver.Metrics()).NotTo(Receive())
+	})
+
+	It("rejects timestamps past the skew bound", func() {
+		receiver.SetMaxSkew(time.Minute)
+		now := time.Now().Unix()
+
+		status, body := post(fmt.Sprintf(`[
+			{"name": "past", "type": "gauge", "value": 1, "timestamp": %d},
+			{"name": "future", "type": "gauge", "value": 1, "timestamp": %d},
+			{"name": "recent", "type": "gauge", "value": 1, "timestamp": %d}
+		]`, now-3600, now+3600, now-30), "secret")
+
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(ContainSubstring("points[0]: timestamp must be within 1m0s of the nozzle's clock"))
+		Expect(body).To(ContainSubstring("points[1]: timestamp must be within 1m0s of the nozzle's clock"))
+		Expect(body).NotTo(ContainSubstring("points[2]"))
+	})
+
+	It("rejects attributes the nozzle sets itself", func() {
+		status, body := post(`[
+			{"name": "spoofed", "type": "gauge", "value": 1, "attributes": {"deployment": "other-cf"}},
+			{"name": "tagged", "type": "gauge", "value": 1, "attributes": {"foundation": "west", "database": "ccdb"}}
+		]`, "secret")
+
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(ContainSubstring(`points[0]: attribute "deployment" is set by the nozzle`))
+		Expect(body).To(ContainSubstring(`points[1]: attribute "foundation" is set by the nozzle`))
+		Expect(receiver.Metrics()).NotTo(Receive())
+	})
+
+	It("rejects bodies that are not arrays of points", func() {
+		status, _ := post(`{"name": "single"}`, "secret")
+		Expect(status).To(Equal(http.StatusBadRequest))
+
+		status, body := post(`[{"name": "x", "type": "gauge", "value": 1, "unit": "s"}]`, "secret")
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(ContainSubstring("unit"))
+
+		status, _ = post(`[]`, "secret")
+		Expect(status).To(Equal(http.StatusBadRequest))
+	})
+
+	It("rejects bodies over the size limit", func() {
+		status, _ := post(`[{"name": "`+strings.Repeat("x", 2048)+`", "type": "gauge", "value": 1}]`, "secret")
+		Expect(status).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+})
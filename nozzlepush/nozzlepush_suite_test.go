@@ -0,0 +1,13 @@
+package nozzlepush_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNozzlePush(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nozzle Push Suite")
+}
@@ -0,0 +1,303 @@
+package nozzletap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzleauth"
+	"github.com/amir/raidman"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	StreamEnvelopes = "envelopes"
+	StreamEvents    = "events"
+
+	clientBufferSize  = 256
+	keepAliveInterval = 15 * time.Second
+)
+
+// Tap streams envelopes read from the firehose, or the events sent to
+// Riemann, to HTTP clients as server-sent events. Publishing never blocks:
+// items beyond a client's rate limit or buffer are dropped for that client
+// and the count is reported to it.
+type Tap struct {
+	token         string
+	ratePerSecond float64
+	maxClients    int
+	prefix        string
+
+	lock        sync.Mutex
+	clients     map[*tapClient]struct{}
+	clientCount int32
+}
+
+type tapClient struct {
+	stream  string
+	filter  filter
+	limiter *rateLimiter
+	items   chan interface{}
+	dropped uint64
+}
+
+type filter struct {
+	origin    string
+	name      string
+	job       string
+	eventType string
+}
+
+// New returns a tap that accepts up to maxClients clients at once presenting
+// token as a bearer token and sends each of them at most ratePerSecond items
+// a second. prefix is the metric prefix of outgoing events, which their
+// filters look past.
+func New(token string, ratePerSecond uint32, maxClients uint32, prefix string) *Tap {
+	return &Tap{
+		token:         token,
+		ratePerSecond: float64(ratePerSecond),
+		maxClients:    int(maxClients),
+		prefix:        prefix,
+		clients:       make(map[*tapClient]struct{}),
+	}
+}
+
+// PublishEnvelope offers an envelope read from the firehose to every client
+// of the envelope stream whose filter it matches.
+func (t *Tap) PublishEnvelope(envelope *events.Envelope) {
+	if atomic.LoadInt32(&t.clientCount) == 0 {
+		return
+	}
+	t.publish(StreamEnvelopes, func(f filter) bool { return f.matchesEnvelope(envelope) }, envelope)
+}
+
+// PublishEvents offers a batch of outgoing events to every client of the
+// event stream whose filter they match.
+func (t *Tap) PublishEvents(metrics []*raidman.Event) {
+	if atomic.LoadInt32(&t.clientCount) == 0 {
+		return
+	}
+	for _, metric := range metrics {
+		metric := metric
+		t.publish(StreamEvents, func(f filter) bool { return f.matchesEvent(metric, t.prefix) }, metric)
+	}
+}
+
+func (t *Tap) publish(stream string, matches func(filter) bool, item interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for client := range t.clients {
+		if client.stream != stream || !matches(client.filter) {
+			continue
+		}
+		if !client.limiter.allow(now) {
+			atomic.AddUint64(&client.dropped, 1)
+			continue
+		}
+		select {
+		case client.items <- item:
+		default:
+			atomic.AddUint64(&client.dropped, 1)
+		}
+	}
+}
+
+// ServeHTTP streams the items selected by the query string until the client
+// goes away. stream is "envelopes" (the default) or "events"; origin, name,
+// job and event_type narrow what is sent.
+func (t *Tap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !nozzleauth.Authorized(r, t.token) {
+		nozzleauth.Unauthorized(w)
+		return
+	}
+
+	query := r.URL.Query()
+	stream := query.Get("stream")
+	if stream == "" {
+		stream = StreamEnvelopes
+	}
+	if stream != StreamEnvelopes && stream != StreamEvents {
+		http.Error(w, fmt.Sprintf("stream must be %q or %q", StreamEnvelopes, StreamEvents), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client := &tapClient{
+		stream: stream,
+		filter: filter{
+			origin:    query.Get("origin"),
+			name:      query.Get("name"),
+			job:       query.Get("job"),
+			eventType: query.Get("event_type"),
+		},
+		limiter: newRateLimiter(t.ratePerSecond),
+		items:   make(chan interface{}, clientBufferSize),
+	}
+	if !t.add(client) {
+		http.Error(w, "Too many tap clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer t.remove(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case item := <-client.items:
+			if dropped := atomic.SwapUint64(&client.dropped, 0); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped)
+			}
+			data, err := json.Marshal(formatItem(item))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", strings.TrimSuffix(stream, "s"), data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// add registers client unless maxClients are already streaming.
+func (t *Tap) add(client *tapClient) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.clients) >= t.maxClients {
+		return false
+	}
+	t.clients[client] = struct{}{}
+	atomic.StoreInt32(&t.clientCount, int32(len(t.clients)))
+	return true
+}
+
+func (t *Tap) remove(client *tapClient) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.clients, client)
+	atomic.StoreInt32(&t.clientCount, int32(len(t.clients)))
+}
+
+func (f filter) matchesEnvelope(envelope *events.Envelope) bool {
+	if f.origin != "" && envelope.GetOrigin() != f.origin {
+		return false
+	}
+	if f.job != "" && envelope.GetJob() != f.job {
+		return false
+	}
+	if f.eventType != "" && envelope.GetEventType().String() != f.eventType {
+		return false
+	}
+	if f.name != "" && envelopeName(envelope) != f.name {
+		return false
+	}
+	return true
+}
+
+// matchesEvent filters outgoing events, whose service is
+// "<prefix><origin>.<name>", followed by ".<aggregation>" for a rollup.
+// event_type does not apply to them.
+func (f filter) matchesEvent(metric *raidman.Event, prefix string) bool {
+	if !strings.HasPrefix(metric.Service, prefix) {
+		return f.origin == "" && f.name == ""
+	}
+	series := strings.TrimPrefix(metric.Service, prefix)
+	if rollup := metric.Attributes["rollup"]; rollup != "" {
+		series = strings.TrimSuffix(series, "."+rollup)
+	}
+	if f.origin != "" && !strings.HasPrefix(series, f.origin+".") {
+		return false
+	}
+	if f.name != "" && series != f.name && !strings.HasSuffix(series, "."+f.name) {
+		return false
+	}
+	if f.job != "" && metric.Attributes["job"] != f.job {
+		return false
+	}
+	return true
+}
+
+// tapEvent is how an outgoing event is shown, matching the debug sink.
+type tapEvent struct {
+	Service    string            `json:"service"`
+	Host       string            `json:"host,omitempty"`
+	Time       int64             `json:"time"`
+	Metric     interface{}       `json:"metric"`
+	State      string            `json:"state,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+}
+
+func formatItem(item interface{}) interface{} {
+	metric, ok := item.(*raidman.Event)
+	if !ok {
+		return item
+	}
+	return tapEvent{
+		Service:    metric.Service,
+		Host:       metric.Host,
+		Time:       metric.Time,
+		Metric:     metric.Metric,
+		State:      metric.State,
+		Attributes: metric.Attributes,
+		Tags:       metric.Tags,
+	}
+}
+
+func envelopeName(envelope *events.Envelope) string {
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		return envelope.GetValueMetric().GetName()
+	case events.Envelope_CounterEvent:
+		return envelope.GetCounterEvent().GetName()
+	default:
+		return ""
+	}
+}
+
+// rateLimiter is a token bucket that refills at rate tokens a second and
+// holds at most one second's worth.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,202 @@
+package nozzletap_test
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzletap"
+	"github.com/amir/raidman"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NozzleTap", func() {
+	var (
+		tap    *nozzletap.Tap
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		tap = nozzletap.New("secret", 100, 2, "cf.")
+		server = httptest.NewServer(tap)
+	})
+
+	AfterEach(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	get := func(query string, token string) *http.Response {
+		request, err := http.NewRequest("GET", server.URL+"/tap?"+query, nil)
+		Expect(err).ToNot(HaveOccurred())
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	// readEvents returns the next count server-sent events as "name: data".
+	readEvents := func(response *http.Response, count int) <-chan []string {
+		received := make(chan []string, 1)
+		go func() {
+			defer GinkgoRecover()
+			reader := bufio.NewReader(response.Body)
+			var sent []string
+			var name string
+			for len(sent) < count {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					break
+				}
+				line = strings.TrimSuffix(line, "\n")
+				switch {
+				case strings.HasPrefix(line, "event: "):
+					name = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					sent = append(sent, name+": "+strings.TrimPrefix(line, "data: "))
+				}
+			}
+			received <- sent
+		}()
+		return received
+	}
+
+	valueMetric := func(origin string, name string) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String(origin),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Job:       proto.String("router"),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(1),
+				Unit:  proto.String("ms"),
+			},
+		}
+	}
+
+	It("rejects clients without the token", func() {
+		response := get("", "")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		response = get("", "wrong")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects unknown streams", func() {
+		response := get("stream=logs", "secret")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("streams the envelopes that match the filter", func() {
+		response := get("origin=gorouter&name=latency&event_type=ValueMetric", "secret")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		received := readEvents(response, 1)
+		tap.PublishEnvelope(valueMetric("doppler", "latency"))
+		tap.PublishEnvelope(valueMetric("gorouter", "requests"))
+		tap.PublishEnvelope(valueMetric("gorouter", "latency"))
+
+		var sent []string
+		Eventually(received).Should(Receive(&sent))
+		Expect(sent).To(HaveLen(1))
+		Expect(sent[0]).To(HavePrefix("envelope: "))
+		Expect(sent[0]).To(ContainSubstring(`"origin":"gorouter"`))
+		Expect(sent[0]).To(ContainSubstring(`"name":"latency"`))
+	})
+
+	It("streams the outgoing events that match the filter", func() {
+		response := get("stream=events&origin=gorouter&job=router", "secret")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		received := readEvents(response, 1)
+		tap.PublishEvents([]*raidman.Event{
+			{Service: "cf.doppler.latency", Metric: 1.0, Attributes: map[string]string{"job": "router"}},
+			{Service: "cf.gorouter.latency", Metric: 2.0, Attributes: map[string]string{"job": "api"}},
+			{Service: "cf.gorouter.latency", Metric: 3.0, Attributes: map[string]string{"job": "router"}},
+		})
+
+		var sent []string
+		Eventually(received).Should(Receive(&sent))
+		Expect(sent).To(ConsistOf(`event: {"service":"cf.gorouter.latency","time":0,"metric":3,"attributes":{"job":"router"}}`))
+	})
+
+	It("matches origins and names exactly, looking past the prefix and rollup suffix", func() {
+		response := get("stream=events&origin=router&name=latency", "secret")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		received := readEvents(response, 2)
+		tap.PublishEvents([]*raidman.Event{
+			{Service: "cf.gorouter.latency", Metric: 1.0},
+			{Service: "cf.other.router.latency", Metric: 2.0},
+			{Service: "cf.router.request_latency", Metric: 3.0},
+			{Service: "cf.router.latency", Metric: 4.0},
+			{Service: "cf.router.latency.p99", Metric: 5.0, Attributes: map[string]string{"rollup": "p99"}},
+		})
+
+		var sent []string
+		Eventually(received).Should(Receive(&sent))
+		Expect(sent).To(ConsistOf(
+			`event: {"service":"cf.router.latency","time":0,"metric":4}`,
+			`event: {"service":"cf.router.latency.p99","time":0,"metric":5,"attributes":{"rollup":"p99"}}`,
+		))
+	})
+
+	It("turns clients away past the limit", func() {
+		first := get("", "secret")
+		defer first.Body.Close()
+		second := get("", "secret")
+		defer second.Body.Close()
+		Expect(second.StatusCode).To(Equal(http.StatusOK))
+
+		third := get("", "secret")
+		defer third.Body.Close()
+		Expect(third.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		first.Body.Close()
+		Eventually(func() int {
+			response := get("", "secret")
+			defer response.Body.Close()
+			return response.StatusCode
+		}).Should(Equal(http.StatusOK))
+	})
+
+	It("drops what exceeds a client's rate and reports how much was dropped", func() {
+		tap = nozzletap.New("secret", 1, 2, "cf.")
+		server.Config.Handler = tap
+
+		response := get("", "secret")
+		defer response.Body.Close()
+		received := readEvents(response, 3)
+
+		start := time.Now()
+		for i := 0; i < 1000; i++ {
+			tap.PublishEnvelope(valueMetric("gorouter", "latency"))
+		}
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		time.Sleep(1100 * time.Millisecond)
+		tap.PublishEnvelope(valueMetric("gorouter", "requests"))
+
+		var sent []string
+		Eventually(received, 3*time.Second).Should(Receive(&sent))
+		Expect(sent).To(ConsistOf(
+			ContainSubstring(`"name":"latency"`),
+			Equal("dropped: 999"),
+			ContainSubstring(`"name":"requests"`),
+		))
+	})
+})
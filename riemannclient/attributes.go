@@ -0,0 +1,72 @@
+package riemannclient
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// TagFilter chooses which envelope tags are sent as event attributes. With
+// Allow set only the tags it names are sent, and Deny removes tags from
+// those. Both empty means every tag is sent.
+type TagFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+func (f TagFilter) allows(tag string) bool {
+	if len(f.Allow) > 0 && !contains(f.Allow, tag) {
+		return false
+	}
+	return !contains(f.Deny, tag)
+}
+
+func contains(list []string, element string) bool {
+	for _, candidate := range list {
+		if candidate == element {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTagFilter chooses which envelope tags become event attributes.
+func (c *Client) SetTagFilter(filter TagFilter) {
+	c.tagFilter = filter
+}
+
+// SetStaticAttributes adds attributes to every event the client sends,
+// including its own metrics. An event's own attributes take precedence.
+func (c *Client) SetStaticAttributes(attributes map[string]string) {
+	c.staticAttributes = attributes
+}
+
+// envelopeTags returns the tags of envelope that the filter lets through.
+// The foundation tag is left out: the nozzle sets it and it is sent anyway.
+func (a *aggregator) envelopeTags(envelope *events.Envelope) map[string]string {
+	var tags map[string]string
+	for tag, value := range envelope.GetTags() {
+		if tag == FoundationAttribute || !a.tagFilter.allows(tag) {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[tag] = value
+	}
+	return tags
+}
+
+// eventAttributes returns attributes with the static attributes beneath
+// them.
+func (c *Client) eventAttributes(attributes map[string]string) map[string]string {
+	if len(c.staticAttributes) == 0 {
+		return attributes
+	}
+	merged := make(map[string]string, len(c.staticAttributes)+len(attributes))
+	for name, value := range c.staticAttributes {
+		merged[name] = value
+	}
+	for name, value := range attributes {
+		merged[name] = value
+	}
+	return merged
+}
@@ -0,0 +1,94 @@
+package riemannclient_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	"github.com/cloudfoundry/sonde-go/events"
+	pb "github.com/gogo/protobuf/proto"
+)
+
+const (
+	benchmarkSeries          = 1000
+	benchmarkPointsPerSeries = 10
+)
+
+// BenchmarkAddMetric measures aggregating a point into a series that already
+// has points in the current flush window, the common case between flushes.
+func BenchmarkAddMetric(b *testing.B) {
+	for _, tagged := range []bool{false, true} {
+		b.Run(fmt.Sprintf("tagged=%t", tagged), func(b *testing.B) {
+			c := newBenchmarkClient(nil)
+			envelopes := benchmarkEnvelopes(tagged)
+			for _, envelope := range envelopes {
+				c.AddMetric(envelope)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.AddMetric(envelopes[i%len(envelopes)])
+				if (i+1)%(len(envelopes)*benchmarkPointsPerSeries) == 0 {
+					b.StopTimer()
+					c.PostMetrics()
+					b.StartTimer()
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFlushWindow measures a whole flush window: a few points for each
+// of benchmarkSeries series, then the flush, which is a dry run so that only
+// the nozzle's own work is counted.
+func BenchmarkFlushWindow(b *testing.B) {
+	rollups := map[string][]riemannclient.RollupRule{
+		"raw":    nil,
+		"rollup": {{Match: "*", Aggregations: []string{"count", "mean", "max"}}},
+	}
+	for _, name := range []string{"raw", "rollup"} {
+		b.Run(name, func(b *testing.B) {
+			c := newBenchmarkClient(rollups[name])
+			envelopes := benchmarkEnvelopes(true)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for point := 0; point < benchmarkPointsPerSeries; point++ {
+					for _, envelope := range envelopes {
+						c.AddMetric(envelope)
+					}
+				}
+				c.PostMetrics()
+			}
+		})
+	}
+}
+
+func newBenchmarkClient(rollups []riemannclient.RollupRule) *riemannclient.Client {
+	c := riemannclient.New([]string{"127.0.0.1:5555"}, riemannclient.BalanceFailover, "tcp", "riemann.nozzle.", "test-deployment", "dummy-ip", "3", riemannclient.RetryPolicy{}, riemannclient.SeriesLimit{}, rollups, nil)
+	c.SetDryRun(true)
+	return c
+}
+
+func benchmarkEnvelopes(tagged bool) []*events.Envelope {
+	envelopes := make([]*events.Envelope, benchmarkSeries)
+	for i := range envelopes {
+		envelopes[i] = &events.Envelope{
+			Origin:      pb.String(fmt.Sprintf("origin-%d", i%10)),
+			Timestamp:   pb.Int64(time.Now().UnixNano()),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{Name: pb.String(fmt.Sprintf("metric-%d", i)), Value: pb.Float64(float64(i)), Unit: pb.String("gauge")},
+			Deployment:  pb.String("cf"),
+			Job:         pb.String("diego-cell"),
+			Index:       pb.String(fmt.Sprintf("%d", i%4)),
+			Ip:          pb.String("10.0.0.1"),
+		}
+		if tagged {
+			envelopes[i].Tags = map[string]string{"source_id": "benchmark", "instance_id": fmt.Sprintf("%d", i%4)}
+		}
+	}
+	return envelopes
+}
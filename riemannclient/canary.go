@@ -0,0 +1,91 @@
+package riemannclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+const canaryPollInterval = 100 * time.Millisecond
+
+// Canary checks that Riemann indexes the events it accepts. Each check sends
+// an event carrying a unique tag and queries the index until the event shows
+// up, which catches a Riemann that acknowledges events and then loses them.
+// Queries need a TCP connection, so the canary always uses TCP.
+type Canary struct {
+	address string
+	service string
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+// NewCanary returns a canary for the Riemann server at address, a host:port.
+func NewCanary(address string, service string, ttl time.Duration, timeout time.Duration) *Canary {
+	return &Canary{
+		address: address,
+		service: service,
+		ttl:     ttl,
+		timeout: timeout,
+	}
+}
+
+func (c *Canary) Address() string {
+	return c.address
+}
+
+// Check returns the time from sending the canary event to finding it in the
+// index, or an error if it could not be sent or was not indexed within the
+// timeout.
+func (c *Canary) Check() (time.Duration, error) {
+	tag, err := canaryTag()
+	if err != nil {
+		return 0, err
+	}
+
+	// The deadline raidman sets when sending also bounds the queries, so
+	// allow one extra poll past the timeout.
+	client, err := raidman.DialWithTimeout("tcp", c.address, c.timeout+canaryPollInterval)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	start := time.Now()
+	err = client.Send(&raidman.Event{
+		Service: c.service,
+		Time:    start.Unix(),
+		Metric:  1.0,
+		Ttl:     float32(c.ttl.Seconds()),
+		Tags:    []string{tag},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("sending canary event: %s", err)
+	}
+
+	query := fmt.Sprintf("service = %q and tagged %q", c.service, tag)
+	for {
+		found, err := client.Query(query)
+		if err != nil {
+			return 0, fmt.Errorf("querying for canary event: %s", err)
+		}
+		if len(found) > 0 {
+			return time.Since(start), nil
+		}
+		if time.Since(start) >= c.timeout {
+			return 0, fmt.Errorf("canary event was accepted but not indexed within %s", c.timeout)
+		}
+		time.Sleep(canaryPollInterval)
+	}
+}
+
+func canaryTag() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return "canary-" + hex.EncodeToString(id), nil
+}
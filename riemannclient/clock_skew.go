@@ -0,0 +1,54 @@
+package riemannclient
+
+import (
+	"time"
+)
+
+const (
+	SkewClamp = "clamp"
+	SkewDrop  = "drop"
+)
+
+// ClockSkew bounds how far a point's timestamp may be from the time the
+// nozzle receives it. A zero MaxSkew means no bound. Timestamps outside it
+// are moved to its nearest edge or, with SkewDrop, their points dropped.
+type ClockSkew struct {
+	MaxSkew time.Duration
+	Action  string
+}
+
+// SetClockSkew bounds the timestamps of envelopes and custom metrics. An
+// empty Action means SkewClamp.
+func (c *Client) SetClockSkew(skew ClockSkew) {
+	if skew.Action == "" {
+		skew.Action = SkewClamp
+	}
+	c.clockSkew = skew
+}
+
+// timestamp returns the time to record for a point stamped timestamp, both
+// in nanoseconds since the epoch, or false if the point is to be dropped.
+// Points without a timestamp are stamped with the time they arrived.
+func (a *aggregator) timestamp(timestamp int64, now time.Time) (int64, bool) {
+	if timestamp == 0 {
+		return now.UnixNano(), true
+	}
+	if a.clockSkew.MaxSkew <= 0 {
+		return timestamp, true
+	}
+
+	earliest := now.Add(-a.clockSkew.MaxSkew).UnixNano()
+	latest := now.Add(a.clockSkew.MaxSkew).UnixNano()
+	if timestamp >= earliest && timestamp <= latest {
+		return timestamp, true
+	}
+
+	a.skewedTimestamps[a.clockSkew.Action]++
+	if a.clockSkew.Action == SkewDrop {
+		return 0, false
+	}
+	if timestamp < earliest {
+		return earliest, true
+	}
+	return latest, true
+}
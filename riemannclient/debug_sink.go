@@ -0,0 +1,64 @@
+package riemannclient
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/amir/raidman"
+)
+
+// DebugSink writes every event the client sends as a JSON line, so a dry
+// run shows exactly what Riemann would receive.
+type DebugSink struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+type debugEvent struct {
+	Service     string            `json:"service"`
+	Host        string            `json:"host"`
+	Time        int64             `json:"time"`
+	Metric      interface{}       `json:"metric"`
+	State       string            `json:"state,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+}
+
+func NewDebugSink(out io.Writer) *DebugSink {
+	return &DebugSink{out: out}
+}
+
+func (s *DebugSink) Write(metrics []*raidman.Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	encoder := json.NewEncoder(s.out)
+	for _, metric := range metrics {
+		host := metric.Host
+		if host == "" {
+			host = hostname
+		}
+		err := encoder.Encode(debugEvent{
+			Service:     metric.Service,
+			Host:        host,
+			Time:        metric.Time,
+			Metric:      metric.Metric,
+			State:       metric.State,
+			Description: metric.Description,
+			Attributes:  metric.Attributes,
+			Tags:        metric.Tags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if flusher, ok := s.out.(interface {
+		Flush() error
+	}); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
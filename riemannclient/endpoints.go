@@ -0,0 +1,168 @@
+package riemannclient
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+const (
+	BalanceFailover   = "failover"
+	BalanceRoundRobin = "round-robin"
+	BalanceHash       = "hash"
+
+	// endpointCooldown is how long an endpoint that failed is passed over
+	// before it is tried again.
+	endpointCooldown = 30 * time.Second
+)
+
+// endpoint is one Riemann server and what the client has seen of it.
+type endpoint struct {
+	address   string
+	up        bool
+	failures  uint64
+	downUntil time.Time
+}
+
+// endpointPool spreads batches over the configured Riemann servers. With
+// BalanceFailover every batch goes to the first server that is up, with
+// BalanceRoundRobin each batch goes to the next one, and with BalanceHash
+// every event goes to the server chosen for its service by rendezvous
+// hashing, so a series stays on one server and only the series of a server
+// that goes down move elsewhere. Whatever the policy, a batch that cannot be
+// delivered to its server falls back to the others in turn.
+type endpointPool struct {
+	balancing string
+	endpoints []*endpoint
+	next      int
+}
+
+// route is part of a batch and the servers to try for it, in order.
+type route struct {
+	endpoints []*endpoint
+	metrics   []*raidman.Event
+}
+
+func newEndpointPool(addresses []string, balancing string) *endpointPool {
+	pool := &endpointPool{balancing: balancing}
+	for _, address := range addresses {
+		pool.endpoints = append(pool.endpoints, &endpoint{address: address, up: true})
+	}
+	return pool
+}
+
+// IsBalancing reports whether balancing is one of the Balance policies.
+func IsBalancing(balancing string) bool {
+	return balancing == BalanceFailover || balancing == BalanceRoundRobin || balancing == BalanceHash
+}
+
+// routes splits metrics into the batches to send and the order in which to
+// try servers for each.
+func (p *endpointPool) routes(metrics []*raidman.Event) []route {
+	switch p.balancing {
+	case BalanceRoundRobin:
+		start := p.next % len(p.endpoints)
+		p.next++
+		order := append(append([]*endpoint{}, p.endpoints[start:]...), p.endpoints[:start]...)
+		return []route{{endpoints: order, metrics: metrics}}
+	case BalanceHash:
+		return p.hashRoutes(metrics)
+	default:
+		return []route{{endpoints: p.endpoints, metrics: metrics}}
+	}
+}
+
+func (p *endpointPool) hashRoutes(metrics []*raidman.Event) []route {
+	byOrder := make(map[string]*route)
+	var keys []string
+	for _, metric := range metrics {
+		order := p.rendezvousOrder(metric.Service)
+		key := orderKey(order)
+		r, ok := byOrder[key]
+		if !ok {
+			r = &route{endpoints: order}
+			byOrder[key] = r
+			keys = append(keys, key)
+		}
+		r.metrics = append(r.metrics, metric)
+	}
+
+	routes := make([]route, 0, len(keys))
+	for _, key := range keys {
+		routes = append(routes, *byOrder[key])
+	}
+	return routes
+}
+
+// rendezvousOrder ranks the servers for service by a hash of the pair, so
+// the ranking of the remaining servers does not change when one is removed.
+func (p *endpointPool) rendezvousOrder(service string) []*endpoint {
+	order := append([]*endpoint{}, p.endpoints...)
+	scores := make(map[*endpoint]uint64, len(order))
+	for _, e := range order {
+		hash := fnv.New64a()
+		hash.Write([]byte(e.address))
+		hash.Write([]byte{0})
+		hash.Write([]byte(service))
+		scores[e] = mix(hash.Sum64())
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order
+}
+
+// mix spreads every bit of an FNV hash over the whole result. FNV alone
+// barely changes its high bits for a different last byte, which would give
+// services such as "a" and "b" the same ranking.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func orderKey(order []*endpoint) string {
+	addresses := make([]string, len(order))
+	for i, e := range order {
+		addresses[i] = e.address
+	}
+	return strings.Join(addresses, ",")
+}
+
+// candidates returns the servers in order to try, those that are up or whose
+// cooldown has passed first. Servers still cooling down come last rather
+// than not at all, so a batch is only given up on once every server fails.
+func candidates(order []*endpoint, now time.Time) []*endpoint {
+	ready := make([]*endpoint, 0, len(order))
+	var coolingDown []*endpoint
+	for _, e := range order {
+		if e.up || !now.Before(e.downUntil) {
+			ready = append(ready, e)
+		} else {
+			coolingDown = append(coolingDown, e)
+		}
+	}
+	return append(ready, coolingDown...)
+}
+
+// succeeded marks e up and reports whether it was down.
+func (e *endpoint) succeeded() bool {
+	recovered := !e.up
+	e.up = true
+	return recovered
+}
+
+// failed marks e down for endpointCooldown and reports whether it was up.
+func (e *endpoint) failed(now time.Time) bool {
+	wasUp := e.up
+	e.up = false
+	e.failures++
+	e.downUntil = now.Add(endpointCooldown)
+	return wasUp
+}
@@ -2,176 +2,861 @@ package riemannclient
 
 import (
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"log"
-
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
 	"github.com/amir/raidman"
+	"github.com/amir/raidman/proto"
 	"github.com/cloudfoundry/sonde-go/events"
+	pb "github.com/golang/protobuf/proto"
 )
 
 type Client struct {
-	host                  string
-	port                  string
+	aggregator
+	pool                  *endpointPool
 	transport             string
-	metricPoints          map[metricKey]metricValue
 	prefix                string
-	deployment            string
 	ip                    string
+	index                 string
+	retryPolicy           RetryPolicy
+	staticAttributes      map[string]string
+	debugSink             *DebugSink
+	eventTap              EventTap
+	dryRun                bool
+	logger                *nozzlelogger.Logger
+	customMetricsReceived uint64
+	lastFlushEvents       int
+	lastCanaries          []canaryResult
+	slowConsumer          SlowConsumerStatus
+	ingestQueueDepth      int
+
+	// lock guards what sending a batch changes, the counters below and the
+	// state of the endpoints, since a batch may be sent while the next flush
+	// window is aggregated.
+	lock              sync.Mutex
+	totalMetricsSent  uint64
+	metricsRejected   uint64
+	sinkErrors        map[string]uint64
+	bytesSent         uint64
+	lastFlushDuration time.Duration
+}
+
+// aggregator collects the points of a flush window and counts the envelopes
+// they came from. The client has one, and each Shard another.
+type aggregator struct {
+	metricPoints          map[metricKey]*series
+	deployment            string
+	limiter               *seriesLimiter
+	rollups               []RollupRule
+	clockSkew             ClockSkew
+	tagFilter             TagFilter
+	labels                map[string]string
+	tagNames              []string
+	labelBuffer           []byte
 	totalMessagesReceived uint64
-	totalMetricsSent      uint64
+	messagesReceived      map[envelopeSource]uint64
+	messagesDropped       map[events.Envelope_EventType]uint64
+	skewedTimestamps      map[string]uint64
+}
+
+func newAggregator(deployment string, seriesLimit SeriesLimit, rollups []RollupRule) aggregator {
+	return aggregator{
+		metricPoints:     make(map[metricKey]*series),
+		deployment:       deployment,
+		limiter:          newSeriesLimiter(seriesLimit),
+		rollups:          rollups,
+		labels:           make(map[string]string),
+		messagesReceived: make(map[envelopeSource]uint64),
+		messagesDropped:  make(map[events.Envelope_EventType]uint64),
+		skewedTimestamps: make(map[string]uint64),
+	}
+}
+
+type canaryResult struct {
+	endpoint string
+	latency  time.Duration
+	err      error
+}
+
+type envelopeSource struct {
+	eventType events.Envelope_EventType
+	origin    string
+}
+
+// RetryPolicy controls how a batch is resent after a transient failure such
+// as a refused connection or a timeout. Batches that Riemann rejects are
+// never retried.
+type RetryPolicy struct {
+	MaxRetries     uint32
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// RejectedError is returned by PostMetrics when Riemann acknowledges a batch
+// with ok=false.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "Riemann rejected batch: " + e.Reason
+}
+
+// EncodingError is returned by PostMetrics when a batch cannot be encoded
+// for Riemann. The batch is dropped without being sent, since no server or
+// retry would take it, and is not counted as a rejection.
+type EncodingError struct {
+	Err error
+}
+
+func (e *EncodingError) Error() string {
+	return "Cannot encode batch: " + e.Err.Error()
+}
+
+// transientError is a failure to reach Riemann or to hear back from it, as
+// opposed to Riemann refusing a batch. Batches are retried after one.
+type transientError struct {
+	err error
 }
 
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+const (
+	sinkErrorTransient = "transient"
+	sinkErrorRejected  = "rejected"
+	sinkErrorEncoding  = "encoding"
+	sinkErrorBacklog   = "backlog"
+)
+
+// hostname is what raidman puts in the host field of every event, so it
+// counts towards bytesSent.
+var hostname, _ = os.Hostname()
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+	sendTimeout           = 10 * time.Second
+)
+
+// FoundationAttribute is the envelope tag, and event attribute, that names
+// the foundation an envelope came from when the nozzle reads several.
+const FoundationAttribute = "foundation"
+
+// IsReservedAttribute reports whether name is an attribute the nozzle sets
+// itself, which custom metrics may not use.
+func IsReservedAttribute(name string) bool {
+	switch name {
+	case "deployment", "job", "index", "ip", FoundationAttribute, "rollup":
+		return true
+	}
+	return false
+}
+
+// metricKey identifies a series. The nozzle's own metrics and the global
+// overflow series have no origin.
 type metricKey struct {
 	eventType  events.Envelope_EventType
+	foundation string
+	origin     string
 	name       string
 	deployment string
 	job        string
 	index      string
 	ip         string
+	labels     string
 }
 
-type metricValue struct {
-	points     []Point
-	attributes map[string]string
-}
-
+// Point is one value of a series. Timestamp is in nanoseconds since the
+// epoch; Riemann is sent whole seconds.
 type Point struct {
 	Timestamp int64
 	Value     float64
 }
 
-func New(host string, port string, transport string, prefix string, deployment string, ip string) *Client {
+// New returns a client that sends to the Riemann servers at addresses, each
+// a host:port, spreading batches over them according to balancing.
+func New(addresses []string, balancing string, transport string, prefix string, deployment string, ip string, index string, retryPolicy RetryPolicy, seriesLimit SeriesLimit, rollups []RollupRule, logger *nozzlelogger.Logger) *Client {
+	if retryPolicy.InitialBackoff <= 0 {
+		retryPolicy.InitialBackoff = defaultInitialBackoff
+	}
+	if retryPolicy.MaxBackoff <= 0 {
+		retryPolicy.MaxBackoff = defaultMaxBackoff
+	}
+
 	return &Client{
-		host:         host,
-		port:         port,
-		transport:    transport,
-		metricPoints: make(map[metricKey]metricValue),
-		prefix:       prefix,
-		deployment:   deployment,
-		ip:           ip,
+		aggregator:  newAggregator(deployment, seriesLimit, rollups),
+		pool:        newEndpointPool(addresses, balancing),
+		transport:   transport,
+		prefix:      prefix,
+		ip:          ip,
+		index:       index,
+		retryPolicy: retryPolicy,
+		logger:      logger.With(nozzlelogger.Fields{"sink": "riemann"}),
+		sinkErrors:  map[string]uint64{sinkErrorTransient: 0, sinkErrorRejected: 0, sinkErrorEncoding: 0, sinkErrorBacklog: 0},
+	}
+}
+
+// SetDebugSink makes the client also write every batch to sink.
+func (c *Client) SetDebugSink(sink *DebugSink) {
+	c.debugSink = sink
+}
+
+// EventTap receives a copy of every batch the client sends. It must not
+// block.
+type EventTap interface {
+	PublishEvents(metrics []*raidman.Event)
+}
+
+// SetEventTap makes the client also publish every batch to tap.
+func (c *Client) SetEventTap(tap EventTap) {
+	c.eventTap = tap
+}
+
+// SetDryRun stops the client from contacting Riemann. Batches still go to
+// the debug sink and are counted as sent.
+func (c *Client) SetDryRun(dryRun bool) {
+	c.dryRun = dryRun
+}
+
+// RecordCanary keeps the outcome of a Canary check of endpoint to be
+// reported with the next flush.
+func (c *Client) RecordCanary(endpoint string, latency time.Duration, err error) {
+	result := canaryResult{endpoint: endpoint, latency: latency, err: err}
+	for i, previous := range c.lastCanaries {
+		if previous.endpoint == endpoint {
+			c.lastCanaries[i] = result
+			return
+		}
 	}
+	c.lastCanaries = append(c.lastCanaries, result)
+}
+
+// SlowConsumerStatus is what the slowConsumerAlert event reports: 1 with
+// state critical while the nozzle is behind and 0 with state ok otherwise.
+// Duration is how long the nozzle was behind and is only set when it
+// recovers.
+type SlowConsumerStatus struct {
+	Slow        bool
+	Description string
+	Duration    time.Duration
+}
+
+// SetSlowConsumerStatus sets what the next flushes report about the nozzle
+// keeping up. A recovery, with its description and duration, is reported by
+// the next flush only.
+func (c *Client) SetSlowConsumerStatus(status SlowConsumerStatus) {
+	c.slowConsumer = status
 }
 
-func (c *Client) AlertSlowConsumerError() {
-	c.addInternalMetric("slowConsumerAlert", uint64(1))
+// SetIngestQueueDepth sets the deepest the nozzle's queue of envelopes got
+// since the last flush, to be reported with the next one.
+func (c *Client) SetIngestQueueDepth(depth int) {
+	c.ingestQueueDepth = depth
 }
 
-func (c *Client) AddMetric(envelope *events.Envelope) {
-	c.totalMessagesReceived++
+// AddMetric aggregates the point of a ValueMetric or CounterEvent envelope
+// and counts every envelope it is given.
+func (a *aggregator) AddMetric(envelope *events.Envelope) {
+	a.totalMessagesReceived++
+	a.messagesReceived[envelopeSource{eventType: envelope.GetEventType(), origin: envelope.GetOrigin()}]++
 	if envelope.GetEventType() != events.Envelope_ValueMetric && envelope.GetEventType() != events.Envelope_CounterEvent {
+		a.messagesDropped[envelope.GetEventType()]++
+		return
+	}
+	timestamp, ok := a.timestamp(envelope.GetTimestamp(), time.Now())
+	if !ok {
 		return
 	}
 
 	key := metricKey{
 		eventType:  envelope.GetEventType(),
+		foundation: envelope.GetTags()[FoundationAttribute],
+		origin:     envelope.GetOrigin(),
 		name:       getName(envelope),
 		deployment: envelope.GetDeployment(),
 		job:        envelope.GetJob(),
 		index:      envelope.GetIndex(),
 		ip:         envelope.GetIp(),
+		labels:     a.envelopeLabels(envelope),
 	}
 
-	mVal := c.metricPoints[key]
-	value := getValue(envelope)
+	s, exists := a.metricPoints[key]
+	if !exists || s.count == 0 {
+		admitted, overflowOrigin := a.limiter.admit(key.origin)
+		if !admitted {
+			a.limiter.overflowed(key.origin, key.name)
+			if a.limiter.limit.Overflow == OverflowCollapse {
+				a.addOverflowPoint(overflowOrigin, timestamp)
+			}
+			return
+		}
+	}
+	if !exists {
+		s = a.newSeries(key, getAttributes(envelope, a.envelopeTags(envelope)))
+	}
 
-	mVal.attributes = getAttributes(envelope)
-	mVal.points = append(mVal.points, Point{
-		Timestamp: envelope.GetTimestamp() / int64(time.Second),
-		Value:     value,
+	s.add(Point{
+		Timestamp: timestamp,
+		Value:     getValue(envelope),
 	})
+}
 
-	c.metricPoints[key] = mVal
+// CustomMetric is a point pushed to the nozzle rather than read from an
+// envelope. Its series is named like an envelope's, <origin>.<name>, and its
+// attributes are sent with it and tell series of the same name apart. As
+// with CounterEvents, a counter's value is its running total.
+type CustomMetric struct {
+	Origin     string
+	Name       string
+	Counter    bool
+	Value      float64
+	Timestamp  int64
+	Attributes map[string]string
 }
 
+// AddCustomMetric adds a pushed point, subject to the same series limits as
+// envelopes and to the same clock skew bound. Timestamp is in seconds since
+// the epoch. Reserved attributes are dropped so that a point cannot pass
+// itself off as another deployment's.
+func (c *Client) AddCustomMetric(metric CustomMetric) {
+	c.customMetricsReceived++
+	timestamp, ok := c.timestamp(metric.Timestamp*int64(time.Second), time.Now())
+	if !ok {
+		return
+	}
+
+	eventType := events.Envelope_ValueMetric
+	if metric.Counter {
+		eventType = events.Envelope_CounterEvent
+	}
+	attributes := customAttributes(metric.Attributes)
+	key := metricKey{
+		eventType: eventType,
+		origin:    metric.Origin,
+		name:      metric.Name,
+		labels:    joinLabels(attributes),
+	}
+
+	s, exists := c.metricPoints[key]
+	if !exists || s.count == 0 {
+		admitted, overflowOrigin := c.limiter.admit(key.origin)
+		if !admitted {
+			c.limiter.overflowed(key.origin, key.name)
+			if c.limiter.limit.Overflow == OverflowCollapse {
+				c.addOverflowPoint(overflowOrigin, timestamp)
+			}
+			return
+		}
+	}
+	if !exists {
+		s = c.newSeries(key, appendAttributeIfNotEmpty(attributes, "deployment", c.deployment))
+	}
+
+	s.add(Point{
+		Timestamp: timestamp,
+		Value:     metric.Value,
+	})
+}
+
+// addOverflowPoint counts a refused point in the overflow series of origin,
+// or in the global one if origin is empty. Its value is the number of points
+// collapsed into it during the flush window.
+func (a *aggregator) addOverflowPoint(origin string, timestamp int64) {
+	key := metricKey{origin: origin, name: overflowName}
+	s, exists := a.metricPoints[key]
+	if !exists {
+		s = a.newSeries(key, map[string]string{"deployment": a.deployment})
+		s.overflow = true
+	}
+	s.add(Point{Timestamp: timestamp})
+}
+
+// Batch is what one flush sends: the events of every series with points in
+// the flush window and the nozzle's own metrics.
+type Batch struct {
+	metrics []*raidman.Event
+}
+
+// Len is the number of events in the batch.
+func (b *Batch) Len() int {
+	return len(b.metrics)
+}
+
+// PostMetrics ends the flush window and sends what it aggregated, the same
+// as Send(NextBatch()).
 func (c *Client) PostMetrics() error {
+	return c.Send(c.NextBatch())
+}
+
+// NextBatch ends the flush window: it returns what the window aggregated,
+// along with the nozzle's own metrics, and starts the next one.
+func (c *Client) NextBatch() *Batch {
 	c.populateInternalMetrics()
-	numMetrics := len(c.metricPoints)
-	log.Printf("Posting %d metrics", numMetrics)
+	c.logger.Debug("Posting metrics", nozzlelogger.Fields{"series": c.activeSeries()})
+	c.logSeriesOverflow()
 
 	metrics := c.formatMetrics()
+	c.reset()
+	c.lastFlushEvents = len(metrics)
+	return &Batch{metrics: metrics}
+}
+
+// Send delivers batch to Riemann, retrying it according to the retry
+// policy, and to the event tap and debug sink. It may be called while the
+// next flush window is aggregated, but not while another Send is running.
+func (c *Client) Send(batch *Batch) error {
+	metrics := batch.metrics
+	if c.eventTap != nil {
+		c.eventTap.PublishEvents(metrics)
+	}
+	if c.debugSink != nil {
+		err := c.debugSink.Write(metrics)
+		if err != nil {
+			c.logger.Error("Error writing batch to debug sink", err)
+		}
+	}
+	if err := checkEncodable(metrics); err != nil {
+		c.countSinkError(sinkErrorEncoding)
+		c.logger.Error("Dropping batch that cannot be encoded", err, nozzlelogger.Fields{"batch_size": len(metrics)})
+		return &EncodingError{Err: err}
+	}
+	if c.dryRun {
+		c.lock.Lock()
+		c.totalMetricsSent += uint64(len(metrics))
+		c.lock.Unlock()
+		return nil
+	}
+
+	start := time.Now()
+	var firstErr error
+	for _, r := range c.pool.routes(metrics) {
+		err := c.sendWithRetry(r.metrics, r.endpoints)
+		rejected, isRejected := err.(*RejectedError)
+
+		c.lock.Lock()
+		if isRejected {
+			c.metricsRejected += uint64(len(r.metrics))
+		} else if err == nil {
+			c.totalMetricsSent += uint64(len(r.metrics))
+			c.bytesSent += uint64(c.encodedSize(r.metrics))
+		}
+		c.lock.Unlock()
+
+		if isRejected {
+			c.logger.Error("Dropping batch rejected by Riemann", err, nozzlelogger.Fields{"batch_size": len(r.metrics), "reason": rejected.Reason})
+		} else if err != nil {
+			c.logger.Error("Dropping batch after exhausting retries", err, nozzlelogger.Fields{"batch_size": len(r.metrics), "retries": c.retryPolicy.MaxRetries})
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.lock.Lock()
+	c.lastFlushDuration = time.Since(start)
+	c.lock.Unlock()
+
+	return firstErr
+}
+
+// DropBatch counts batch as a failed send without sending it, for when
+// batches are flushed faster than they can be sent.
+func (c *Client) DropBatch(batch *Batch) {
+	c.countSinkError(sinkErrorBacklog)
+}
+
+func (c *Client) countSinkError(kind string) {
+	c.lock.Lock()
+	c.sinkErrors[kind]++
+	c.lock.Unlock()
+}
+
+// sendWithRetry sends metrics to the first of endpoints that takes them and,
+// if none does, starts over after a backoff.
+func (c *Client) sendWithRetry(metrics []*raidman.Event, endpoints []*endpoint) error {
+	backoff := c.retryPolicy.InitialBackoff
+	for attempt := uint32(0); ; attempt++ {
+		err := c.sendToAny(metrics, endpoints)
+		if err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			c.countSinkError(sinkErrorRejected)
+			return err
+		}
+		c.countSinkError(sinkErrorTransient)
+		if attempt >= c.retryPolicy.MaxRetries {
+			return err
+		}
+
+		c.logger.Warn("Error posting metrics to Riemann, retrying", nozzlelogger.Fields{
+			"error":      err.Error(),
+			"batch_size": len(metrics),
+			"attempt":    attempt + 1,
+			"backoff":    backoff.String(),
+		})
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > c.retryPolicy.MaxBackoff {
+			backoff = c.retryPolicy.MaxBackoff
+		}
+	}
+}
 
-	client, err := raidman.Dial(c.transport, fmt.Sprintf("%s:%s", c.host, c.port))
+// sendToAny tries endpoints in turn, skipping those that recently failed
+// until every other one has been tried. A rejection is returned straight
+// away: another server would reject the same batch.
+func (c *Client) sendToAny(metrics []*raidman.Event, endpoints []*endpoint) error {
+	var err error
+	for _, e := range candidates(endpoints, time.Now()) {
+		err = c.send(e.address, metrics)
+		if err == nil {
+			c.lock.Lock()
+			recovered := e.succeeded()
+			c.lock.Unlock()
+			if recovered {
+				c.logger.Info("Riemann endpoint recovered", nozzlelogger.Fields{"endpoint": e.address})
+			}
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+		c.lock.Lock()
+		wentDown := e.failed(time.Now())
+		c.lock.Unlock()
+		if wentDown && len(endpoints) > 1 {
+			c.logger.Warn("Riemann endpoint is down, failing over", nozzlelogger.Fields{"endpoint": e.address, "error": err.Error()})
+		}
+	}
+	return err
+}
+
+// send delivers metrics to the server at address. Whatever goes wrong before
+// a connection is made, a refused connection or a proxy that cannot be
+// reached, is transient; once connected, only I/O errors are.
+func (c *Client) send(address string, metrics []*raidman.Event) error {
+	client, err := raidman.DialWithTimeout(c.transport, address, sendTimeout)
 	if err != nil {
-		return err
+		return &transientError{err: err}
 	}
+	defer client.Close()
 
 	err = client.SendMulti(metrics)
-	if err != nil {
-		return err
+	switch {
+	case err == nil:
+		return nil
+	case isIOError(err):
+		return &transientError{err: err}
+	default:
+		return &RejectedError{Reason: err.Error()}
 	}
+}
+
+// isTransient reports whether err is worth retrying the batch for.
+func isTransient(err error) bool {
+	_, ok := err.(*transientError)
+	return ok
+}
 
-	c.totalMetricsSent += uint64(len(metrics))
-	c.metricPoints = make(map[metricKey]metricValue)
+// isIOError reports whether err came from the connection rather than from
+// Riemann itself. raidman surfaces an ok=false acknowledgement as a plain
+// error carrying the server's message, and the batch has been checked with
+// checkEncodable, so anything else is a rejection.
+func isIOError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
 
+// checkEncodable finds what raidman would fail to encode before anything is
+// sent, so that it is not mistaken for a rejection. The client only sends
+// float64 metrics, which encodedSize relies on.
+func checkEncodable(metrics []*raidman.Event) error {
+	for _, metric := range metrics {
+		if _, ok := metric.Metric.(float64); !ok {
+			return fmt.Errorf("metric of invalid type %T for %s", metric.Metric, metric.Service)
+		}
+	}
 	return nil
 }
 
+func (c *Client) logSeriesOverflow() {
+	offenders := c.limiter.topOffenders()
+	if len(offenders) == 0 {
+		return
+	}
+
+	fields := nozzlelogger.Fields{"overflow": c.limiter.limit.Overflow}
+	for i, offender := range offenders {
+		fields[fmt.Sprintf("origin_%d", i+1)] = fmt.Sprintf("%s points=%d names=%s", offender.origin, offender.points, strings.Join(offender.sampleNames, ","))
+	}
+	c.logger.Warn("Series limit reached, new series were not forwarded", fields)
+}
+
+// encodedSize is the number of bytes raidman writes for metrics: the
+// protobuf message plus, over TCP, its four byte length prefix.
+func (c *Client) encodedSize(metrics []*raidman.Event) int {
+	message := &proto.Msg{}
+	for _, metric := range metrics {
+		event := &proto.Event{
+			Service: pb.String(metric.Service),
+			Host:    pb.String(hostname),
+			Time:    pb.Int64(metric.Time),
+			MetricD: pb.Float64(metric.Metric.(float64)),
+		}
+		if metric.State != "" {
+			event.State = pb.String(metric.State)
+		}
+		if metric.Description != "" {
+			event.Description = pb.String(metric.Description)
+		}
+		for key, value := range metric.Attributes {
+			event.Attributes = append(event.Attributes, &proto.Attribute{Key: pb.String(key), Value: pb.String(value)})
+		}
+		message.Events = append(message.Events, event)
+	}
+
+	size := pb.Size(message)
+	if c.transport == "tcp" {
+		size += 4
+	}
+	return size
+}
+
+// populateInternalMetrics adds the nozzle's own telemetry to the batch. The
+// flush duration and event count describe the previous flush, since the
+// current one has not happened yet.
 func (c *Client) populateInternalMetrics() {
-	c.addInternalMetric("totalMessagesReceived", c.totalMessagesReceived)
-	c.addInternalMetric("totalMetricsSent", c.totalMetricsSent)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	seriesCardinality := c.activeSeries()
+
+	c.addInternalMetric("totalMessagesReceived", float64(c.totalMessagesReceived), nil)
+	c.addInternalMetric("customMetricsReceived", float64(c.customMetricsReceived), nil)
+	c.addInternalMetric("totalMetricsSent", float64(c.totalMetricsSent), nil)
+	c.addInternalMetric("metricsRejected", float64(c.metricsRejected), nil)
+	c.addInternalMetric("seriesCardinality", float64(seriesCardinality), nil)
+	c.addInternalMetric("flushDurationMs", float64(c.lastFlushDuration)/float64(time.Millisecond), nil)
+	c.addInternalMetric("eventsPerFlush", float64(c.lastFlushEvents), nil)
+	c.addInternalMetric("bytesSent", float64(c.bytesSent), nil)
+	c.addInternalMetric("ingestQueueDepth", float64(c.ingestQueueDepth), nil)
+
+	for source, count := range c.messagesReceived {
+		c.addInternalMetric("messagesReceived", float64(count), map[string]string{
+			"event_type": source.eventType.String(),
+			"origin":     source.origin,
+		})
+	}
+	for eventType, count := range c.messagesDropped {
+		c.addInternalMetric("messagesDropped", float64(count), map[string]string{"event_type": eventType.String()})
+	}
+	for kind, count := range c.sinkErrors {
+		c.addInternalMetric("sinkErrors", float64(count), map[string]string{"kind": kind})
+	}
+	for action, count := range c.skewedTimestamps {
+		c.addInternalMetric("skewedTimestamps", float64(count), map[string]string{"action": action})
+	}
+	for _, e := range c.pool.endpoints {
+		up := 0.0
+		if e.up {
+			up = 1
+		}
+		c.addInternalMetric("endpointUp", up, map[string]string{"endpoint": e.address})
+		c.addInternalMetric("endpointErrors", float64(e.failures), map[string]string{"endpoint": e.address})
+	}
+	c.addInternalMetric("totalSeriesOverflowed", float64(c.limiter.totalOverflowed), nil)
+	for _, offender := range c.limiter.topOffenders() {
+		c.addInternalMetric("seriesOverflowed", float64(offender.points), map[string]string{"origin": offender.origin})
+	}
 
-	if !c.containsSlowConsumerAlert() {
-		c.addInternalMetric("slowConsumerAlert", uint64(0))
+	// A canary result is sent once, with the flush that follows the check.
+	for _, canary := range c.lastCanaries {
+		endpoint := map[string]string{"endpoint": canary.endpoint}
+		if canary.err != nil {
+			c.addInternalMetric("canarySuccess", 0, endpoint)
+		} else {
+			c.addInternalMetric("canarySuccess", 1, endpoint)
+			c.addInternalMetric("canaryLatencyMs", float64(canary.latency)/float64(time.Millisecond), endpoint)
+		}
 	}
+	c.lastCanaries = nil
+
+	c.addSlowConsumerAlert()
 }
 
-func (c *Client) containsSlowConsumerAlert() bool {
-	key := metricKey{
-		name:       "slowConsumerAlert",
-		deployment: c.deployment,
-		ip:         c.ip,
+// addSlowConsumerAlert reports the slow consumer status as a Riemann state,
+// so that a recovery is a transition from critical to ok. The flush that
+// reports a recovery also carries how long the nozzle was behind.
+func (c *Client) addSlowConsumerAlert() {
+	value, state := 0.0, "ok"
+	if c.slowConsumer.Slow {
+		value, state = 1, "critical"
+	}
+	var labels map[string]string
+	if c.slowConsumer.Duration > 0 {
+		labels = map[string]string{"duration_seconds": strconv.FormatFloat(c.slowConsumer.Duration.Seconds(), 'f', 0, 64)}
+	}
+
+	s := c.addInternalMetric("slowConsumerAlert", value, labels)
+	s.state = state
+	s.description = c.slowConsumer.Description
+
+	if !c.slowConsumer.Slow {
+		c.slowConsumer = SlowConsumerStatus{}
 	}
-	_, ok := c.metricPoints[key]
-	return ok
 }
 
 func (c *Client) formatMetrics() []*raidman.Event {
-	metrics := []*raidman.Event{}
+	metrics := make([]*raidman.Event, 0, c.lastFlushEvents)
 
-	for key, metric := range c.metricPoints {
-		for _, point := range metric.points {
+	for _, s := range c.metricPoints {
+		if s.count == 0 {
+			continue
+		}
+		seriesEvents := c.seriesEvents(s)
+
+		switch {
+		case s.overflow:
 			metrics = append(metrics, &raidman.Event{
-				Service:    c.prefix + key.name,
-				Time:       point.Timestamp,
-				Metric:     point.Value,
-				Attributes: metric.attributes,
+				Service:    seriesEvents[0].service,
+				Time:       s.last.Timestamp / int64(time.Second),
+				Metric:     float64(s.count),
+				Attributes: seriesEvents[0].attributes,
 			})
+		case s.rollup != nil:
+			for _, event := range seriesEvents {
+				metrics = append(metrics, &raidman.Event{
+					Service:    event.service,
+					Time:       s.last.Timestamp / int64(time.Second),
+					Metric:     s.aggregate(event.aggregation),
+					Attributes: event.attributes,
+				})
+			}
+		default:
+			for _, point := range s.points {
+				metrics = append(metrics, &raidman.Event{
+					Service:     seriesEvents[0].service,
+					Time:        point.Timestamp / int64(time.Second),
+					Metric:      point.Value,
+					State:       s.state,
+					Description: s.description,
+					Attributes:  seriesEvents[0].attributes,
+				})
+			}
 		}
 	}
 
 	return metrics
 }
 
-func (c *Client) addInternalMetric(name string, value uint64) {
+// seriesEvents returns the services and attributes that s is sent with,
+// building them the first time. Events share the attributes maps, which are
+// never changed once built.
+func (c *Client) seriesEvents(s *series) []seriesEvent {
+	if s.events != nil {
+		return s.events
+	}
+
+	attributes := c.eventAttributes(s.attributes)
+	if s.rollup == nil {
+		s.events = []seriesEvent{{service: c.prefix + s.name, attributes: attributes}}
+		return s.events
+	}
+	for _, aggregation := range s.rollup.Aggregations {
+		rollupAttributes := make(map[string]string, len(attributes)+1)
+		for attribute, value := range attributes {
+			rollupAttributes[attribute] = value
+		}
+		rollupAttributes["rollup"] = aggregation
+		s.events = append(s.events, seriesEvent{
+			service:     c.prefix + s.name + "." + aggregation,
+			aggregation: aggregation,
+			attributes:  rollupAttributes,
+		})
+	}
+	return s.events
+}
+
+// addInternalMetric records one of the nozzle's own metrics. Every internal
+// metric carries the nozzle's ip, deployment and instance index; labels add
+// further attributes and keep series with the same name apart. It returns
+// the series the metric is recorded in, which holds just this value.
+func (c *Client) addInternalMetric(name string, value float64, labels map[string]string) *series {
 	key := metricKey{
 		name:       name,
 		deployment: c.deployment,
 		ip:         c.ip,
+		labels:     joinLabels(labels),
 	}
 
-	point := Point{
-		Timestamp: time.Now().Unix(),
-		Value:     float64(value),
-	}
-
-	mValue := metricValue{
-		attributes: map[string]string{
+	s, exists := c.metricPoints[key]
+	if !exists {
+		attributes := map[string]string{
 			"ip":         c.ip,
 			"deployment": c.deployment,
-		},
-		points: []Point{point},
+			"index":      c.index,
+		}
+		for label, labelValue := range labels {
+			attributes[label] = labelValue
+		}
+		s = c.newSeries(key, attributes)
 	}
 
-	c.metricPoints[key] = mValue
+	s.clear()
+	s.add(Point{
+		Timestamp: time.Now().UnixNano(),
+		Value:     value,
+	})
+	return s
+}
+
+// customAttributes returns a copy of attributes without the reserved ones.
+func customAttributes(attributes map[string]string) map[string]string {
+	custom := make(map[string]string, len(attributes)+1)
+	for name, value := range attributes {
+		if !IsReservedAttribute(name) {
+			custom[name] = value
+		}
+	}
+	return custom
+}
+
+// joinLabels encodes labels the same way as envelopeLabels.
+func joinLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	var joined []byte
+	for i, label := range names {
+		if i > 0 {
+			joined = append(joined, ',')
+		}
+		joined = appendLabel(joined, label, labels[label])
+	}
+	return string(joined)
 }
 
 func getName(envelope *events.Envelope) string {
 	switch envelope.GetEventType() {
 	case events.Envelope_ValueMetric:
-		return envelope.GetOrigin() + "." + envelope.GetValueMetric().GetName()
+		return envelope.GetValueMetric().GetName()
 	case events.Envelope_CounterEvent:
-		return envelope.GetOrigin() + "." + envelope.GetCounterEvent().GetName()
+		return envelope.GetCounterEvent().GetName()
 	default:
 		panic("Unknown event type")
 	}
@@ -188,13 +873,19 @@ func getValue(envelope *events.Envelope) float64 {
 	}
 }
 
-func getAttributes(envelope *events.Envelope) map[string]string {
-	attributes := make(map[string]string)
+// getAttributes returns the attributes of an envelope's events: its tags,
+// overridden by its own fields.
+func getAttributes(envelope *events.Envelope, tags map[string]string) map[string]string {
+	attributes := make(map[string]string, len(tags)+5)
+	for tag, value := range tags {
+		attributes[tag] = value
+	}
 
 	attributes = appendAttributeIfNotEmpty(attributes, "deployment", envelope.GetDeployment())
 	attributes = appendAttributeIfNotEmpty(attributes, "job", envelope.GetJob())
 	attributes = appendAttributeIfNotEmpty(attributes, "index", envelope.GetIndex())
 	attributes = appendAttributeIfNotEmpty(attributes, "ip", envelope.GetIp())
+	attributes = appendAttributeIfNotEmpty(attributes, FoundationAttribute, envelope.GetTags()[FoundationAttribute])
 
 	return attributes
 }
@@ -1,437 +1,1237 @@
 package riemannclient_test
 
 import (
-	"io/ioutil"
-	"net/http"
-	"net/http/httptest"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
-	"github.com/18F/influxdb-firehose-nozzle/influxdbclient"
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	. "github.com/18F/riemann-firehose-nozzle/testhelpers"
 
+	"github.com/amir/raidman/proto"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/gogo/protobuf/proto"
-
-	"encoding/json"
-	"time"
+	pb "github.com/gogo/protobuf/proto"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
-var bodies [][]byte
-var responseCode int
+var _ = Describe("RiemannClient", func() {
+	var fakeRiemann *FakeRiemann
+	var retryPolicy riemannclient.RetryPolicy
+	var seriesLimit riemannclient.SeriesLimit
+	var rollups []riemannclient.RollupRule
 
-var _ = Describe("DatadogClient", func() {
-
-	var ts *httptest.Server
+	newClient := func() *riemannclient.Client {
+		return riemannclient.New([]string{fakeRiemann.Address()}, riemannclient.BalanceFailover, "tcp", "riemann.nozzle.", "test-deployment", "dummy-ip", "3", retryPolicy, seriesLimit, rollups, nil)
+	}
 
 	BeforeEach(func() {
-		bodies = nil
-		responseCode = http.StatusOK
-		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+		fakeRiemann = NewFakeRiemann("tcp")
+		fakeRiemann.Start()
+
+		retryPolicy = riemannclient.RetryPolicy{
+			MaxRetries:     2,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     2 * time.Millisecond,
+		}
+		seriesLimit = riemannclient.SeriesLimit{}
+		rollups = nil
+	})
+
+	AfterEach(func() {
+		fakeRiemann.Close()
 	})
 
 	It("ignores messages that aren't value metrics or counter events", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+		c := newClient()
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(1000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(1000000000),
 			EventType: events.Envelope_LogMessage.Enum(),
 			LogMessage: &events.LogMessage{
 				Message:     []byte("log message"),
 				MessageType: events.LogMessage_OUT.Enum(),
-				Timestamp:   proto.Int64(1000000000),
+				Timestamp:   pb.Int64(1000000000),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("doppler"),
 		})
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(1000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(1000000000),
 			EventType: events.Envelope_ContainerMetric.Enum(),
 			ContainerMetric: &events.ContainerMetric{
-				ApplicationId: proto.String("app-id"),
-				InstanceIndex: proto.Int32(4),
-				CpuPercentage: proto.Float64(20.0),
-				MemoryBytes:   proto.Uint64(19939949),
-				DiskBytes:     proto.Uint64(29488929),
+				ApplicationId: pb.String("app-id"),
+				InstanceIndex: pb.Int32(4),
+				CpuPercentage: pb.Float64(20.0),
+				MemoryBytes:   pb.Uint64(19939949),
+				DiskBytes:     pb.Uint64(29488929),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("doppler"),
 		})
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
-		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
-
-		validateMetrics(payload, 2, 0)
+		Expect(externalEvents(fakeRiemann.Events())).To(BeEmpty())
+		validateMetrics(fakeRiemann.Events(), 2, 0)
 	})
 
 	It("generates aggregate messages even when idle", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+		c := newClient()
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
-		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
-
-		validateMetrics(payload, 0, 0)
+		first := fakeRiemann.Events()
+		Expect(externalEvents(first)).To(BeEmpty())
+		validateMetrics(first, 0, 0)
 
 		err = c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
-		Eventually(bodies).Should(HaveLen(2))
-		err = json.Unmarshal(bodies[1], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
-
-		validateMetrics(payload, 0, 3)
+		second := fakeRiemann.Events()[len(first):]
+		Expect(externalEvents(second)).To(BeEmpty())
+		validateMetrics(second, 0, len(first))
 	})
 
-	It("posts ValueMetrics in JSON format", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	It("posts ValueMetrics as Riemann events", func() {
+		c := newClient()
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(1000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(1000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
 			ValueMetric: &events.ValueMetric{
-				Name:  proto.String("metricName"),
-				Value: proto.Float64(5),
+				Name:  pb.String("metricName"),
+				Value: pb.Float64(5),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("doppler"),
 		})
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(2000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(2000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
 			ValueMetric: &events.ValueMetric{
-				Name:  proto.String("metricName"),
-				Value: proto.Float64(76),
+				Name:  pb.String("metricName"),
+				Value: pb.Float64(76),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("doppler"),
 		})
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
-		Eventually(bodies).Should(HaveLen(1))
-
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(4))
-
-		metricFound := false
-		for _, metric := range payload.Series {
-			Expect(metric.Type).To(Equal("gauge"))
-
-			if metric.Metric == "datadog.nozzle.origin.metricName" {
-				metricFound = true
-				Expect(metric.Points).To(Equal([]influxdbclient.Point{
-					influxdbclient.Point{
-						Timestamp: 1,
-						Value:     5.0,
-					},
-					influxdbclient.Point{
-						Timestamp: 2,
-						Value:     76.0,
-					},
-				}))
-				Expect(metric.Tags).To(Equal([]string{"deployment:deployment-name", "job:doppler"}))
-			}
+		points := findEvents(fakeRiemann.Events(), "riemann.nozzle.origin.metricName")
+		Expect(points).To(HaveLen(2))
+		for _, event := range points {
+			Expect(attributes(event)).To(Equal(map[string]string{"deployment": "deployment-name", "job": "doppler"}))
 		}
-		Expect(metricFound).To(BeTrue())
+		Expect(points[0].GetTime()).To(BeEquivalentTo(1))
+		Expect(points[0].GetMetricD()).To(Equal(5.0))
+		Expect(points[1].GetTime()).To(BeEquivalentTo(2))
+		Expect(points[1].GetMetricD()).To(Equal(76.0))
 
-		validateMetrics(payload, 2, 0)
+		validateMetrics(fakeRiemann.Events(), 2, 0)
 	})
 
-	It("registers metrics with the same name but different tags as different", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	It("registers metrics with the same name but different attributes as different series", func() {
+		c := newClient()
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(1000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(1000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
 			ValueMetric: &events.ValueMetric{
-				Name:  proto.String("metricName"),
-				Value: proto.Float64(5),
+				Name:  pb.String("metricName"),
+				Value: pb.Float64(5),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("doppler"),
 		})
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(2000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(2000000000),
 			EventType: events.Envelope_ValueMetric.Enum(),
 			ValueMetric: &events.ValueMetric{
-				Name:  proto.String("metricName"),
-				Value: proto.Float64(76),
+				Name:  pb.String("metricName"),
+				Value: pb.Float64(76),
 			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("gorouter"),
+			Deployment: pb.String("deployment-name"),
+			Job:        pb.String("gorouter"),
 		})
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
-		Eventually(bodies).Should(HaveLen(1))
-
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(5))
-		dopplerFound := false
-		gorouterFound := false
-		for _, metric := range payload.Series {
-			Expect(metric.Type).To(Equal("gauge"))
-
-			if metric.Metric == "datadog.nozzle.origin.metricName" {
-				Expect(metric.Tags).To(HaveLen(2))
-				Expect(metric.Tags[0]).To(Equal("deployment:deployment-name"))
-				if metric.Tags[1] == "job:doppler" {
-					dopplerFound = true
-					Expect(metric.Points).To(Equal([]influxdbclient.Point{
-						influxdbclient.Point{
-							Timestamp: 1,
-							Value:     5.0,
-						},
-					}))
-				} else if metric.Tags[1] == "job:gorouter" {
-					gorouterFound = true
-					Expect(metric.Points).To(Equal([]influxdbclient.Point{
-						influxdbclient.Point{
-							Timestamp: 2,
-							Value:     76.0,
-						},
-					}))
-				} else {
-					panic("Unknown tag found")
-				}
-			}
-		}
-		Expect(dopplerFound).To(BeTrue())
-		Expect(gorouterFound).To(BeTrue())
-		validateMetrics(payload, 2, 0)
+		Expect(externalEvents(fakeRiemann.Events())).To(HaveLen(2))
+		doppler := findEventWith(fakeRiemann.Events(), "riemann.nozzle.origin.metricName", map[string]string{"job": "doppler"})
+		Expect(doppler.GetTime()).To(BeEquivalentTo(1))
+		Expect(doppler.GetMetricD()).To(Equal(5.0))
+		gorouter := findEventWith(fakeRiemann.Events(), "riemann.nozzle.origin.metricName", map[string]string{"job": "gorouter"})
+		Expect(gorouter.GetTime()).To(BeEquivalentTo(2))
+		Expect(gorouter.GetMetricD()).To(Equal(76.0))
+
+		validateMetrics(fakeRiemann.Events(), 2, 0)
 	})
 
-	It("posts CounterEvents in JSON format and empties map after post", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	It("posts CounterEvents as Riemann events with their totals and empties the series after a flush", func() {
+		c := newClient()
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(1000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(1000000000),
 			EventType: events.Envelope_CounterEvent.Enum(),
 			CounterEvent: &events.CounterEvent{
-				Name:  proto.String("counterName"),
-				Delta: proto.Uint64(1),
-				Total: proto.Uint64(5),
+				Name:  pb.String("counterName"),
+				Delta: pb.Uint64(1),
+				Total: pb.Uint64(5),
 			},
 		})
 
 		c.AddMetric(&events.Envelope{
-			Origin:    proto.String("origin"),
-			Timestamp: proto.Int64(2000000000),
+			Origin:    pb.String("origin"),
+			Timestamp: pb.Int64(2000000000),
 			EventType: events.Envelope_CounterEvent.Enum(),
 			CounterEvent: &events.CounterEvent{
-				Name:  proto.String("counterName"),
-				Delta: proto.Uint64(6),
-				Total: proto.Uint64(11),
+				Name:  pb.String("counterName"),
+				Delta: pb.Uint64(6),
+				Total: pb.Uint64(11),
 			},
 		})
 
 		err := c.PostMetrics()
 		Expect(err).ToNot(HaveOccurred())
 
-		Eventually(bodies).Should(HaveLen(1))
-
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(4))
-		counterNameFound := false
-		for _, metric := range payload.Series {
-			Expect(metric.Type).To(Equal("gauge"))
-
-			if metric.Metric == "datadog.nozzle.origin.counterName" {
-				counterNameFound = true
-				Expect(metric.Points).To(Equal([]influxdbclient.Point{
-					influxdbclient.Point{
-						Timestamp: 1,
-						Value:     5.0,
+		first := fakeRiemann.Events()
+		Expect(externalEvents(first)).To(HaveLen(2))
+		points := findEvents(first, "riemann.nozzle.origin.counterName")
+		Expect(points).To(HaveLen(2))
+		Expect(points[0].GetTime()).To(BeEquivalentTo(1))
+		Expect(points[0].GetMetricD()).To(Equal(5.0))
+		Expect(points[1].GetTime()).To(BeEquivalentTo(2))
+		Expect(points[1].GetMetricD()).To(Equal(11.0))
+		validateMetrics(first, 2, 0)
+
+		err = c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		second := fakeRiemann.Events()[len(first):]
+		Expect(externalEvents(second)).To(BeEmpty())
+		validateMetrics(second, 2, len(first))
+	})
+
+	It("posts custom metrics as Riemann events with their attributes", func() {
+		c := newClient()
+
+		c.AddCustomMetric(riemannclient.CustomMetric{Origin: "backup", Name: "duration", Value: 300, Timestamp: 1580428783, Attributes: map[string]string{"database": "ccdb"}})
+		c.AddCustomMetric(riemannclient.CustomMetric{Origin: "backup", Name: "duration", Value: 20, Timestamp: 1580428783, Attributes: map[string]string{"database": "uaadb"}})
+		c.AddCustomMetric(riemannclient.CustomMetric{Origin: "certs", Name: "renewed", Counter: true, Value: 4, Timestamp: 1580428783})
+
+		err := c.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		event := findEventWith(fakeRiemann.Events(), "riemann.nozzle.backup.duration", map[string]string{"database": "ccdb"})
+		Expect(event).NotTo(BeNil())
+		Expect(event.GetTime()).To(BeEquivalentTo(1580428783))
+		Expect(event.GetMetricD()).To(Equal(300.0))
+		Expect(attributes(event)).To(Equal(map[string]string{"deployment": "test-deployment", "database": "ccdb"}))
+		Expect(findEventWith(fakeRiemann.Events(), "riemann.nozzle.backup.duration", map[string]string{"database": "uaadb"}).GetMetricD()).To(Equal(20.0))
+		Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.certs.renewed").GetMetricD()).To(Equal(4.0))
+		Expect(externalEvents(fakeRiemann.Events())).To(HaveLen(3))
+		Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.customMetricsReceived").GetMetricD()).To(Equal(3.0))
+	})
+
+	It("keeps custom metrics apart when their attribute values contain separators, and keeps its own attributes", func() {
+		c := newClient()
+
+		c.AddCustomMetric(riemannclient.CustomMetric{Origin: "backup", Name: "duration", Value: 1, Timestamp: 1580428783, Attributes: map[string]string{"database": "ccdb,region=east"}})
+		c.AddCustomMetric(riemannclient.CustomMetric{Origin: "backup", Name: "duration", Value: 2, Timestamp: 1580428783, Attributes: map[string]string{"database": "ccdb", "region": "east"}})
+		c.AddCustomMetric(riemannclient.CustomMetric{Origin: "certs", Name: "renewed", Value: 3, Timestamp: 1580428783, Attributes: map[string]string{"deployment": "other-deployment", "rollup": "p99"}})
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(externalEvents(fakeRiemann.Events())).To(HaveLen(3))
+		Expect(findEventWith(fakeRiemann.Events(), "riemann.nozzle.backup.duration", map[string]string{"database": "ccdb,region=east"}).GetMetricD()).To(Equal(1.0))
+		Expect(findEventWith(fakeRiemann.Events(), "riemann.nozzle.backup.duration", map[string]string{"database": "ccdb", "region": "east"}).GetMetricD()).To(Equal(2.0))
+		Expect(attributes(findEvent(fakeRiemann.Events(), "riemann.nozzle.certs.renewed"))).To(Equal(map[string]string{"deployment": "test-deployment"}))
+	})
+
+	Context("timestamps", func() {
+		valueMetric := func(name string, timestamp int64) *events.Envelope {
+			return &events.Envelope{
+				Origin:      pb.String("origin"),
+				Timestamp:   pb.Int64(timestamp),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{Name: pb.String(name), Value: pb.Float64(1)},
+			}
+		}
+
+		It("stamps points without a timestamp with the time they arrive", func() {
+			c := newClient()
+
+			c.AddMetric(valueMetric("unstamped", 0))
+			c.AddCustomMetric(riemannclient.CustomMetric{Origin: "backup", Name: "duration", Value: 1})
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.unstamped").GetTime()).To(BeNumerically("~", time.Now().Unix(), 5))
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.backup.duration").GetTime()).To(BeNumerically("~", time.Now().Unix(), 5))
+		})
+
+		It("leaves timestamps alone without a skew bound", func() {
+			c := newClient()
+
+			c.AddMetric(valueMetric("ancient", int64(1500*time.Millisecond)))
+			Expect(c.PostMetrics()).To(Succeed())
+
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.ancient").GetTime()).To(BeEquivalentTo(1))
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.skewedTimestamps")).To(BeNil())
+		})
+
+		It("clamps timestamps to the skew bound and counts them", func() {
+			c := newClient()
+			c.SetClockSkew(riemannclient.ClockSkew{MaxSkew: time.Minute})
+
+			now := time.Now()
+			c.AddMetric(valueMetric("ancient", 1000000000))
+			c.AddMetric(valueMetric("future", now.Add(time.Hour).UnixNano()))
+			c.AddMetric(valueMetric("recent", now.Add(-30*time.Second).UnixNano()))
+			Expect(c.PostMetrics()).To(Succeed())
+
+			received := fakeRiemann.Events()
+			Expect(findEvent(received, "riemann.nozzle.origin.ancient").GetTime()).To(BeNumerically("~", now.Add(-time.Minute).Unix(), 1))
+			Expect(findEvent(received, "riemann.nozzle.origin.future").GetTime()).To(BeNumerically("~", now.Add(time.Minute).Unix(), 1))
+			Expect(findEvent(received, "riemann.nozzle.origin.recent").GetTime()).To(Equal(now.Add(-30 * time.Second).Unix()))
+			Expect(findEventWith(received, "riemann.nozzle.skewedTimestamps", map[string]string{"action": "clamp"}).GetMetricD()).To(Equal(2.0))
+		})
+
+		It("drops points outside the skew bound", func() {
+			c := newClient()
+			c.SetClockSkew(riemannclient.ClockSkew{MaxSkew: time.Minute, Action: riemannclient.SkewDrop})
+
+			c.AddMetric(valueMetric("ancient", 1000000000))
+			c.AddCustomMetric(riemannclient.CustomMetric{Origin: "backup", Name: "duration", Value: 1, Timestamp: 1580428783})
+			c.AddMetric(valueMetric("recent", time.Now().UnixNano()))
+			Expect(c.PostMetrics()).To(Succeed())
+
+			received := fakeRiemann.Events()
+			Expect(externalEvents(received)).To(HaveLen(1))
+			Expect(findEvent(received, "riemann.nozzle.origin.recent")).NotTo(BeNil())
+			Expect(findEventWith(received, "riemann.nozzle.skewedTimestamps", map[string]string{"action": "drop"}).GetMetricD()).To(Equal(2.0))
+		})
+	})
+
+	Context("attributes", func() {
+		tagged := func(value float64, tags map[string]string) *events.Envelope {
+			return &events.Envelope{
+				Origin:      pb.String("origin"),
+				Timestamp:   pb.Int64(1000000000),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{Name: pb.String("metricName"), Value: pb.Float64(value)},
+				Job:         pb.String("doppler"),
+				Tags:        tags,
+			}
+		}
+
+		It("sends envelope tags as attributes, keeping series with different tags apart", func() {
+			c := newClient()
+
+			c.AddMetric(tagged(1, map[string]string{"zone": "z1", "job": "not-the-job"}))
+			c.AddMetric(tagged(2, map[string]string{"zone": "z2", "job": "not-the-job"}))
+			Expect(c.PostMetrics()).To(Succeed())
+
+			event := findEventWith(fakeRiemann.Events(), "riemann.nozzle.origin.metricName", map[string]string{"zone": "z1"})
+			Expect(event.GetMetricD()).To(Equal(1.0))
+			Expect(attributes(event)).To(Equal(map[string]string{"zone": "z1", "job": "doppler"}))
+			Expect(findEventWith(fakeRiemann.Events(), "riemann.nozzle.origin.metricName", map[string]string{"zone": "z2"}).GetMetricD()).To(Equal(2.0))
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.seriesCardinality").GetMetricD()).To(Equal(2.0))
+		})
+
+		It("filters tags through the allow and deny lists", func() {
+			c := newClient()
+			c.SetTagFilter(riemannclient.TagFilter{Allow: []string{"zone", "source_id"}, Deny: []string{"source_id"}})
+
+			c.AddMetric(tagged(1, map[string]string{"zone": "z1", "source_id": "router", "instance_id": "0"}))
+			Expect(c.PostMetrics()).To(Succeed())
+
+			event := findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.metricName")
+			Expect(attributes(event)).To(Equal(map[string]string{"zone": "z1", "job": "doppler"}))
+		})
+
+		It("adds static attributes to every event beneath the event's own", func() {
+			rollups = []riemannclient.RollupRule{{Match: "origin.rolled", Aggregations: []string{"max"}}}
+			c := newClient()
+			c.SetStaticAttributes(map[string]string{"environment": "production", "job": "static"})
+
+			c.AddMetric(tagged(1, nil))
+			c.AddMetric(&events.Envelope{
+				Origin:      pb.String("origin"),
+				Timestamp:   pb.Int64(1000000000),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{Name: pb.String("rolled"), Value: pb.Float64(3)},
+			})
+			Expect(c.PostMetrics()).To(Succeed())
+
+			received := fakeRiemann.Events()
+			Expect(attributes(findEvent(received, "riemann.nozzle.origin.metricName"))).To(Equal(map[string]string{"environment": "production", "job": "doppler"}))
+			Expect(attributes(findEvent(received, "riemann.nozzle.origin.rolled.max"))).To(Equal(map[string]string{"environment": "production", "job": "static", "rollup": "max"}))
+			Expect(attributes(findEvent(received, "riemann.nozzle.totalMessagesReceived"))).To(Equal(map[string]string{"environment": "production", "job": "static", "ip": "dummy-ip", "deployment": "test-deployment", "index": "3"}))
+		})
+	})
+
+	It("sends a critical slowConsumerAlert of 1 on every flush while the consumer is slow", func() {
+		c := newClient()
+
+		c.SetSlowConsumerStatus(riemannclient.SlowConsumerStatus{Slow: true, Description: "Behind since 2020-01-30T00:00:00Z: truncating_buffer=1"})
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(c.PostMetrics()).To(Succeed())
+
+		Expect(countEvents(fakeRiemann.Events(), "riemann.nozzle.slowConsumerAlert")).To(Equal(2))
+		for _, event := range fakeRiemann.Events() {
+			if event.GetService() == "riemann.nozzle.slowConsumerAlert" {
+				Expect(event.GetMetricD()).To(BeEquivalentTo(1))
+				Expect(event.GetState()).To(Equal("critical"))
+				Expect(event.GetDescription()).To(Equal("Behind since 2020-01-30T00:00:00Z: truncating_buffer=1"))
+			}
+		}
+	})
+
+	It("sends an ok slowConsumerAlert of 0 while the consumer keeps up", func() {
+		c := newClient()
+
+		Expect(c.PostMetrics()).To(Succeed())
+
+		alert := findEvent(fakeRiemann.Events(), "riemann.nozzle.slowConsumerAlert")
+		Expect(alert).NotTo(BeNil())
+		Expect(alert.GetMetricD()).To(BeEquivalentTo(0))
+		Expect(alert.GetState()).To(Equal("ok"))
+		Expect(alert.GetDescription()).To(BeEmpty())
+	})
+
+	It("resets the slowConsumerAlert once the consumer is no longer slow", func() {
+		c := newClient()
+
+		c.SetSlowConsumerStatus(riemannclient.SlowConsumerStatus{Slow: true, Description: "Behind since 2020-01-30T00:00:00Z: truncating_buffer=1"})
+		Expect(c.PostMetrics()).To(Succeed())
+		Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.slowConsumerAlert").GetMetricD()).To(BeEquivalentTo(1))
+
+		c.SetSlowConsumerStatus(riemannclient.SlowConsumerStatus{})
+		first := len(fakeRiemann.Events())
+		Expect(c.PostMetrics()).To(Succeed())
+		alert := findEvent(fakeRiemann.Events()[first:], "riemann.nozzle.slowConsumerAlert")
+		Expect(alert.GetMetricD()).To(BeEquivalentTo(0))
+		Expect(alert.GetState()).To(Equal("ok"))
+	})
+
+	It("reports a recovery with its description and duration once", func() {
+		c := newClient()
+
+		c.SetSlowConsumerStatus(riemannclient.SlowConsumerStatus{Description: "Caught up after 3m0s behind: ingest_queue=2", Duration: 3 * time.Minute})
+		Expect(c.PostMetrics()).To(Succeed())
+		recovery := findEvent(fakeRiemann.Events(), "riemann.nozzle.slowConsumerAlert")
+		Expect(recovery.GetMetricD()).To(BeEquivalentTo(0))
+		Expect(recovery.GetState()).To(Equal("ok"))
+		Expect(recovery.GetDescription()).To(Equal("Caught up after 3m0s behind: ingest_queue=2"))
+		Expect(attributes(recovery)).To(HaveKeyWithValue("duration_seconds", "180"))
+
+		first := len(fakeRiemann.Events())
+		Expect(c.PostMetrics()).To(Succeed())
+		next := findEvent(fakeRiemann.Events()[first:], "riemann.nozzle.slowConsumerAlert")
+		Expect(next.GetState()).To(Equal("ok"))
+		Expect(next.GetDescription()).To(BeEmpty())
+		Expect(attributes(next)).NotTo(HaveKey("duration_seconds"))
+	})
+
+	Context("when Riemann rejects the batch", func() {
+		BeforeEach(func() {
+			fakeRiemann.SetResponses(RiemannResponse{Ok: false, Error: "no such stream"})
+		})
+
+		It("drops the batch without retrying", func() {
+			c := newClient()
+
+			err := c.PostMetrics()
+			Expect(err).To(HaveOccurred())
+			Expect(err).To(BeAssignableToTypeOf(&riemannclient.RejectedError{}))
+			Expect(err.Error()).To(ContainSubstring("no such stream"))
+			Expect(fakeRiemann.MessagesServed()).To(Equal(1))
+			Expect(fakeRiemann.Events()).To(BeEmpty())
+		})
+
+		It("counts the rejected events in metricsRejected", func() {
+			c := newClient()
+
+			Expect(c.PostMetrics()).To(HaveOccurred())
+			Expect(c.PostMetrics()).To(Succeed())
+
+			// The rejected batch held only internal metrics; eventsPerFlush
+			// reports its size on the following flush.
+			rejectedBatch := findEvent(fakeRiemann.Events(), "riemann.nozzle.eventsPerFlush").GetMetricD()
+			Expect(rejectedBatch).To(BeNumerically(">", 0))
+
+			event := findEvent(fakeRiemann.Events(), "riemann.nozzle.metricsRejected")
+			Expect(event).NotTo(BeNil())
+			Expect(event.GetMetricD()).To(Equal(rejectedBatch))
+		})
+	})
+
+	Context("when the connection fails transiently", func() {
+		It("retries the batch until it is acknowledged", func() {
+			fakeRiemann.SetResponses(RiemannResponse{Hangup: true}, RiemannResponse{Hangup: true})
+			c := newClient()
+
+			err := c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeRiemann.MessagesServed()).To(Equal(3))
+			validateMetrics(fakeRiemann.Events(), 0, 0)
+		})
+
+		It("gives up after MaxRetries and does not keep the batch", func() {
+			fakeRiemann.SetResponses(RiemannResponse{Hangup: true}, RiemannResponse{Hangup: true}, RiemannResponse{Hangup: true})
+			c := newClient()
+
+			err := c.PostMetrics()
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(BeAssignableToTypeOf(&riemannclient.RejectedError{}))
+			Expect(fakeRiemann.MessagesServed()).To(Equal(3))
+
+			err = c.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(externalEvents(fakeRiemann.Events())).To(BeEmpty())
+		})
+
+		It("retries when the proxy cannot be reached", func() {
+			proxy := NewFakeRiemann("tcp")
+			proxy.Start()
+			proxy.Close()
+			os.Setenv("RIEMANN_PROXY", "socks5://"+proxy.Address())
+			defer os.Unsetenv("RIEMANN_PROXY")
+			c := newClient()
+
+			err := c.PostMetrics()
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(BeAssignableToTypeOf(&riemannclient.RejectedError{}))
+
+			os.Unsetenv("RIEMANN_PROXY")
+			Expect(c.PostMetrics()).To(Succeed())
+			received := fakeRiemann.Events()
+			Expect(findEventWith(received, "riemann.nozzle.sinkErrors", map[string]string{"kind": "transient"}).GetMetricD()).To(Equal(3.0))
+			Expect(findEventWith(received, "riemann.nozzle.sinkErrors", map[string]string{"kind": "rejected"}).GetMetricD()).To(Equal(0.0))
+			Expect(findEvent(received, "riemann.nozzle.metricsRejected").GetMetricD()).To(Equal(0.0))
+		})
+	})
+
+	Describe("multiple endpoints", func() {
+		var secondRiemann *FakeRiemann
+		var downAddress string
+
+		BeforeEach(func() {
+			secondRiemann = NewFakeRiemann("tcp")
+			secondRiemann.Start()
+
+			down := NewFakeRiemann("tcp")
+			down.Start()
+			downAddress = down.Address()
+			down.Close()
+		})
+
+		AfterEach(func() {
+			secondRiemann.Close()
+		})
+
+		newBalancedClient := func(balancing string, addresses ...string) *riemannclient.Client {
+			return riemannclient.New(addresses, balancing, "tcp", "riemann.nozzle.", "test-deployment", "dummy-ip", "3", retryPolicy, seriesLimit, rollups, nil)
+		}
+
+		addSeries := func(c *riemannclient.Client, names ...string) {
+			for _, name := range names {
+				c.AddMetric(&events.Envelope{
+					Origin:    pb.String("origin"),
+					Timestamp: pb.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  pb.String(name),
+						Value: pb.Float64(1),
 					},
-					influxdbclient.Point{
-						Timestamp: 2,
-						Value:     11.0,
+				})
+			}
+		}
+
+		It("sends everything to the first endpoint while it is up", func() {
+			c := newBalancedClient(riemannclient.BalanceFailover, fakeRiemann.Address(), secondRiemann.Address())
+
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(fakeRiemann.MessagesServed()).To(Equal(2))
+			Expect(secondRiemann.MessagesServed()).To(Equal(0))
+		})
+
+		It("fails over to the next endpoint without losing the batch and reports the endpoint down", func() {
+			c := newBalancedClient(riemannclient.BalanceFailover, downAddress, fakeRiemann.Address())
+			addSeries(c, "metricName")
+
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+			Expect(findEvent(first, "riemann.nozzle.origin.metricName")).NotTo(BeNil())
+
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+			Expect(findEventWith(second, "riemann.nozzle.endpointUp", map[string]string{"endpoint": downAddress}).GetMetricD()).To(Equal(0.0))
+			Expect(findEventWith(second, "riemann.nozzle.endpointErrors", map[string]string{"endpoint": downAddress}).GetMetricD()).To(Equal(1.0))
+			Expect(findEventWith(second, "riemann.nozzle.endpointUp", map[string]string{"endpoint": fakeRiemann.Address()}).GetMetricD()).To(Equal(1.0))
+		})
+
+		It("does not fail over a batch that Riemann rejects", func() {
+			fakeRiemann.SetResponses(RiemannResponse{Ok: false, Error: "bad"})
+			c := newBalancedClient(riemannclient.BalanceFailover, fakeRiemann.Address(), secondRiemann.Address())
+
+			Expect(c.PostMetrics()).To(BeAssignableToTypeOf(&riemannclient.RejectedError{}))
+			Expect(secondRiemann.MessagesServed()).To(Equal(0))
+		})
+
+		It("alternates between endpoints with round-robin", func() {
+			c := newBalancedClient(riemannclient.BalanceRoundRobin, fakeRiemann.Address(), secondRiemann.Address())
+
+			for i := 0; i < 4; i++ {
+				Expect(c.PostMetrics()).To(Succeed())
+			}
+			Expect(fakeRiemann.MessagesServed()).To(Equal(2))
+			Expect(secondRiemann.MessagesServed()).To(Equal(2))
+		})
+
+		It("keeps each series on one endpoint with hash", func() {
+			c := newBalancedClient(riemannclient.BalanceHash, fakeRiemann.Address(), secondRiemann.Address())
+			// The servers listen on random ports, so use enough series that
+			// both are all but certain to get some.
+			var names []string
+			for i := 0; i < 32; i++ {
+				names = append(names, fmt.Sprintf("series%d", i))
+			}
+
+			addSeries(c, names...)
+			Expect(c.PostMetrics()).To(Succeed())
+			addSeries(c, names...)
+			Expect(c.PostMetrics()).To(Succeed())
+
+			for _, name := range names {
+				service := "riemann.nozzle.origin." + name
+				first := countEvents(fakeRiemann.Events(), service)
+				second := countEvents(secondRiemann.Events(), service)
+				Expect([]int{first, second}).To(ConsistOf(0, 2), service)
+			}
+			Expect(externalEvents(fakeRiemann.Events())).NotTo(BeEmpty())
+			Expect(externalEvents(secondRiemann.Events())).NotTo(BeEmpty())
+		})
+
+		It("moves only the series of an endpoint that is down with hash", func() {
+			c := newBalancedClient(riemannclient.BalanceHash, downAddress, fakeRiemann.Address())
+			addSeries(c, "a", "b", "c", "d", "e", "f", "g", "h")
+
+			Expect(c.PostMetrics()).To(Succeed())
+			Expect(externalEvents(fakeRiemann.Events())).To(HaveLen(8))
+		})
+	})
+
+	Describe("series limit", func() {
+		addSeries := func(c *riemannclient.Client, origin string, names ...string) {
+			for _, name := range names {
+				c.AddMetric(&events.Envelope{
+					Origin:    pb.String(origin),
+					Timestamp: pb.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  pb.String(name),
+						Value: pb.Float64(1),
 					},
-				}))
+				})
 			}
 		}
-		Expect(counterNameFound).To(BeTrue())
-		validateMetrics(payload, 2, 0)
 
-		err = c.PostMetrics()
-		Expect(err).ToNot(HaveOccurred())
+		It("collapses series past the per-origin cap into an overflow series for that origin", func() {
+			seriesLimit = riemannclient.SeriesLimit{MaxSeriesPerOrigin: 2, Overflow: riemannclient.OverflowCollapse}
+			c := newClient()
+
+			addSeries(c, "noisy", "a", "b", "c", "d", "a")
+			addSeries(c, "quiet", "a")
+			Expect(c.PostMetrics()).To(Succeed())
 
-		Eventually(bodies).Should(HaveLen(2))
+			received := fakeRiemann.Events()
+			Expect(findEvent(received, "riemann.nozzle.noisy.a")).NotTo(BeNil())
+			Expect(findEvent(received, "riemann.nozzle.noisy.b")).NotTo(BeNil())
+			Expect(findEvent(received, "riemann.nozzle.noisy.c")).To(BeNil())
+			Expect(findEvent(received, "riemann.nozzle.quiet.a")).NotTo(BeNil())
 
-		err = json.Unmarshal(bodies[1], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
+			overflow := findEvent(received, "riemann.nozzle.noisy.__overflow__")
+			Expect(overflow).NotTo(BeNil())
+			Expect(overflow.GetMetricD()).To(Equal(2.0))
+
+			offender := findEventWith(received, "riemann.nozzle.seriesOverflowed", map[string]string{"origin": "noisy"})
+			Expect(offender).NotTo(BeNil())
+			Expect(offender.GetMetricD()).To(Equal(2.0))
+			Expect(findEvent(received, "riemann.nozzle.totalSeriesOverflowed").GetMetricD()).To(Equal(2.0))
+		})
 
-		validateMetrics(payload, 2, 4)
+		It("drops series past the global cap and starts over on the next flush", func() {
+			seriesLimit = riemannclient.SeriesLimit{MaxSeries: 2, Overflow: riemannclient.OverflowDrop}
+			c := newClient()
+
+			addSeries(c, "origin", "a", "b", "c")
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+			Expect(findEvent(first, "riemann.nozzle.origin.c")).To(BeNil())
+			Expect(findEvent(first, "riemann.nozzle.__overflow__")).To(BeNil())
+
+			addSeries(c, "origin", "c")
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+			Expect(findEvent(second, "riemann.nozzle.origin.c")).NotTo(BeNil())
+			Expect(findEvent(second, "riemann.nozzle.totalSeriesOverflowed").GetMetricD()).To(Equal(1.0))
+			Expect(findEvent(second, "riemann.nozzle.seriesOverflowed")).To(BeNil())
+		})
 	})
 
-	It("sends a value 1 for the slowConsumerAlert metric when consumer error is set", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	Describe("shards", func() {
+		valueMetric := func(origin string, name string, value float64) *events.Envelope {
+			return &events.Envelope{
+				Origin:    pb.String(origin),
+				Timestamp: pb.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  pb.String(name),
+					Value: pb.Float64(value),
+				},
+			}
+		}
 
-		c.AlertSlowConsumerError()
+		It("sends what every shard aggregated with the next flush", func() {
+			c := newClient()
+			shards := c.NewShards(2)
+
+			for _, envelope := range []*events.Envelope{
+				valueMetric("origin", "a", 1),
+				valueMetric("origin", "b", 2),
+				valueMetric("origin", "a", 3),
+				valueMetric("other", "a", 4),
+			} {
+				shards[riemannclient.ShardFor(envelope, len(shards))].AddMetric(envelope)
+			}
+			for _, shard := range shards {
+				c.Merge(shard)
+				shard.Reset()
+			}
+			Expect(c.PostMetrics()).To(Succeed())
 
-		err := c.PostMetrics()
-		Expect(err).ToNot(HaveOccurred())
+			received := fakeRiemann.Events()
+			Expect(countEvents(received, "riemann.nozzle.origin.a")).To(Equal(2))
+			Expect(countEvents(received, "riemann.nozzle.origin.b")).To(Equal(1))
+			Expect(countEvents(received, "riemann.nozzle.other.a")).To(Equal(1))
+			Expect(findEvent(received, "riemann.nozzle.totalMessagesReceived").GetMetricD()).To(Equal(4.0))
+		})
+
+		It("keeps every point of a series on one shard", func() {
+			envelope := valueMetric("origin", "a", 1)
+			shard := riemannclient.ShardFor(envelope, 8)
+			Expect(riemannclient.ShardFor(valueMetric("origin", "a", 2), 8)).To(Equal(shard))
+			Expect(riemannclient.ShardFor(envelope, 1)).To(Equal(0))
+		})
+
+		It("leaves a shard empty once reset", func() {
+			c := newClient()
+			shard := c.NewShards(1)[0]
+
+			shard.AddMetric(valueMetric("origin", "a", 1))
+			c.Merge(shard)
+			shard.Reset()
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+
+			c.Merge(shard)
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+			Expect(externalEvents(second)).To(BeEmpty())
+			Expect(findEvent(second, "riemann.nozzle.totalMessagesReceived").GetMetricD()).To(Equal(1.0))
+		})
+
+		It("divides the series limits between shards and sums their overflow series", func() {
+			seriesLimit = riemannclient.SeriesLimit{MaxSeriesPerOrigin: 4, Overflow: riemannclient.OverflowCollapse}
+			c := newClient()
+			shards := c.NewShards(2)
 
-		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
-
-		errMetric := findSlowConsumerMetric(payload)
-		Expect(errMetric).NotTo(BeNil())
-		Expect(errMetric.Type).To(Equal("gauge"))
-		Expect(errMetric.Points).To(HaveLen(1))
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(1))
+			for _, name := range []string{"a", "b", "c"} {
+				shards[0].AddMetric(valueMetric("noisy", name, 1))
+			}
+			for _, name := range []string{"d", "e", "f", "g"} {
+				shards[1].AddMetric(valueMetric("noisy", name, 1))
+			}
+			for _, shard := range shards {
+				c.Merge(shard)
+				shard.Reset()
+			}
+			Expect(c.PostMetrics()).To(Succeed())
+
+			received := fakeRiemann.Events()
+			Expect(findEvent(received, "riemann.nozzle.noisy.__overflow__").GetMetricD()).To(Equal(3.0))
+			Expect(findEventWith(received, "riemann.nozzle.seriesOverflowed", map[string]string{"origin": "noisy"}).GetMetricD()).To(Equal(3.0))
+			Expect(findEvent(received, "riemann.nozzle.totalSeriesOverflowed").GetMetricD()).To(Equal(3.0))
+		})
 	})
 
-	It("sends a value 0 for the slowConsumerAlert metric when consumer error is not set", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	Describe("flush windows", func() {
+		valueMetric := func(name string, value float64) *events.Envelope {
+			return &events.Envelope{
+				Origin:      pb.String("origin"),
+				Timestamp:   pb.Int64(1000000000),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{Name: pb.String(name), Value: pb.Float64(value)},
+				Tags:        map[string]string{"source_id": "api"},
+			}
+		}
 
-		err := c.PostMetrics()
-		Expect(err).ToNot(HaveOccurred())
+		It("sends only the points of the current window for a series seen before", func() {
+			c := newClient()
+			c.AddMetric(valueMetric("a", 1))
+			c.AddMetric(valueMetric("a", 2))
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+
+			c.AddMetric(valueMetric("a", 3))
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+
+			Expect(externalEvents(second)).To(HaveLen(1))
+			event := findEvent(second, "riemann.nozzle.origin.a")
+			Expect(event.GetMetricD()).To(Equal(3.0))
+			Expect(attributes(event)).To(Equal(map[string]string{"source_id": "api"}))
+			Expect(findEvent(second, "riemann.nozzle.seriesCardinality").GetMetricD()).To(Equal(1.0))
+		})
+
+		It("does not send or count a series without points in the window", func() {
+			c := newClient()
+			c.AddMetric(valueMetric("a", 1))
+			c.AddMetric(valueMetric("b", 1))
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
 
-		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
-		Expect(payload.Series).To(HaveLen(3))
-
-		errMetric := findSlowConsumerMetric(payload)
-		Expect(errMetric).NotTo(BeNil())
-		Expect(errMetric.Type).To(Equal("gauge"))
-		Expect(errMetric.Points).To(HaveLen(1))
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(0))
+			c.AddMetric(valueMetric("b", 2))
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+
+			Expect(findEvent(second, "riemann.nozzle.origin.a")).To(BeNil())
+			Expect(findEvent(second, "riemann.nozzle.seriesCardinality").GetMetricD()).To(Equal(1.0))
+		})
+
+		It("counts a series seen before against the series limit again", func() {
+			seriesLimit = riemannclient.SeriesLimit{MaxSeries: 1, Overflow: riemannclient.OverflowDrop}
+			c := newClient()
+			c.AddMetric(valueMetric("a", 1))
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+
+			c.AddMetric(valueMetric("b", 1))
+			c.AddMetric(valueMetric("a", 2))
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+
+			Expect(findEvent(second, "riemann.nozzle.origin.b")).NotTo(BeNil())
+			Expect(findEvent(second, "riemann.nozzle.origin.a")).To(BeNil())
+		})
 	})
 
-	It("unsets the slow consumer error once it publishes the alert to datadog", func() {
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
+	Describe("rollups", func() {
+		addPoints := func(c *riemannclient.Client, origin string, name string, values ...float64) {
+			for i, value := range values {
+				c.AddMetric(&events.Envelope{
+					Origin:    pb.String(origin),
+					Timestamp: pb.Int64(int64(i+1) * int64(time.Second)),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  pb.String(name),
+						Value: pb.Float64(value),
+					},
+					Job: pb.String("router"),
+				})
+			}
+		}
 
-		c.AlertSlowConsumerError()
+		BeforeEach(func() {
+			rollups = []riemannclient.RollupRule{
+				{Match: "gorouter.*", Aggregations: []string{"last", "min", "max", "mean", "sum", "count", "p50", "p90"}},
+			}
+		})
 
-		err := c.PostMetrics()
-		Expect(err).ToNot(HaveOccurred())
+		It("sends one event per aggregation instead of the raw points", func() {
+			c := newClient()
+			addPoints(c, "gorouter", "latency", 4, 1, 3, 2, 10, 6, 5, 9, 7, 8)
+			Expect(c.PostMetrics()).To(Succeed())
+
+			received := fakeRiemann.Events()
+			Expect(findEvent(received, "riemann.nozzle.gorouter.latency")).To(BeNil())
+
+			expected := map[string]float64{"last": 8, "min": 1, "max": 10, "mean": 5.5, "sum": 55, "count": 10, "p50": 5, "p90": 9}
+			for aggregation, value := range expected {
+				event := findEvent(received, "riemann.nozzle.gorouter.latency."+aggregation)
+				Expect(event).NotTo(BeNil(), aggregation)
+				Expect(event.GetMetricD()).To(Equal(value), aggregation)
+				Expect(event.GetTime()).To(BeEquivalentTo(10))
+				Expect(attributes(event)).To(Equal(map[string]string{"job": "router", "rollup": aggregation}))
+			}
+		})
 
-		Eventually(bodies).Should(HaveLen(1))
-		var payload influxdbclient.Payload
-		err = json.Unmarshal(bodies[0], &payload)
-		Expect(err).NotTo(HaveOccurred())
+		It("sends series that match no rule unchanged", func() {
+			c := newClient()
+			addPoints(c, "doppler", "latency", 1, 2)
+			Expect(c.PostMetrics()).To(Succeed())
 
-		errMetric := findSlowConsumerMetric(payload)
-		Expect(errMetric).NotTo(BeNil())
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(1))
+			Expect(externalEvents(fakeRiemann.Events())).To(HaveLen(2))
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.doppler.latency")).NotTo(BeNil())
+		})
 
-		err = c.PostMetrics()
-		Expect(err).ToNot(HaveOccurred())
+		It("uses the first matching rule", func() {
+			rollups = append([]riemannclient.RollupRule{{Match: "gorouter.latency", Aggregations: []string{"max"}}}, rollups...)
+			c := newClient()
+			addPoints(c, "gorouter", "latency", 1, 2)
+			Expect(c.PostMetrics()).To(Succeed())
 
-		Eventually(bodies).Should(HaveLen(2))
-		err = json.Unmarshal(bodies[1], &payload)
-		Expect(err).NotTo(HaveOccurred())
+			Expect(externalEvents(fakeRiemann.Events())).To(HaveLen(1))
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.gorouter.latency.max").GetMetricD()).To(Equal(2.0))
+		})
 
-		errMetric = findSlowConsumerMetric(payload)
-		Expect(findSlowConsumerMetric(payload)).ToNot(BeNil())
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(0))
+		It("starts each flush window's aggregations afresh", func() {
+			c := newClient()
+			addPoints(c, "gorouter", "latency", 4, 1, 3)
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+
+			addPoints(c, "gorouter", "latency", 6, 5)
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+
+			expected := map[string]float64{"last": 5, "min": 5, "max": 6, "mean": 5.5, "sum": 11, "count": 2, "p50": 5, "p90": 6}
+			for aggregation, value := range expected {
+				Expect(findEvent(second, "riemann.nozzle.gorouter.latency."+aggregation).GetMetricD()).To(Equal(value), aggregation)
+			}
+		})
+
+		It("validates rules", func() {
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"p99.9"}}.Validate()).To(Succeed())
+			Expect(riemannclient.RollupRule{Match: "[", Aggregations: []string{"max"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"median"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"p101"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"p0"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"pNaN"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"pInf"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"p1e1"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"p+50"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*", Aggregations: []string{"p.5"}}.Validate()).NotTo(Succeed())
+			Expect(riemannclient.RollupRule{Match: "*"}.Validate()).NotTo(Succeed())
+		})
 	})
 
-	It("returns an error when datadog responds with a non 200 response code", func() {
+	Describe("debug sink", func() {
+		var output *bytes.Buffer
 
-		c := influxdbclient.New(ts.URL, "testdb", "user", "password", "influxdb.nozzle.", "test-deployment", "dummy-ip")
-		responseCode = http.StatusBadRequest // 400
-		err := c.PostMetrics()
-		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("datadog request returned HTTP response: 400 Bad Request"))
+		BeforeEach(func() {
+			output = &bytes.Buffer{}
+		})
 
-		responseCode = http.StatusSwitchingProtocols // 101
-		err = c.PostMetrics()
-		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("datadog request returned HTTP response: 101"))
+		post := func(c *riemannclient.Client) []map[string]interface{} {
+			c.SetDebugSink(riemannclient.NewDebugSink(output))
+			c.AddMetric(&events.Envelope{
+				Origin:    pb.String("origin"),
+				Timestamp: pb.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  pb.String("metricName"),
+					Value: pb.Float64(5),
+				},
+				Job: pb.String("doppler"),
+			})
+			Expect(c.PostMetrics()).To(Succeed())
+
+			var lines []map[string]interface{}
+			decoder := json.NewDecoder(output)
+			for decoder.More() {
+				var line map[string]interface{}
+				Expect(decoder.Decode(&line)).To(Succeed())
+				lines = append(lines, line)
+			}
+			return lines
+		}
 
-		responseCode = http.StatusAccepted // 201
-		err = c.PostMetrics()
-		Expect(err).ToNot(HaveOccurred())
+		It("writes every event it sends as a JSON line", func() {
+			lines := post(newClient())
+
+			Expect(lines).To(HaveLen(len(fakeRiemann.Events())))
+			var forwarded map[string]interface{}
+			for _, line := range lines {
+				if line["service"] == "riemann.nozzle.origin.metricName" {
+					forwarded = line
+				}
+			}
+			Expect(forwarded).NotTo(BeNil())
+			Expect(forwarded["time"]).To(BeEquivalentTo(1))
+			Expect(forwarded["metric"]).To(BeEquivalentTo(5))
+			Expect(forwarded["host"]).NotTo(BeEmpty())
+			Expect(forwarded["attributes"]).To(Equal(map[string]interface{}{"job": "doppler"}))
+		})
+
+		It("does not contact Riemann on a dry run", func() {
+			c := newClient()
+			c.SetDryRun(true)
+
+			lines := post(c)
+			Expect(lines).NotTo(BeEmpty())
+			Expect(fakeRiemann.MessagesServed()).To(Equal(0))
+		})
+	})
+
+	Describe("canary", func() {
+		newCanary := func() *riemannclient.Canary {
+			return riemannclient.NewCanary(fakeRiemann.Address(), "riemann.nozzle.canary", time.Minute, 300*time.Millisecond)
+		}
+
+		It("finds its tagged event in the index", func() {
+			latency, err := newCanary().Check()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(latency).To(BeNumerically(">", 0))
+
+			received := fakeRiemann.Events()
+			Expect(received).To(HaveLen(1))
+			Expect(received[0].GetService()).To(Equal("riemann.nozzle.canary"))
+			Expect(received[0].GetTags()).To(ConsistOf(HavePrefix("canary-")))
+			Expect(received[0].GetTtl()).To(Equal(float32(60)))
+		})
+
+		It("tags every check uniquely", func() {
+			canary := newCanary()
+			_, err := canary.Check()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = canary.Check()
+			Expect(err).ToNot(HaveOccurred())
+
+			received := fakeRiemann.Events()
+			Expect(received).To(HaveLen(2))
+			Expect(received[0].GetTags()).NotTo(Equal(received[1].GetTags()))
+		})
+
+		It("fails when Riemann accepts the event but does not index it", func() {
+			fakeRiemann.StopIndexing()
+
+			_, err := newCanary().Check()
+			Expect(err).To(MatchError(ContainSubstring("not indexed within 300ms")))
+			Expect(fakeRiemann.Queries()).To(BeNumerically(">", 1))
+		})
+
+		It("fails when Riemann rejects the event", func() {
+			fakeRiemann.SetResponses(RiemannResponse{Ok: false, Error: "bad"})
+
+			_, err := newCanary().Check()
+			Expect(err).To(MatchError(ContainSubstring("sending canary event")))
+			Expect(fakeRiemann.Queries()).To(Equal(0))
+		})
+	})
+
+	Describe("self-telemetry", func() {
+		valueMetric := func(origin string, name string) *events.Envelope {
+			return &events.Envelope{
+				Origin:    pb.String(origin),
+				Timestamp: pb.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  pb.String(name),
+					Value: pb.Float64(1),
+				},
+			}
+		}
+
+		It("counts received envelopes by type and origin and dropped envelopes by type", func() {
+			c := newClient()
+
+			c.AddMetric(valueMetric("doppler", "a"))
+			c.AddMetric(valueMetric("doppler", "b"))
+			c.AddMetric(valueMetric("gorouter", "a"))
+			c.AddMetric(&events.Envelope{
+				Origin:    pb.String("gorouter"),
+				EventType: events.Envelope_HttpStartStop.Enum(),
+			})
+
+			Expect(c.PostMetrics()).To(Succeed())
+			received := fakeRiemann.Events()
+
+			doppler := findEventWith(received, "riemann.nozzle.messagesReceived", map[string]string{"event_type": "ValueMetric", "origin": "doppler"})
+			Expect(doppler).NotTo(BeNil())
+			Expect(doppler.GetMetricD()).To(Equal(2.0))
+			Expect(attributes(doppler)).To(HaveKeyWithValue("index", "3"))
+
+			httpStartStop := findEventWith(received, "riemann.nozzle.messagesReceived", map[string]string{"event_type": "HttpStartStop", "origin": "gorouter"})
+			Expect(httpStartStop.GetMetricD()).To(Equal(1.0))
+
+			dropped := findEventWith(received, "riemann.nozzle.messagesDropped", map[string]string{"event_type": "HttpStartStop"})
+			Expect(dropped).NotTo(BeNil())
+			Expect(dropped.GetMetricD()).To(Equal(1.0))
+
+			cardinality := findEvent(received, "riemann.nozzle.seriesCardinality")
+			Expect(cardinality.GetMetricD()).To(Equal(3.0))
+		})
+
+		It("reports the size and duration of the previous flush", func() {
+			c := newClient()
+			c.AddMetric(valueMetric("doppler", "a"))
+
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+			Expect(findEvent(first, "riemann.nozzle.eventsPerFlush").GetMetricD()).To(Equal(0.0))
+			Expect(findEvent(first, "riemann.nozzle.bytesSent").GetMetricD()).To(Equal(0.0))
+
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+			Expect(findEvent(second, "riemann.nozzle.eventsPerFlush").GetMetricD()).To(BeEquivalentTo(len(first)))
+			Expect(findEvent(second, "riemann.nozzle.bytesSent").GetMetricD()).To(BeNumerically(">", 0))
+			Expect(findEvent(second, "riemann.nozzle.flushDurationMs").GetMetricD()).To(BeNumerically(">", 0))
+		})
+
+		It("reports the latest canary check of each endpoint with the next flush only", func() {
+			c := newClient()
+			c.RecordCanary("riemann-1:5555", 0, errors.New("not indexed"))
+			c.RecordCanary("riemann-1:5555", 25*time.Millisecond, nil)
+			c.RecordCanary("riemann-2:5555", 0, errors.New("not indexed"))
+
+			Expect(c.PostMetrics()).To(Succeed())
+			first := fakeRiemann.Events()
+			Expect(findEventWith(first, "riemann.nozzle.canarySuccess", map[string]string{"endpoint": "riemann-1:5555"}).GetMetricD()).To(Equal(1.0))
+			Expect(findEventWith(first, "riemann.nozzle.canaryLatencyMs", map[string]string{"endpoint": "riemann-1:5555"}).GetMetricD()).To(Equal(25.0))
+			Expect(findEventWith(first, "riemann.nozzle.canarySuccess", map[string]string{"endpoint": "riemann-2:5555"}).GetMetricD()).To(Equal(0.0))
+			Expect(findEventWith(first, "riemann.nozzle.canaryLatencyMs", map[string]string{"endpoint": "riemann-2:5555"})).To(BeNil())
+
+			Expect(c.PostMetrics()).To(Succeed())
+			second := fakeRiemann.Events()[len(first):]
+			Expect(findEvent(second, "riemann.nozzle.canarySuccess")).To(BeNil())
+		})
+
+		It("counts sink errors by kind", func() {
+			fakeRiemann.SetResponses(RiemannResponse{Hangup: true}, RiemannResponse{Ok: false, Error: "bad"})
+			c := newClient()
+
+			Expect(c.PostMetrics()).NotTo(Succeed())
+			Expect(c.PostMetrics()).To(Succeed())
 
+			received := fakeRiemann.Events()
+			Expect(findEventWith(received, "riemann.nozzle.sinkErrors", map[string]string{"kind": "transient"}).GetMetricD()).To(Equal(1.0))
+			Expect(findEventWith(received, "riemann.nozzle.sinkErrors", map[string]string{"kind": "rejected"}).GetMetricD()).To(Equal(1.0))
+			Expect(findEventWith(received, "riemann.nozzle.sinkErrors", map[string]string{"kind": "encoding"}).GetMetricD()).To(Equal(0.0))
+		})
+
+		It("counts a dropped batch as a backlog error without sending it", func() {
+			c := newClient()
+
+			c.DropBatch(c.NextBatch())
+			Expect(fakeRiemann.MessagesServed()).To(Equal(0))
+
+			Expect(c.Send(c.NextBatch())).To(Succeed())
+			Expect(findEventWith(fakeRiemann.Events(), "riemann.nozzle.sinkErrors", map[string]string{"kind": "backlog"}).GetMetricD()).To(Equal(1.0))
+		})
 	})
 
+	It("sends a batch taken from one flush window while the next one is filled", func() {
+		c := newClient()
+
+		batch := c.NextBatch()
+		c.SetSlowConsumerStatus(riemannclient.SlowConsumerStatus{Slow: true})
+
+		Expect(c.Send(batch)).To(Succeed())
+		first := fakeRiemann.Events()
+		Expect(first).To(HaveLen(batch.Len()))
+		Expect(findEvent(first, "riemann.nozzle.slowConsumerAlert").GetMetricD()).To(BeEquivalentTo(0))
+
+		Expect(c.PostMetrics()).To(Succeed())
+		second := fakeRiemann.Events()[len(first):]
+		Expect(findEvent(second, "riemann.nozzle.slowConsumerAlert").GetMetricD()).To(BeEquivalentTo(1))
+		validateMetrics(second, 0, batch.Len())
+	})
 })
 
-func validateMetrics(payload influxdbclient.Payload, totalMessagesReceived int, totalMetricsSent int) {
-	totalMessagesReceivedFound := false
-	totalMetricsSentFound := false
-	for _, metric := range payload.Series {
-		Expect(metric.Type).To(Equal("gauge"))
-
-		internalMetric := false
-		var metricValue int
-		if metric.Metric == "datadog.nozzle.totalMessagesReceived" {
-			totalMessagesReceivedFound = true
-			internalMetric = true
-			metricValue = totalMessagesReceived
+func validateMetrics(events []*proto.Event, totalMessagesReceived int, totalMetricsSent int) {
+	received := findEvent(events, "riemann.nozzle.totalMessagesReceived")
+	Expect(received).NotTo(BeNil())
+	Expect(received.GetTime()).To(BeNumerically(">", time.Now().Unix()-10), "Timestamp should not be less than 10 seconds ago")
+	Expect(received.GetMetricD()).To(Equal(float64(totalMessagesReceived)))
+	Expect(attributes(received)).To(Equal(map[string]string{"ip": "dummy-ip", "deployment": "test-deployment", "index": "3"}))
+
+	sent := findEvent(events, "riemann.nozzle.totalMetricsSent")
+	Expect(sent).NotTo(BeNil())
+	Expect(sent.GetMetricD()).To(Equal(float64(totalMetricsSent)))
+}
+
+func findEvent(events []*proto.Event, service string) *proto.Event {
+	return findEventWith(events, service, nil)
+}
+
+func findEventWith(events []*proto.Event, service string, labels map[string]string) *proto.Event {
+	for _, event := range events {
+		if event.GetService() != service {
+			continue
 		}
-		if metric.Metric == "datadog.nozzle.totalMetricsSent" {
-			totalMetricsSentFound = true
-			internalMetric = true
-			metricValue = totalMetricsSent
+		eventAttributes := attributes(event)
+		matches := true
+		for label, value := range labels {
+			if eventAttributes[label] != value {
+				matches = false
+			}
 		}
-
-		if internalMetric {
-			Expect(metric.Points).To(HaveLen(1))
-			Expect(metric.Points[0].Timestamp).To(BeNumerically(">", time.Now().Unix()-10), "Timestamp should not be less than 10 seconds ago")
-			Expect(metric.Points[0].Value).To(Equal(float64(metricValue)))
-			Expect(metric.Tags).To(Equal([]string{"ip:dummy-ip", "deployment:test-deployment"}))
+		if matches {
+			return event
 		}
 	}
-	Expect(totalMessagesReceivedFound).To(BeTrue())
-	Expect(totalMetricsSentFound).To(BeTrue())
+	return nil
 }
 
-func handlePost(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		panic("No body!")
+func findEvents(events []*proto.Event, service string) []*proto.Event {
+	var found []*proto.Event
+	for _, event := range events {
+		if event.GetService() == service {
+			found = append(found, event)
+		}
 	}
+	return found
+}
 
-	bodies = append(bodies, body)
-	w.WriteHeader(responseCode)
+func countEvents(events []*proto.Event, service string) int {
+	count := 0
+	for _, event := range events {
+		if event.GetService() == service {
+			count++
+		}
+	}
+	return count
 }
 
-func findSlowConsumerMetric(payload influxdbclient.Payload) *influxdbclient.Metric {
-	for _, metric := range payload.Series {
-		if metric.Metric == "datadog.nozzle.slowConsumerAlert" {
-			return &metric
+// externalEvents filters out the nozzle's own metrics, which carry the
+// nozzle's ip.
+func externalEvents(events []*proto.Event) []*proto.Event {
+	var external []*proto.Event
+	for _, event := range events {
+		if attributes(event)["ip"] != "dummy-ip" {
+			external = append(external, event)
 		}
 	}
-	return nil
+	return external
+}
+
+func attributes(event *proto.Event) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range event.GetAttributes() {
+		attributes[attribute.GetKey()] = attribute.GetValue()
+	}
+	return attributes
 }
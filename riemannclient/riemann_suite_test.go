@@ -9,9 +9,9 @@ import (
 	"testing"
 )
 
-func TestDatadogclient(t *testing.T) {
+func TestRiemannclient(t *testing.T) {
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "DatadogClient Suite")
+	RunSpecs(t, "RiemannClient Suite")
 }
 
 var _ = BeforeSuite(func() {
@@ -0,0 +1,120 @@
+package riemannclient
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// RollupRule replaces the raw points of every series whose name matches
+// Match, a path.Match pattern such as "gorouter.*", with one event per
+// aggregation each flush. Aggregations are last, min, max, mean, sum, count
+// and percentiles written as p50, p99 or p99.9. Each event's service is the
+// series name followed by the aggregation, e.g. "gorouter.latency.p99".
+type RollupRule struct {
+	Match        string
+	Aggregations []string
+}
+
+func (r RollupRule) Validate() error {
+	if r.Match == "" {
+		return fmt.Errorf("Match is required")
+	}
+	if _, err := path.Match(r.Match, ""); err != nil {
+		return fmt.Errorf("Match %q is not a valid pattern: %s", r.Match, err)
+	}
+	if len(r.Aggregations) == 0 {
+		return fmt.Errorf("Aggregations is required")
+	}
+	for _, aggregation := range r.Aggregations {
+		if !isAggregation(aggregation) {
+			return fmt.Errorf("unknown aggregation %q, expected last, min, max, mean, sum, count or a percentile such as p99", aggregation)
+		}
+	}
+	return nil
+}
+
+// rollupFor returns the first rule matching the series name, or nil if its
+// points are sent as they are. The nozzle's own metrics and overflow series
+// are never rolled up.
+func (a *aggregator) rollupFor(eventType events.Envelope_EventType, name string) *RollupRule {
+	if eventType != events.Envelope_ValueMetric && eventType != events.Envelope_CounterEvent {
+		return nil
+	}
+	for i := range a.rollups {
+		if matched, _ := path.Match(a.rollups[i].Match, name); matched {
+			return &a.rollups[i]
+		}
+	}
+	return nil
+}
+
+// hasPercentile reports whether the rule needs every value of a series
+// rather than a few running totals. A nil rule has no percentile.
+func (r *RollupRule) hasPercentile() bool {
+	if r == nil {
+		return false
+	}
+	for _, aggregation := range r.Aggregations {
+		if _, ok := parsePercentile(aggregation); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isAggregation(name string) bool {
+	switch name {
+	case "last", "min", "max", "mean", "sum", "count":
+		return true
+	}
+	_, ok := parsePercentile(name)
+	return ok
+}
+
+// percentileName only admits plain decimals, so names such as pNaN, pInf or
+// p1e1 that strconv would also parse are not percentiles.
+var percentileName = regexp.MustCompile(`^p\d+(\.\d+)?$`)
+
+func parsePercentile(name string) (float64, bool) {
+	if !percentileName.MatchString(name) {
+		return 0, false
+	}
+	percentile, err := strconv.ParseFloat(name[1:], 64)
+	if err != nil || percentile <= 0 || percentile > 100 {
+		return 0, false
+	}
+	return percentile, true
+}
+
+// aggregate computes aggregation over the points of s, which must have at
+// least one. Percentiles use the nearest-rank method.
+func (s *series) aggregate(aggregation string) float64 {
+	switch aggregation {
+	case "last":
+		return s.last.Value
+	case "count":
+		return float64(s.count)
+	case "sum":
+		return s.sum
+	case "mean":
+		return s.sum / float64(s.count)
+	case "min":
+		return s.min
+	case "max":
+		return s.max
+	}
+
+	percentile, _ := parsePercentile(aggregation)
+	sort.Float64s(s.values)
+	rank := int(math.Ceil(percentile / 100 * float64(len(s.values))))
+	if rank < 1 {
+		rank = 1
+	}
+	return s.values[rank-1]
+}
@@ -0,0 +1,211 @@
+package riemannclient
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// maxRetainedPoints is the most points a series keeps room for from one
+// flush window to the next. A burst past it is let go once flushed, rather
+// than held for as long as the series lives.
+const maxRetainedPoints = 1024
+
+// series is what a flush window has aggregated for one metricKey. Series
+// live on from one window to the next and are cleared in place, so that a
+// steady stream of envelopes allocates nothing once its series exist. A
+// series without points for a whole window is dropped.
+type series struct {
+	// name is the series' origin and name, the event service without the
+	// prefix.
+	name string
+	// attributes are built when the series is created: everything in them
+	// is part of its key.
+	attributes map[string]string
+	rollup     *RollupRule
+	// overflow marks an overflow series, sent as the number of points
+	// collapsed into it.
+	overflow bool
+
+	count int
+	sum   float64
+	min   float64
+	max   float64
+	last  Point
+	// points holds every point of a series sent as it is, and values every
+	// value of a rolled up series with a percentile. Other rollups need no
+	// more than the accumulators above.
+	points     []Point
+	keepValues bool
+	values     []float64
+
+	state       string
+	description string
+
+	// events is what the series is sent as, built by the client the first
+	// time it sends the series.
+	events []seriesEvent
+}
+
+// seriesEvent is the service and attributes of one event a series is sent
+// as: one per aggregation for a rollup, otherwise one for every point.
+type seriesEvent struct {
+	service     string
+	aggregation string
+	attributes  map[string]string
+}
+
+func (s *series) add(point Point) {
+	if s.count == 0 || point.Value < s.min {
+		s.min = point.Value
+	}
+	if s.count == 0 || point.Value > s.max {
+		s.max = point.Value
+	}
+	s.count++
+	s.sum += point.Value
+	s.last = point
+
+	switch {
+	case s.overflow:
+	case s.rollup == nil:
+		s.points = append(s.points, point)
+	case s.keepValues:
+		s.values = append(s.values, point.Value)
+	}
+}
+
+// merge adds the points of other, which come after those of s.
+func (s *series) merge(other *series) {
+	if other.count == 0 {
+		return
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	s.last = other.last
+	s.points = append(s.points, other.points...)
+	s.values = append(s.values, other.values...)
+}
+
+// clear empties the series for the next flush window, keeping the room it
+// has for points unless a burst made it unusually large.
+func (s *series) clear() {
+	s.count = 0
+	s.sum, s.min, s.max = 0, 0, 0
+	s.last = Point{}
+	s.state, s.description = "", ""
+
+	if cap(s.points) > maxRetainedPoints {
+		s.points = nil
+	}
+	s.points = s.points[:0]
+	if cap(s.values) > maxRetainedPoints {
+		s.values = nil
+	}
+	s.values = s.values[:0]
+}
+
+// newSeries creates the series of key, sent with attributes.
+func (a *aggregator) newSeries(key metricKey, attributes map[string]string) *series {
+	name := key.name
+	if key.origin != "" {
+		name = key.origin + "." + key.name
+	}
+	s := &series{name: name, attributes: attributes}
+	s.rollup = a.rollupFor(key.eventType, name)
+	s.keepValues = s.rollup.hasPercentile()
+	a.metricPoints[key] = s
+	return s
+}
+
+// activeSeries counts the series with points in the current flush window.
+func (a *aggregator) activeSeries() int {
+	active := 0
+	for _, s := range a.metricPoints {
+		if s.count > 0 {
+			active++
+		}
+	}
+	return active
+}
+
+// reset starts a new flush window: series with points in the window just
+// flushed are cleared in place and those without are dropped.
+func (a *aggregator) reset() {
+	for key, s := range a.metricPoints {
+		if s.count == 0 {
+			delete(a.metricPoints, key)
+			continue
+		}
+		s.clear()
+	}
+	// Labels outlive the series that used them; start over once they
+	// outnumber the series left.
+	if len(a.labels) > len(a.metricPoints) {
+		a.labels = make(map[string]string)
+	}
+	a.limiter.reset()
+}
+
+// envelopeLabels returns the tags of envelope that the filter lets through,
+// joined in order of name as name=value pairs separated by commas, with
+// backslashes, commas and equals signs escaped so that different tags never
+// join the same way. The result is interned, so that the series of an
+// envelope can be looked up without allocating.
+func (a *aggregator) envelopeLabels(envelope *events.Envelope) string {
+	tags := envelope.GetTags()
+	a.tagNames = a.tagNames[:0]
+	for tag := range tags {
+		if tag == FoundationAttribute || !a.tagFilter.allows(tag) {
+			continue
+		}
+		a.tagNames = append(a.tagNames, tag)
+	}
+	if len(a.tagNames) == 0 {
+		return ""
+	}
+
+	// Envelopes have few tags: an insertion sort does not allocate, unlike
+	// sort.Strings.
+	for i := 1; i < len(a.tagNames); i++ {
+		for j := i; j > 0 && a.tagNames[j] < a.tagNames[j-1]; j-- {
+			a.tagNames[j], a.tagNames[j-1] = a.tagNames[j-1], a.tagNames[j]
+		}
+	}
+
+	a.labelBuffer = a.labelBuffer[:0]
+	for i, tag := range a.tagNames {
+		if i > 0 {
+			a.labelBuffer = append(a.labelBuffer, ',')
+		}
+		a.labelBuffer = appendLabel(a.labelBuffer, tag, tags[tag])
+	}
+	if labels, ok := a.labels[string(a.labelBuffer)]; ok {
+		return labels
+	}
+	labels := string(a.labelBuffer)
+	a.labels[labels] = labels
+	return labels
+}
+
+// appendLabel appends name=value to buffer, escaping both.
+func appendLabel(buffer []byte, name, value string) []byte {
+	buffer = appendEscaped(buffer, name)
+	buffer = append(buffer, '=')
+	return appendEscaped(buffer, value)
+}
+
+func appendEscaped(buffer []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\', ',', '=':
+			buffer = append(buffer, '\\')
+		}
+		buffer = append(buffer, s[i])
+	}
+	return buffer
+}
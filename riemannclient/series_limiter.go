@@ -0,0 +1,127 @@
+package riemannclient
+
+import (
+	"sort"
+)
+
+const (
+	OverflowCollapse = "collapse"
+	OverflowDrop     = "drop"
+
+	overflowName         = "__overflow__"
+	topOffenderOrigins   = 5
+	sampleNamesPerOrigin = 3
+)
+
+// SeriesLimit caps the number of distinct series buffered between flushes.
+// A zero cap means no limit. Points for new series past a cap are dropped or,
+// with OverflowCollapse, counted in an __overflow__ series instead.
+type SeriesLimit struct {
+	MaxSeries          uint32
+	MaxSeriesPerOrigin uint32
+	Overflow           string
+}
+
+// overflowOrigin is an origin that had points refused by the series limit
+// during the current flush window.
+type overflowOrigin struct {
+	origin      string
+	points      uint64
+	sampleNames []string
+}
+
+type seriesLimiter struct {
+	limit            SeriesLimit
+	series           uint32
+	seriesByOrigin   map[string]uint32
+	overflowByOrigin map[string]*overflowOrigin
+	totalOverflowed  uint64
+}
+
+func newSeriesLimiter(limit SeriesLimit) *seriesLimiter {
+	return &seriesLimiter{
+		limit:            limit,
+		seriesByOrigin:   make(map[string]uint32),
+		overflowByOrigin: make(map[string]*overflowOrigin),
+	}
+}
+
+// admit counts a new series from origin against the limits. When the series
+// is refused it returns the origin of the overflow series to collapse it
+// into: its own for the per-origin cap, none for the single shared one of
+// the global cap, so overflow series stay bounded either way.
+func (l *seriesLimiter) admit(origin string) (bool, string) {
+	if l.limit.MaxSeriesPerOrigin > 0 && l.seriesByOrigin[origin] >= l.limit.MaxSeriesPerOrigin {
+		return false, origin
+	}
+	if l.limit.MaxSeries > 0 && l.series >= l.limit.MaxSeries {
+		return false, ""
+	}
+
+	l.series++
+	l.seriesByOrigin[origin]++
+	return true, ""
+}
+
+// overflowed records a refused point of the series name from origin.
+func (l *seriesLimiter) overflowed(origin string, name string) {
+	l.totalOverflowed++
+
+	offender, ok := l.overflowByOrigin[origin]
+	if !ok {
+		offender = &overflowOrigin{origin: origin}
+		l.overflowByOrigin[origin] = offender
+	}
+	offender.points++
+	if len(offender.sampleNames) < sampleNamesPerOrigin {
+		offender.sampleNames = append(offender.sampleNames, origin+"."+name)
+	}
+}
+
+// topOffenders returns the origins with the most refused points in the
+// current window, worst first.
+func (l *seriesLimiter) topOffenders() []overflowOrigin {
+	offenders := make([]overflowOrigin, 0, len(l.overflowByOrigin))
+	for _, offender := range l.overflowByOrigin {
+		offenders = append(offenders, *offender)
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].points != offenders[j].points {
+			return offenders[i].points > offenders[j].points
+		}
+		return offenders[i].origin < offenders[j].origin
+	})
+	if len(offenders) > topOffenderOrigins {
+		offenders = offenders[:topOffenderOrigins]
+	}
+	return offenders
+}
+
+// merge adds the points other refused to those l refused.
+func (l *seriesLimiter) merge(other *seriesLimiter) {
+	l.totalOverflowed += other.totalOverflowed
+	for origin, refused := range other.overflowByOrigin {
+		offender, ok := l.overflowByOrigin[origin]
+		if !ok {
+			offender = &overflowOrigin{origin: origin}
+			l.overflowByOrigin[origin] = offender
+		}
+		offender.points += refused.points
+		for _, name := range refused.sampleNames {
+			if len(offender.sampleNames) < sampleNamesPerOrigin {
+				offender.sampleNames = append(offender.sampleNames, name)
+			}
+		}
+	}
+}
+
+// reset starts a new flush window, clearing the counts in place.
+func (l *seriesLimiter) reset() {
+	l.series = 0
+	for origin := range l.seriesByOrigin {
+		delete(l.seriesByOrigin, origin)
+	}
+	for origin := range l.overflowByOrigin {
+		delete(l.overflowByOrigin, origin)
+	}
+}
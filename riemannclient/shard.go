@@ -0,0 +1,120 @@
+package riemannclient
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// The parameters of the 32-bit FNV-1a hash.
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// Shard aggregates envelopes for a share of the series, apart from the
+// client, so that several shards can be filled in parallel without locks.
+// Every envelope of a series must go to the same shard, which ShardFor
+// ensures. A shard is not safe for concurrent use.
+type Shard struct {
+	aggregator
+}
+
+// NewShards returns count shards with the client's rollups, clock skew bound
+// and tag filter. The series limits are divided between them, so with series spread
+// unevenly a flush can refuse a series somewhat before the limit is reached.
+func (c *Client) NewShards(count int) []*Shard {
+	limit := c.limiter.limit
+	limit.MaxSeries = divideLimit(limit.MaxSeries, count)
+	limit.MaxSeriesPerOrigin = divideLimit(limit.MaxSeriesPerOrigin, count)
+
+	shards := make([]*Shard, count)
+	for i := range shards {
+		shards[i] = &Shard{aggregator: newAggregator(c.deployment, limit, c.rollups)}
+		shards[i].clockSkew = c.clockSkew
+		shards[i].tagFilter = c.tagFilter
+	}
+	return shards
+}
+
+// divideLimit shares a limit between count shards, rounding up so that no
+// shard is left without series. Zero, no limit, stays zero.
+func divideLimit(limit uint32, count int) uint32 {
+	if limit == 0 {
+		return 0
+	}
+	return (limit + uint32(count) - 1) / uint32(count)
+}
+
+// ShardFor returns which of count shards the series of envelope belongs to.
+// It hashes the fields that name the series rather than building its key,
+// which is left to the shard, and does so without allocating.
+func ShardFor(envelope *events.Envelope, count int) int {
+	if count <= 1 {
+		return 0
+	}
+
+	hash := uint32(fnvOffset32)
+	for _, field := range [...]string{
+		envelope.GetOrigin(),
+		envelope.GetValueMetric().GetName(),
+		envelope.GetCounterEvent().GetName(),
+		envelope.GetDeployment(),
+		envelope.GetJob(),
+		envelope.GetIndex(),
+		envelope.GetIp(),
+		envelope.GetTags()[FoundationAttribute],
+	} {
+		for i := 0; i < len(field); i++ {
+			hash ^= uint32(field[i])
+			hash *= fnvPrime32
+		}
+		// Hash a zero byte between fields, so that "ab", "c" and "a", "bc"
+		// differ.
+		hash *= fnvPrime32
+	}
+	return int(hash % uint32(count))
+}
+
+// Reset empties the shard for the next flush window once the client has
+// merged it, clearing its series in place like the client's own.
+func (s *Shard) Reset() {
+	s.reset()
+	s.totalMessagesReceived = 0
+	for source := range s.messagesReceived {
+		delete(s.messagesReceived, source)
+	}
+	for eventType := range s.messagesDropped {
+		delete(s.messagesDropped, eventType)
+	}
+	for action := range s.skewedTimestamps {
+		delete(s.skewedTimestamps, action)
+	}
+	s.limiter.totalOverflowed = 0
+}
+
+// Merge adds what shard aggregated to the client, to be sent with the next
+// flush. The shard must not be used until it has been merged and Reset.
+func (c *Client) Merge(shard *Shard) {
+	for key, s := range shard.metricPoints {
+		if s.count == 0 {
+			continue
+		}
+		merged, exists := c.metricPoints[key]
+		if !exists {
+			merged = c.newSeries(key, s.attributes)
+			merged.overflow = s.overflow
+		}
+		merged.merge(s)
+	}
+
+	c.totalMessagesReceived += shard.totalMessagesReceived
+	for source, count := range shard.messagesReceived {
+		c.messagesReceived[source] += count
+	}
+	for eventType, count := range shard.messagesDropped {
+		c.messagesDropped[eventType] += count
+	}
+	for action, count := range shard.skewedTimestamps {
+		c.skewedTimestamps[action] += count
+	}
+	c.limiter.merge(shard.limiter)
+}
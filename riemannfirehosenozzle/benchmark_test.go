@@ -0,0 +1,105 @@
+package riemannfirehosenozzle_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzleconfig"
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	"github.com/18F/riemann-firehose-nozzle/riemannfirehosenozzle"
+	. "github.com/18F/riemann-firehose-nozzle/testhelpers"
+	"github.com/cloudfoundry/sonde-go/events"
+	pb "github.com/gogo/protobuf/proto"
+)
+
+const (
+	benchmarkEnvelopes = 10000
+	benchmarkSeries    = 1000
+)
+
+func BenchmarkAggregationWorkers(b *testing.B) {
+	for _, workers := range []uint32{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkNozzle(b, workers)
+		})
+	}
+}
+
+// benchmarkNozzle runs b.N envelopes through a nozzle with the given number
+// of aggregation workers and reports how many it handled per second. Every
+// series is rolled up into a single count so that the final flush stays
+// small.
+func benchmarkNozzle(b *testing.B, workers uint32) {
+	fakeRiemann := NewFakeRiemann("tcp")
+	fakeRiemann.Start()
+	defer fakeRiemann.Close()
+
+	config := &nozzleconfig.NozzleConfig{
+		FlushDurationSeconds: 3600,
+		RiemannHost:          fakeRiemann.Host(),
+		RiemannPort:          fakeRiemann.Port(),
+		RiemannTransport:     "tcp",
+		MetricPrefix:         "riemann.nozzle.",
+		IngestQueueSize:      10000,
+		AggregationWorkers:   workers,
+		Rollups:              []riemannclient.RollupRule{{Match: "*", Aggregations: []string{"count"}}},
+	}
+	logger := nozzlelogger.New(ioutil.Discard, nozzlelogger.Error, nozzlelogger.FormatJSON)
+	nozzle := riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, &FakeTokenFetcher{}, logger)
+	nozzle.SetEnvelopeSource(&cyclingSource{envelopes: benchmarkEnvelopeSet(), count: b.N})
+
+	b.ResetTimer()
+	start := time.Now()
+	if err := nozzle.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "envelopes/s")
+}
+
+func benchmarkEnvelopeSet() []*events.Envelope {
+	envelopes := make([]*events.Envelope, benchmarkEnvelopes)
+	for i := range envelopes {
+		series := i % benchmarkSeries
+		envelopes[i] = &events.Envelope{
+			Origin:      pb.String(fmt.Sprintf("origin-%d", series%10)),
+			Timestamp:   pb.Int64(time.Now().UnixNano()),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{Name: pb.String(fmt.Sprintf("metric-%d", series)), Value: pb.Float64(float64(i)), Unit: pb.String("gauge")},
+			Deployment:  pb.String("cf"),
+			Job:         pb.String("diego-cell"),
+			Index:       pb.String(fmt.Sprintf("%d", series%4)),
+			Ip:          pb.String("10.0.0.1"),
+			Tags:        map[string]string{"source_id": "benchmark"},
+		}
+	}
+	return envelopes
+}
+
+// cyclingSource streams count envelopes, cycling through envelopes, and then
+// ends with io.EOF.
+type cyclingSource struct {
+	envelopes []*events.Envelope
+	count     int
+}
+
+func (s *cyclingSource) Stream(onConnect func()) (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error)
+	go func() {
+		onConnect()
+		for i := 0; i < s.count; i++ {
+			messages <- s.envelopes[i%len(s.envelopes)]
+		}
+		close(messages)
+		errs <- io.EOF
+	}()
+	return messages, errs
+}
+
+func (s *cyclingSource) Close() error {
+	return nil
+}
@@ -0,0 +1,34 @@
+package riemannfirehosenozzle
+
+import (
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// EnvelopeSource delivers the envelopes the nozzle forwards. Stream calls
+// onConnect each time the source (re)connects. The first error received
+// ends the stream; io.EOF means the source ran out of envelopes.
+type EnvelopeSource interface {
+	Stream(onConnect func()) (<-chan *events.Envelope, <-chan error)
+	Close() error
+}
+
+// EnvelopeRecorder receives a copy of every envelope the nozzle reads.
+type EnvelopeRecorder interface {
+	Write(envelope *events.Envelope) error
+}
+
+type firehoseSource struct {
+	consumer       *consumer.Consumer
+	subscriptionID string
+	authToken      string
+}
+
+func (s *firehoseSource) Stream(onConnect func()) (<-chan *events.Envelope, <-chan error) {
+	s.consumer.SetOnConnectCallback(onConnect)
+	return s.consumer.Firehose(s.subscriptionID, s.authToken)
+}
+
+func (s *firehoseSource) Close() error {
+	return s.consumer.Close()
+}
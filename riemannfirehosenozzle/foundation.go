@@ -0,0 +1,155 @@
+package riemannfirehosenozzle
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzleconfig"
+	"github.com/18F/riemann-firehose-nozzle/nozzlehealth"
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	initialReconnectBackoff = time.Second
+	maxReconnectBackoff     = time.Minute
+)
+
+// errStreamClosed is reported when a foundation's firehose closes without
+// saying why, so that the foundation still reconnects.
+var errStreamClosed = errors.New("firehose stream closed")
+
+// foundation is a Cloud Foundry foundation whose firehose the nozzle reads,
+// with the health components that track its connection and its UAA.
+type foundation struct {
+	config            nozzleconfig.FoundationConfig
+	tokenFetcher      AuthTokenFetcher
+	health            *nozzlehealth.Tracker
+	firehoseComponent string
+	uaaComponent      string
+}
+
+// foundationError is a firehose error from one of several foundations. The
+// foundation reconnects by itself; the main loop only reports it.
+type foundationError struct {
+	foundation *foundation
+	err        error
+}
+
+func (f *foundation) fields() nozzlelogger.Fields {
+	if f.config.Name == "" {
+		return nozzlelogger.Fields{}
+	}
+	return nozzlelogger.Fields{riemannclient.FoundationAttribute: f.config.Name}
+}
+
+// RefreshAuthToken lets the noaa consumer fetch a new token when the
+// firehose rejects an expired one.
+func (f *foundation) RefreshAuthToken() (string, error) {
+	return f.fetchAuthToken()
+}
+
+func (f *foundation) fetchAuthToken() (string, error) {
+	if f.config.DisableAccessControl {
+		return "", nil
+	}
+	authToken, err := f.tokenFetcher.FetchAuthToken()
+	if err != nil {
+		f.health.Failed(f.uaaComponent, err)
+		return "", err
+	}
+	f.health.Succeeded(f.uaaComponent)
+	return authToken, nil
+}
+
+// consume reads the foundation's firehose into messages until done is
+// closed, reconnecting with a backoff after every error so that one
+// foundation going away does not affect the others.
+func (d *RiemannFirehoseNozzle) consume(f *foundation, messages chan<- *events.Envelope, errs chan<- foundationError, done <-chan struct{}) {
+	backoff := initialReconnectBackoff
+	for {
+		received, err := d.consumeOnce(f, messages, done)
+		if err == nil {
+			return
+		}
+		if received {
+			backoff = initialReconnectBackoff
+		}
+
+		select {
+		case errs <- foundationError{foundation: f, err: err}:
+		case <-done:
+			return
+		}
+
+		fields := f.fields()
+		fields["backoff"] = backoff.String()
+		d.logger.Info("Reconnecting to the firehose", fields)
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// consumeOnce streams the firehose until it fails, returning the error and
+// whether any envelope arrived, or until done is closed, returning nil.
+func (d *RiemannFirehoseNozzle) consumeOnce(f *foundation, messages chan<- *events.Envelope, done <-chan struct{}) (bool, error) {
+	authToken, err := f.fetchAuthToken()
+	if err != nil {
+		return false, fmt.Errorf("fetching UAA token: %s", err)
+	}
+
+	source := d.firehoseSource(f, authToken)
+	defer source.Close()
+	envelopes, errs := source.Stream(func() {
+		f.health.Succeeded(f.firehoseComponent)
+	})
+
+	received := false
+	for {
+		select {
+		case envelope, ok := <-envelopes:
+			if !ok {
+				// Wait for the error that explains why.
+				envelopes = nil
+				continue
+			}
+			received = true
+			select {
+			case messages <- f.tag(envelope):
+			case <-done:
+				return received, nil
+			}
+		case err, ok := <-errs:
+			if !ok || err == nil {
+				err = errStreamClosed
+			}
+			f.health.Failed(f.firehoseComponent, err)
+			return received, err
+		case <-done:
+			return received, nil
+		}
+	}
+}
+
+// tag returns a copy of envelope with the foundation attribute added,
+// leaving the envelope and the tags the source handed over untouched.
+func (f *foundation) tag(envelope *events.Envelope) *events.Envelope {
+	tags := make(map[string]string, len(envelope.Tags)+1)
+	for key, value := range envelope.Tags {
+		tags[key] = value
+	}
+	tags[riemannclient.FoundationAttribute] = f.config.Name
+
+	tagged := *envelope
+	tagged.Tags = tags
+	return &tagged
+}
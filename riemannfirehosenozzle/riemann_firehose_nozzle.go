@@ -2,11 +2,21 @@ package riemannfirehosenozzle
 
 import (
 	"crypto/tls"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/18F/riemann-firehose-nozzle/nozzleconfig"
+	"github.com/18F/riemann-firehose-nozzle/nozzlehealth"
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/nozzlepush"
+	"github.com/18F/riemann-firehose-nozzle/nozzletap"
 	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	"github.com/18F/riemann-firehose-nozzle/rlpgateway"
+	"github.com/18F/riemann-firehose-nozzle/rotatingfile"
 	"github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gorilla/websocket"
@@ -14,57 +24,303 @@ import (
 )
 
 type RiemannFirehoseNozzle struct {
-	config           *nozzleconfig.NozzleConfig
-	errs             <-chan error
-	messages         <-chan *events.Envelope
-	authTokenFetcher AuthTokenFetcher
-	consumer         *consumer.Consumer
-	client           *riemannclient.Client
+	config            *nozzleconfig.NozzleConfig
+	queue             chan *events.Envelope
+	maxQueueDepth     int
+	workers           []chan<- workItem
+	errs              chan sourceError
+	foundationErrs    chan foundationError
+	defaultFoundation *foundation
+	foundations       []*foundation
+	source            EnvelopeSource
+	openFirehose      FirehoseOpener
+	extraSources      []namedSource
+	sourceErrs        chan sourceError
+	slowConsumer      *slowConsumer
+	recorder          EnvelopeRecorder
+	tap               *nozzletap.Tap
+	pushed            <-chan []riemannclient.CustomMetric
+	canaryResults     chan []canaryResult
+	debugSinkFile     *rotatingfile.File
+	client            *riemannclient.Client
+	batches           chan *riemannclient.Batch
+	senderDone        chan struct{}
+	logger            *nozzlelogger.Logger
+	health            *nozzlehealth.Tracker
+}
+
+// namedSource is a source read alongside the firehose, tracked in the health
+// report as name.
+type namedSource struct {
+	name   string
+	source EnvelopeSource
+}
+
+type sourceError struct {
+	name string
+	err  error
+}
+
+type canaryResult struct {
+	endpoint string
+	latency  time.Duration
+	err      error
 }
 
 type AuthTokenFetcher interface {
-	FetchAuthToken() string
+	FetchAuthToken() (string, error)
 }
 
-func NewRiemannFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher) *RiemannFirehoseNozzle {
+func NewRiemannFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher, logger *nozzlelogger.Logger) *RiemannFirehoseNozzle {
+	// The main loop and Riemann are expected to make progress every flush;
+	// allow ReadyFlushIntervals of them before reporting a problem.
+	readyFlushIntervals := config.ReadyFlushIntervals
+	if readyFlushIntervals == 0 {
+		readyFlushIntervals = nozzleconfig.Default().ReadyFlushIntervals
+	}
+	window := time.Duration(readyFlushIntervals*config.FlushDurationSeconds) * time.Second
+
+	health := nozzlehealth.New(window)
+	health.Register(nozzlehealth.Firehose, 0)
+	health.Register(nozzlehealth.Riemann, window)
+	if !config.DisableAccessControl {
+		health.Register(nozzlehealth.UAA, 0)
+	}
+	if config.CanaryIntervalSeconds > 0 && !config.DryRun {
+		health.Register(nozzlehealth.Canary, 0)
+	}
+
 	return &RiemannFirehoseNozzle{
-		config:           config,
-		authTokenFetcher: tokenFetcher,
+		config: config,
+		defaultFoundation: &foundation{
+			config:            config.FoundationConfigs()[0],
+			tokenFetcher:      tokenFetcher,
+			health:            health,
+			firehoseComponent: nozzlehealth.Firehose,
+			uaaComponent:      nozzlehealth.UAA,
+		},
+		logger: logger,
+		health: health,
+	}
+}
+
+// AddFoundation makes the nozzle read the firehose of another foundation,
+// using tokenFetcher for its UAA, in place of the one described by the
+// top-level settings. Each foundation is consumed and reconnected on its
+// own, and its envelopes are tagged with its name. It must be called before
+// Start.
+func (d *RiemannFirehoseNozzle) AddFoundation(config nozzleconfig.FoundationConfig, tokenFetcher AuthTokenFetcher) {
+	if len(d.foundations) == 0 {
+		d.health.Unregister(nozzlehealth.Firehose)
+		d.health.Unregister(nozzlehealth.UAA)
+	}
+
+	f := &foundation{
+		config:            config,
+		tokenFetcher:      tokenFetcher,
+		health:            d.health,
+		firehoseComponent: nozzlehealth.Firehose + "." + config.Name,
+		uaaComponent:      nozzlehealth.UAA + "." + config.Name,
+	}
+	d.health.Register(f.firehoseComponent, 0)
+	if !config.DisableAccessControl {
+		d.health.Register(f.uaaComponent, 0)
 	}
+	d.foundations = append(d.foundations, f)
+}
+
+// SetPushReceiver sends the custom metrics pushed to receiver along with
+// everything else. It must be called before Start.
+func (d *RiemannFirehoseNozzle) SetPushReceiver(receiver *nozzlepush.Receiver) {
+	d.pushed = receiver.Metrics()
+}
+
+// AddSource reads source alongside the firehose, reporting on it in
+// readiness as the component name. Unlike the firehose, a source that fails
+// ends Start whether or not foundations were added. It must be called
+// before Start.
+func (d *RiemannFirehoseNozzle) AddSource(name string, source EnvelopeSource) {
+	d.health.Register(name, 0)
+	d.extraSources = append(d.extraSources, namedSource{name: name, source: source})
+}
+
+// Health returns the tracker behind the nozzle's /health and /ready
+// endpoints.
+func (d *RiemannFirehoseNozzle) Health() *nozzlehealth.Tracker {
+	return d.health
+}
+
+// SetEnvelopeSource replaces the firehose with another source of envelopes,
+// such as a recorded file. It must be called before Start.
+func (d *RiemannFirehoseNozzle) SetEnvelopeSource(source EnvelopeSource) {
+	d.source = source
+}
+
+// FirehoseOpener opens the firehose of the foundation described by config,
+// authenticating with authToken.
+type FirehoseOpener func(config nozzleconfig.FoundationConfig, authToken string) EnvelopeSource
+
+// SetFirehoseOpener replaces how the nozzle connects to the firehose of each
+// foundation, such as with a stand-in for tests. It must be called before
+// Start.
+func (d *RiemannFirehoseNozzle) SetFirehoseOpener(open FirehoseOpener) {
+	d.openFirehose = open
+}
+
+// SetEnvelopeRecorder tees every envelope read to recorder. It must be
+// called before Start.
+func (d *RiemannFirehoseNozzle) SetEnvelopeRecorder(recorder EnvelopeRecorder) {
+	d.recorder = recorder
 }
 
+// SetTap publishes every envelope read, and every batch sent, to tap. It
+// must be called before Start.
+func (d *RiemannFirehoseNozzle) SetTap(tap *nozzletap.Tap) {
+	d.tap = tap
+}
+
+// Start forwards envelopes until the source fails, returning its error, or
+// runs out of envelopes, returning nil. With foundations added it reconnects
+// to each of them after an error instead and only returns if the Riemann
+// client cannot be created or a source added with AddSource fails.
 func (d *RiemannFirehoseNozzle) Start() error {
-	var authToken string
+	if d.source == nil && len(d.foundations) == 0 {
+		authToken, err := d.defaultFoundation.fetchAuthToken()
+		if err != nil {
+			d.logger.Error("Error getting oauth token. Please check your username and password.", err)
+			return err
+		}
+		d.source = d.firehoseSource(d.defaultFoundation, authToken)
+	}
 
-	if !d.config.DisableAccessControl {
-		authToken = d.authTokenFetcher.FetchAuthToken()
+	d.logger.Info("Starting Riemann Firehose Nozzle...")
+	err := d.createClient()
+	if err != nil {
+		d.logger.Error("Error creating Riemann client", err)
+		return err
+	}
+	if d.debugSinkFile != nil {
+		defer d.debugSinkFile.Close()
+	}
+	d.startSender()
+	defer d.stopSender()
+	if d.config.CanaryIntervalSeconds > 0 && !d.config.DryRun {
+		done := make(chan struct{})
+		defer close(done)
+		d.canaryResults = make(chan []canaryResult)
+		go d.runCanary(done)
 	}
 
-	log.Print("Starting Riemann Firehose Nozzle...")
-	d.createClient()
-	d.consumeFirehose(authToken)
-	err := d.postToRiemann()
-	log.Print("Riemann Firehose Nozzle shutting down...")
+	d.slowConsumer = &slowConsumer{hold: time.Duration(d.config.SlowConsumerHoldSeconds) * time.Second}
+	d.queue = make(chan *events.Envelope, d.config.IngestQueueSize)
+	done := make(chan struct{})
+	defer close(done)
+	d.startWorkers(done)
+	if d.source != nil {
+		d.errs = make(chan sourceError)
+		go d.forward(namedSource{name: nozzlehealth.Firehose, source: d.source}, d.errs, done)
+	} else {
+		d.foundationErrs = make(chan foundationError)
+		for _, f := range d.foundations {
+			go d.consume(f, d.queue, d.foundationErrs, done)
+		}
+	}
+	if len(d.extraSources) > 0 {
+		d.sourceErrs = make(chan sourceError)
+		for _, source := range d.extraSources {
+			defer source.source.Close()
+			go d.forward(source, d.sourceErrs, done)
+		}
+	}
+	err = d.postToRiemann()
+	d.logger.Info("Riemann Firehose Nozzle shutting down...")
+	if err == io.EOF {
+		return nil
+	}
 	return err
 }
 
-func (d *RiemannFirehoseNozzle) createClient() {
+func (d *RiemannFirehoseNozzle) createClient() error {
 	ipAddress, err := localip.LocalIP()
 	if err != nil {
 		panic(err)
 	}
 
-	d.client = riemannclient.New(d.config.RiemannHost, d.config.RiemannPort, d.config.RiemannTransport,
-		d.config.MetricPrefix, d.config.Deployment, ipAddress)
+	retryPolicy := riemannclient.RetryPolicy{
+		MaxRetries:     d.config.RiemannMaxRetries,
+		InitialBackoff: time.Duration(d.config.RiemannRetryBackoffMs) * time.Millisecond,
+		MaxBackoff:     time.Duration(d.config.RiemannMaxBackoffMs) * time.Millisecond,
+	}
+
+	seriesLimit := riemannclient.SeriesLimit{
+		MaxSeries:          d.config.MaxSeries,
+		MaxSeriesPerOrigin: d.config.MaxSeriesPerOrigin,
+		Overflow:           d.config.SeriesOverflow,
+	}
+
+	d.client = riemannclient.New(d.config.RiemannAddresses(), d.config.RiemannBalancing, d.config.RiemannTransport,
+		d.config.MetricPrefix, d.config.Deployment, ipAddress, d.config.InstanceIndex, retryPolicy, seriesLimit, d.config.Rollups, d.logger)
+	d.client.SetDryRun(d.config.DryRun)
+	d.client.SetClockSkew(riemannclient.ClockSkew{
+		MaxSkew: time.Duration(d.config.MaxClockSkewSeconds) * time.Second,
+		Action:  d.config.ClockSkewAction,
+	})
+	d.client.SetTagFilter(riemannclient.TagFilter{Allow: d.config.AllowedTags, Deny: d.config.DeniedTags})
+	d.client.SetStaticAttributes(d.config.StaticAttributes)
+	if d.tap != nil {
+		d.client.SetEventTap(d.tap)
+	}
+
+	switch {
+	case d.config.DebugSinkOnStdout():
+		d.client.SetDebugSink(riemannclient.NewDebugSink(os.Stdout))
+	case d.config.DebugSinkPath != "":
+		d.debugSinkFile, err = rotatingfile.Open(d.config.DebugSinkPath, int64(d.config.DebugSinkMaxMB)<<20, int(d.config.DebugSinkMaxFiles))
+		if err != nil {
+			return err
+		}
+		d.client.SetDebugSink(riemannclient.NewDebugSink(d.debugSinkFile))
+	}
+	return nil
 }
 
-func (d *RiemannFirehoseNozzle) consumeFirehose(authToken string) {
-	d.consumer = consumer.New(
-		d.config.TrafficControllerURL,
-		&tls.Config{InsecureSkipVerify: d.config.InsecureSSLSkipVerify},
+// firehoseSource returns the source of the foundation's envelopes: the RLP
+// gateway if it has one, otherwise the V1 firehose.
+func (d *RiemannFirehoseNozzle) firehoseSource(f *foundation, authToken string) EnvelopeSource {
+	if d.openFirehose != nil {
+		return d.openFirehose(f.config, authToken)
+	}
+
+	tlsConfig, err := d.config.TLSConfig()
+	if err != nil {
+		d.logger.Error("Ignoring CACert", err)
+		tlsConfig = &tls.Config{InsecureSkipVerify: d.config.InsecureSSLSkipVerify}
+	}
+	idleTimeout := time.Duration(d.config.IdleTimeoutSeconds) * time.Second
+
+	if f.config.RLPGatewayURL != "" {
+		var refresher rlpgateway.TokenRefresher
+		if !f.config.DisableAccessControl {
+			refresher = f
+		}
+		source := rlpgateway.New(f.config.RLPGatewayURL, f.config.FirehoseSubscriptionID, tlsConfig, authToken, refresher)
+		source.SetIdleTimeout(idleTimeout)
+		return source
+	}
+
+	firehoseConsumer := consumer.New(
+		f.config.TrafficControllerURL,
+		tlsConfig,
 		nil)
-	d.consumer.SetIdleTimeout(time.Duration(d.config.IdleTimeoutSeconds) * time.Second)
-	d.messages, d.errs = d.consumer.Firehose(d.config.FirehoseSubscriptionID, authToken)
+	firehoseConsumer.SetIdleTimeout(idleTimeout)
+	if !f.config.DisableAccessControl {
+		firehoseConsumer.RefreshTokenFrom(f)
+	}
+	return &firehoseSource{
+		consumer:       firehoseConsumer,
+		subscriptionID: f.config.FirehoseSubscriptionID,
+		authToken:      authToken,
+	}
 }
 
 func (d *RiemannFirehoseNozzle) postToRiemann() error {
@@ -72,51 +328,252 @@ func (d *RiemannFirehoseNozzle) postToRiemann() error {
 	for {
 		select {
 		case <-ticker.C:
+			d.health.Heartbeat()
 			d.postMetrics()
-		case envelope := <-d.messages:
-			d.handleMessage(envelope)
-			d.client.AddMetric(envelope)
-		case err := <-d.errs:
-			d.handleError(err)
-			return err
+			d.checkSlowConsumerRecovery()
+		case envelope := <-d.queue:
+			d.receive(envelope)
+		case metrics := <-d.pushed:
+			for _, metric := range metrics {
+				d.client.AddCustomMetric(metric)
+			}
+		case results := <-d.canaryResults:
+			for _, result := range results {
+				d.client.RecordCanary(result.endpoint, result.latency, result.err)
+			}
+		case foundationErr := <-d.foundationErrs:
+			d.logFirehoseError(foundationErr.err, foundationErr.foundation.fields())
+		case sourceErr := <-d.errs:
+			d.drainQueue()
+			d.handleError(sourceErr.err)
+			return sourceErr.err
+		case sourceErr := <-d.sourceErrs:
+			d.drainQueue()
+			d.health.Failed(sourceErr.name, sourceErr.err)
+			d.logger.Error("Error reading envelopes", sourceErr.err, nozzlelogger.Fields{"source": sourceErr.name})
+			d.postMetrics()
+			return sourceErr.err
 		}
 	}
 }
 
-func (d *RiemannFirehoseNozzle) postMetrics() {
-	err := d.client.PostMetrics()
-	if err != nil {
-		log.Println("FATAL ERROR: " + err.Error())
-		// os.Exit(1)
+func (d *RiemannFirehoseNozzle) receive(envelope *events.Envelope) {
+	d.checkQueueDepth()
+	d.recordMessage(envelope)
+	if d.tap != nil && envelope != nil {
+		d.tap.PublishEnvelope(envelope)
+	}
+	d.handleMessage(envelope)
+	d.aggregate(envelope)
+}
+
+// drainQueue handles the envelopes already queued, so that those read
+// before a source failed are not lost.
+func (d *RiemannFirehoseNozzle) drainQueue() {
+	for {
+		select {
+		case envelope := <-d.queue:
+			d.receive(envelope)
+		default:
+			return
+		}
+	}
+}
+
+// forward passes what a source streams to the ingest queue, and the error
+// that ends it to errs once everything before it is queued, until done is
+// closed.
+func (d *RiemannFirehoseNozzle) forward(source namedSource, errs chan<- sourceError, done <-chan struct{}) {
+	messages, sourceErrs := source.source.Stream(func() {
+		d.health.Succeeded(source.name)
+	})
+	for {
+		select {
+		case envelope, ok := <-messages:
+			if !ok {
+				// Wait for the error that explains why.
+				messages = nil
+				continue
+			}
+			select {
+			case d.queue <- envelope:
+			case <-done:
+				return
+			}
+		case err, ok := <-sourceErrs:
+			if !ok {
+				sourceErrs = nil
+				continue
+			}
+			select {
+			case errs <- sourceError{name: source.name, err: err}:
+			case <-done:
+			}
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// runCanary checks that every Riemann server indexes what it accepts once
+// every CanaryIntervalSeconds until done is closed. Results go to the health
+// tracker straight away and to the main loop for the next flush. Batches can
+// still be delivered while any server passes, so only a check in which every
+// server fails makes the nozzle unready; a server that fails alone is logged
+// and reported in its canarySuccess.
+func (d *RiemannFirehoseNozzle) runCanary(done <-chan struct{}) {
+	interval := time.Duration(d.config.CanaryIntervalSeconds) * time.Second
+	var canaries []*riemannclient.Canary
+	for _, address := range d.config.RiemannAddresses() {
+		canaries = append(canaries, riemannclient.NewCanary(address, d.config.MetricPrefix+"canary",
+			2*interval, time.Duration(d.config.CanaryTimeoutSeconds)*time.Second))
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		results := checkCanaries(canaries)
+		var failures []string
+		for _, result := range results {
+			if result.err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", result.endpoint, result.err))
+				d.logger.Warn("Riemann canary check failed", nozzlelogger.Fields{"sink": "riemann", "endpoint": result.endpoint, "error": result.err.Error()})
+				continue
+			}
+			d.logger.Debug("Riemann canary check succeeded", nozzlelogger.Fields{"sink": "riemann", "endpoint": result.endpoint, "latency": result.latency.String()})
+		}
+		if len(failures) == len(results) {
+			err := errors.New(strings.Join(failures, "; "))
+			d.logger.Error("Riemann canary check failed on every endpoint", err, nozzlelogger.Fields{"sink": "riemann"})
+			d.health.Failed(nozzlehealth.Canary, err)
+		} else {
+			d.health.Succeeded(nozzlehealth.Canary)
+		}
+
+		select {
+		case d.canaryResults <- results:
+		case <-done:
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkCanaries checks every server in turn.
+func checkCanaries(canaries []*riemannclient.Canary) []canaryResult {
+	results := make([]canaryResult, len(canaries))
+	for i, canary := range canaries {
+		latency, err := canary.Check()
+		results[i] = canaryResult{endpoint: canary.Address(), latency: latency, err: err}
 	}
+	return results
+}
+
+func (d *RiemannFirehoseNozzle) postMetrics() {
+	d.mergeShards()
+	d.client.SetIngestQueueDepth(d.maxQueueDepth)
+	d.maxQueueDepth = len(d.queue)
+	d.sendBatch(d.client.NextBatch())
 }
 
 func (d *RiemannFirehoseNozzle) handleError(err error) {
+	if err == io.EOF {
+		d.logger.Info("Envelope source has no more envelopes")
+		d.source.Close()
+		d.postMetrics()
+		return
+	}
+
+	d.health.Failed(nozzlehealth.Firehose, err)
+	d.logFirehoseError(err, nozzlelogger.Fields{})
+
+	d.logger.Info("Closing connection with traffic controller", nozzlelogger.Fields{"reason": err.Error()})
+	d.source.Close()
+	d.postMetrics()
+}
+
+// logFirehoseError reports why the firehose connection ended and raises the
+// slow consumer alert if the traffic controller dropped the nozzle for not
+// keeping up.
+func (d *RiemannFirehoseNozzle) logFirehoseError(err error, fields nozzlelogger.Fields) {
 	switch closeErr := err.(type) {
 	case *websocket.CloseError:
 		switch closeErr.Code {
 		case websocket.CloseNormalClosure:
 		// no op
 		case websocket.ClosePolicyViolation:
-			log.Printf("Error while reading from the firehose: %v", err)
-			log.Printf("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.")
-			d.client.AlertSlowConsumerError()
+			d.logger.Error("Error while reading from the firehose", err, fields)
+			d.logger.Error("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.", nil, fields)
+			d.alertSlowConsumer(signalPolicyViolation)
 		default:
-			log.Printf("Error while reading from the firehose: %v", err)
+			d.logger.Error("Error while reading from the firehose", err, fields)
 		}
 	default:
-		log.Printf("Error while reading from the firehose: %v", err)
+		d.logger.Error("Error while reading from the firehose", err, fields)
 
 	}
+}
 
-	log.Printf("Closing connection with traffic controller due to %v", err)
-	d.consumer.Close()
-	d.postMetrics()
+func (d *RiemannFirehoseNozzle) recordMessage(envelope *events.Envelope) {
+	if d.recorder == nil || envelope == nil {
+		return
+	}
+	err := d.recorder.Write(envelope)
+	if err != nil {
+		d.logger.Error("Error recording envelope", err)
+	}
 }
 
 func (d *RiemannFirehoseNozzle) handleMessage(envelope *events.Envelope) {
 	if envelope.GetEventType() == events.Envelope_CounterEvent && envelope.CounterEvent.GetName() == "TruncatingBuffer.DroppedMessages" && envelope.GetOrigin() == "doppler" {
-		log.Printf("We've intercepted an upstream message which indicates that the nozzle or the TrafficController is not keeping up. Please try scaling up the nozzle.")
-		d.client.AlertSlowConsumerError()
+		d.logger.Warn("We've intercepted an upstream message which indicates that the nozzle or the TrafficController is not keeping up. Please try scaling up the nozzle.")
+		d.alertSlowConsumer(signalTruncatingBuffer)
+	}
+}
+
+// checkQueueDepth notes how many envelopes are waiting to be handled and
+// raises the slow consumer alert when there are SlowConsumerQueueDepth or
+// more.
+func (d *RiemannFirehoseNozzle) checkQueueDepth() {
+	depth := len(d.queue)
+	if depth > d.maxQueueDepth {
+		d.maxQueueDepth = depth
+	}
+	if d.config.SlowConsumerQueueDepth > 0 && depth >= int(d.config.SlowConsumerQueueDepth) {
+		d.alertSlowConsumer(signalIngestQueue)
+	}
+}
+
+// alertSlowConsumer records a sign that the nozzle is not keeping up and
+// reports it as critical from the next flush on.
+func (d *RiemannFirehoseNozzle) alertSlowConsumer(signal string) {
+	if d.slowConsumer.signal(signal, time.Now()) {
+		d.logger.Warn("Nozzle is not keeping up", nozzlelogger.Fields{"signal": signal})
+	}
+	d.client.SetSlowConsumerStatus(riemannclient.SlowConsumerStatus{
+		Slow:        true,
+		Description: fmt.Sprintf("Behind since %s: %s", d.slowConsumer.since.UTC().Format(time.RFC3339), d.slowConsumer.describe()),
+	})
+}
+
+// checkSlowConsumerRecovery reports a recovery with the next flush once
+// SlowConsumerHoldSeconds have passed without a sign that the nozzle is not
+// keeping up. It runs after a flush so that every slow spell is reported as
+// critical at least once.
+func (d *RiemannFirehoseNozzle) checkSlowConsumerRecovery() {
+	duration, recovered := d.slowConsumer.recover(time.Now())
+	if !recovered {
+		return
 	}
+	description := fmt.Sprintf("Caught up after %s behind: %s", duration.Round(time.Second), d.slowConsumer.describe())
+	d.logger.Info("Nozzle is keeping up again", nozzlelogger.Fields{"duration": duration.String(), "signals": d.slowConsumer.describe()})
+	d.client.SetSlowConsumerStatus(riemannclient.SlowConsumerStatus{
+		Description: description,
+		Duration:    duration,
+	})
 }
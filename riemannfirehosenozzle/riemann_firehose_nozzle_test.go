@@ -1,43 +1,56 @@
 package riemannfirehosenozzle_test
 
 import (
-	. "github.com/18F/influxdb-firehose-nozzle/testhelpers"
+	. "github.com/18F/riemann-firehose-nozzle/testhelpers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/18F/riemann-firehose-nozzle/envelopefile"
+	"github.com/18F/riemann-firehose-nozzle/nozzleconfig"
+	"github.com/18F/riemann-firehose-nozzle/nozzlehealth"
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/nozzlepush"
+	"github.com/18F/riemann-firehose-nozzle/riemannfirehosenozzle"
+	"github.com/18F/riemann-firehose-nozzle/sysloglistener"
+	"github.com/18F/riemann-firehose-nozzle/uaatokenfetcher"
+	"github.com/amir/raidman/proto"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/18F/influxdb-firehose-nozzle/influxdbclient"
-	"github.com/18F/influxdb-firehose-nozzle/influxdbfirehosenozzle"
-	"github.com/18F/influxdb-firehose-nozzle/nozzleconfig"
-	"github.com/18F/influxdb-firehose-nozzle/uaatokenfetcher"
-	"github.com/gogo/protobuf/proto"
+	pb "github.com/gogo/protobuf/proto"
 	"github.com/gorilla/websocket"
 	"github.com/onsi/gomega/gbytes"
 )
 
-var _ = Describe("Datadog Firehose Nozzle", func() {
+var _ = Describe("Riemann Firehose Nozzle", func() {
 	var fakeUAA *FakeUAA
 	var fakeFirehose *FakeFirehose
-	var influxDbAPI *FakeInfluxDbAPI
+	var fakeRiemann *FakeRiemann
 	var config *nozzleconfig.NozzleConfig
-	var nozzle *influxdbfirehosenozzle.InfluxDbFirehoseNozzle
+	var nozzle *riemannfirehosenozzle.RiemannFirehoseNozzle
 	var logOutput *gbytes.Buffer
+	var logger *nozzlelogger.Logger
 
 	BeforeEach(func() {
 		fakeUAA = NewFakeUAA("bearer", "123456789")
 		fakeToken := fakeUAA.AuthToken()
 		fakeFirehose = NewFakeFirehose(fakeToken)
-		influxDbAPI = NewFakeInfluxDbAPI()
+		fakeRiemann = NewFakeRiemann("tcp")
 
 		fakeUAA.Start()
 		fakeFirehose.Start()
-		influxDbAPI.Start()
+		fakeRiemann.Start()
 
 		tokenFetcher := &uaatokenfetcher.UAATokenFetcher{
 			UaaUrl: fakeUAA.URL(),
@@ -46,21 +59,23 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 		config = &nozzleconfig.NozzleConfig{
 			UAAURL:               fakeUAA.URL(),
 			FlushDurationSeconds: 10,
-			InfluxDbUrl:          influxDbAPI.URL(),
+			RiemannHost:          fakeRiemann.Host(),
+			RiemannPort:          fakeRiemann.Port(),
+			RiemannTransport:     "tcp",
 			TrafficControllerURL: strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
 			DisableAccessControl: false,
-			MetricPrefix:         "datadog.nozzle.",
+			MetricPrefix:         "riemann.nozzle.",
 		}
 
 		logOutput = gbytes.NewBuffer()
-		log.SetOutput(logOutput)
-		nozzle = influxdbfirehosenozzle.NewInfluxDbFirehoseNozzle(config, tokenFetcher)
+		logger = nozzlelogger.New(logOutput, nozzlelogger.Debug, nozzlelogger.FormatJSON)
+		nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, tokenFetcher, logger)
 	})
 
 	AfterEach(func() {
 		fakeUAA.Close()
 		fakeFirehose.Close()
-		influxDbAPI.Close()
+		fakeRiemann.Close()
 	})
 
 	It("receives data from the firehose", func(done Done) {
@@ -68,34 +83,34 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 
 		for i := 0; i < 10; i++ {
 			envelope := events.Envelope{
-				Origin:    proto.String("origin"),
-				Timestamp: proto.Int64(1000000000),
+				Origin:    pb.String("origin"),
+				Timestamp: pb.Int64(1000000000),
 				EventType: events.Envelope_ValueMetric.Enum(),
 				ValueMetric: &events.ValueMetric{
-					Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
-					Value: proto.Float64(float64(i)),
-					Unit:  proto.String("gauge"),
+					Name:  pb.String(fmt.Sprintf("metricName-%d", i)),
+					Value: pb.Float64(float64(i)),
+					Unit:  pb.String("gauge"),
 				},
-				Deployment: proto.String("deployment-name"),
-				Job:        proto.String("doppler"),
+				Deployment: pb.String("deployment-name"),
+				Job:        pb.String("doppler"),
 			}
 			fakeFirehose.AddEvent(envelope)
 		}
 
 		go nozzle.Start()
 
-		var contents []byte
-		Eventually(influxDbAPI.ReceivedContents).Should(Receive(&contents))
-
-		var payload influxdbclient.Payload
-		err := json.Unmarshal(contents, &payload)
-		Expect(err).ToNot(HaveOccurred())
+		Eventually(fakeRiemann.Events).ShouldNot(BeEmpty())
 
 		Expect(logOutput).ToNot(gbytes.Say("Error while reading from the firehose"))
 
-		// +3 internal metrics that show totalMessagesReceived, totalMetricSent, and slowConsumerAlert
-		Expect(payload.Series).To(HaveLen(13))
-
+		var firehoseEvents []*proto.Event
+		for _, event := range fakeRiemann.Events() {
+			if strings.HasPrefix(event.GetService(), "riemann.nozzle.origin.") {
+				firehoseEvents = append(firehoseEvents, event)
+			}
+		}
+		Expect(firehoseEvents).To(HaveLen(10))
+		Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.totalMessagesReceived")).NotTo(BeNil())
 	}, 2)
 
 	It("sends a server disconnected metric when the server disconnects abnormally", func(done Done) {
@@ -103,16 +118,16 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 
 		for i := 0; i < 10; i++ {
 			envelope := events.Envelope{
-				Origin:    proto.String("origin"),
-				Timestamp: proto.Int64(1000000000),
+				Origin:    pb.String("origin"),
+				Timestamp: pb.Int64(1000000000),
 				EventType: events.Envelope_ValueMetric.Enum(),
 				ValueMetric: &events.ValueMetric{
-					Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
-					Value: proto.Float64(float64(i)),
-					Unit:  proto.String("gauge"),
+					Name:  pb.String(fmt.Sprintf("metricName-%d", i)),
+					Value: pb.Float64(float64(i)),
+					Unit:  pb.String("gauge"),
 				},
-				Deployment: proto.String("deployment-name"),
-				Job:        proto.String("doppler"),
+				Deployment: pb.String("deployment-name"),
+				Job:        pb.String("doppler"),
 			}
 			fakeFirehose.AddEvent(envelope)
 		}
@@ -121,21 +136,19 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 
 		go nozzle.Start()
 
-		var contents []byte
-		Eventually(influxDbAPI.ReceivedContents).Should(Receive(&contents))
-
-		var payload datadogclient.Payload
-		err := json.Unmarshal(contents, &payload)
-		Expect(err).ToNot(HaveOccurred())
+		Eventually(fakeRiemann.Events).ShouldNot(BeEmpty())
 
-		slowConsumerMetric := findSlowConsumerMetric(payload)
+		slowConsumerMetric := findSlowConsumerMetric(fakeRiemann.Events())
 		Expect(slowConsumerMetric).NotTo(BeNil())
-		Expect(slowConsumerMetric.Points).To(HaveLen(1))
-		Expect(slowConsumerMetric.Points[0].Value).To(BeEquivalentTo(1))
+		Expect(slowConsumerMetric.GetMetricD()).To(BeEquivalentTo(1))
 
 		Expect(logOutput).To(gbytes.Say("Error while reading from the firehose"))
 		Expect(logOutput).To(gbytes.Say("Client did not respond to ping before keep-alive timeout expired."))
 		Expect(logOutput).To(gbytes.Say("Disconnected because nozzle couldn't keep up."))
+
+		firehose := nozzle.Health().Readiness().Components[nozzlehealth.Firehose]
+		Expect(firehose.Healthy).To(BeFalse())
+		Expect(firehose.LastError).To(ContainSubstring("Client did not respond to ping"))
 	}, 2)
 
 	It("does not report slow consumer error when closed for other reasons", func(done Done) {
@@ -145,16 +158,11 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 
 		go nozzle.Start()
 
-		var contents []byte
-		Eventually(influxDbAPI.ReceivedContents).Should(Receive(&contents))
+		Eventually(fakeRiemann.Events).ShouldNot(BeEmpty())
 
-		var payload datadogclient.Payload
-		err := json.Unmarshal(contents, &payload)
-		Expect(err).ToNot(HaveOccurred())
-
-		errMetric := findSlowConsumerMetric(payload)
+		errMetric := findSlowConsumerMetric(fakeRiemann.Events())
 		Expect(errMetric).NotTo(BeNil())
-		Expect(errMetric.Points[0].Value).To(BeEquivalentTo(0))
+		Expect(errMetric.GetMetricD()).To(BeEquivalentTo(0))
 
 		Expect(logOutput).To(gbytes.Say("Error while reading from the firehose"))
 		Expect(logOutput).NotTo(gbytes.Say("Client did not respond to ping before keep-alive timeout expired."))
@@ -170,34 +178,107 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 	Context("receives a truncatingbuffer.droppedmessage value metric,", func() {
 		It("sets a slow-consumer error", func() {
 			slowConsumerError := events.Envelope{
-				Origin:    proto.String("doppler"),
-				Timestamp: proto.Int64(1000000000),
+				Origin:    pb.String("doppler"),
+				Timestamp: pb.Int64(1000000000),
 				EventType: events.Envelope_CounterEvent.Enum(),
 				CounterEvent: &events.CounterEvent{
-					Name:  proto.String("TruncatingBuffer.DroppedMessages"),
-					Delta: proto.Uint64(1),
-					Total: proto.Uint64(1),
+					Name:  pb.String("TruncatingBuffer.DroppedMessages"),
+					Delta: pb.Uint64(1),
+					Total: pb.Uint64(1),
 				},
-				Deployment: proto.String("deployment-name"),
-				Job:        proto.String("doppler"),
+				Deployment: pb.String("deployment-name"),
+				Job:        pb.String("doppler"),
 			}
 			fakeFirehose.AddEvent(slowConsumerError)
 
 			go nozzle.Start()
 
-			var contents []byte
-			Eventually(influxDbAPI.ReceivedContents).Should(Receive(&contents))
-
-			var payload datadogclient.Payload
-			err := json.Unmarshal(contents, &payload)
-			Expect(err).ToNot(HaveOccurred())
+			Eventually(fakeRiemann.Events).ShouldNot(BeEmpty())
 
-			Expect(findSlowConsumerMetric(payload)).NotTo(BeNil())
+			Expect(findSlowConsumerMetric(fakeRiemann.Events())).NotTo(BeNil())
 
 			Expect(logOutput).To(gbytes.Say("We've intercepted an upstream message which indicates that the nozzle or the TrafficController is not keeping up. Please try scaling up the nozzle."))
 		})
 	})
 
+	Context("when the nozzle falls behind", func() {
+		It("stays critical for the hold period and then reports the recovery", func() {
+			config.FlushDurationSeconds = 1
+			config.SlowConsumerHoldSeconds = 1
+			nozzle.SetEnvelopeSource(newQueuedSource(false, &events.Envelope{
+				Origin:       pb.String("doppler"),
+				Timestamp:    pb.Int64(1000000000),
+				EventType:    events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{Name: pb.String("TruncatingBuffer.DroppedMessages"), Delta: pb.Uint64(1), Total: pb.Uint64(1)},
+			}))
+
+			go nozzle.Start()
+
+			Eventually(func() *proto.Event {
+				return findSlowConsumerMetricInState(fakeRiemann.Events(), "ok")
+			}, 5).ShouldNot(BeNil())
+			critical := findSlowConsumerMetricInState(fakeRiemann.Events(), "critical")
+			Expect(critical).NotTo(BeNil())
+			Expect(critical.GetMetricD()).To(BeEquivalentTo(1))
+			Expect(critical.GetDescription()).To(HaveSuffix("truncating_buffer=1"))
+
+			recovery := findSlowConsumerMetricInState(fakeRiemann.Events(), "ok")
+			Expect(recovery.GetMetricD()).To(BeEquivalentTo(0))
+			Expect(recovery.GetDescription()).To(MatchRegexp(`^Caught up after \d+s behind: truncating_buffer=1$`))
+			Expect(attributeValue(recovery, "duration_seconds")).NotTo(BeEmpty())
+			Expect(logOutput).To(gbytes.Say("Nozzle is not keeping up"))
+			Expect(logOutput).To(gbytes.Say("Nozzle is keeping up again"))
+		})
+
+		It("raises the alert when envelopes pile up in the ingest queue", func() {
+			config.IngestQueueSize = 100
+			config.SlowConsumerQueueDepth = 1
+			var envelopes []*events.Envelope
+			for i := 0; i < 100; i++ {
+				envelopes = append(envelopes, &events.Envelope{
+					Origin:      pb.String("origin"),
+					Timestamp:   pb.Int64(1000000000),
+					EventType:   events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{Name: pb.String("queued"), Value: pb.Float64(float64(i))},
+				})
+			}
+			nozzle.SetEnvelopeSource(newQueuedSource(true, envelopes...))
+
+			Expect(nozzle.Start()).To(Succeed())
+
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.totalMessagesReceived").GetMetricD()).To(Equal(100.0))
+			alert := findSlowConsumerMetric(fakeRiemann.Events())
+			Expect(alert.GetState()).To(Equal("critical"))
+			Expect(alert.GetDescription()).To(ContainSubstring("ingest_queue="))
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.ingestQueueDepth").GetMetricD()).To(BeNumerically(">=", 1))
+		})
+	})
+
+	Context("with several aggregation workers", func() {
+		It("sends every envelope that the workers aggregated", func() {
+			config.IngestQueueSize = 100
+			config.AggregationWorkers = 4
+			var envelopes []*events.Envelope
+			for i := 0; i < 40; i++ {
+				envelopes = append(envelopes, &events.Envelope{
+					Origin:      pb.String("origin"),
+					Timestamp:   pb.Int64(1000000000),
+					EventType:   events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{Name: pb.String(fmt.Sprintf("metricName-%d", i%10)), Value: pb.Float64(float64(i))},
+				})
+			}
+			nozzle.SetEnvelopeSource(newQueuedSource(true, envelopes...))
+
+			Expect(nozzle.Start()).To(Succeed())
+
+			received := fakeRiemann.Events()
+			for i := 0; i < 10; i++ {
+				Expect(countEvents(received, fmt.Sprintf("riemann.nozzle.origin.metricName-%d", i))).To(Equal(4))
+			}
+			Expect(findEvent(received, "riemann.nozzle.totalMessagesReceived").GetMetricD()).To(Equal(40.0))
+		})
+	})
+
 	Context("when the DisableAccessControl is set to true", func() {
 		var tokenFetcher *FakeTokenFetcher
 
@@ -205,27 +286,21 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			fakeUAA = NewFakeUAA("", "")
 			fakeToken := fakeUAA.AuthToken()
 			fakeFirehose = NewFakeFirehose(fakeToken)
-			influxDbAPI = NewFakeInfluxDbAPI()
 			tokenFetcher = &FakeTokenFetcher{}
 
 			fakeUAA.Start()
 			fakeFirehose.Start()
-			influxDbAPI.Start()
 
 			config = &nozzleconfig.NozzleConfig{
 				FlushDurationSeconds: 1,
-				DataDogURL:           influxDbAPI.URL(),
+				RiemannHost:          fakeRiemann.Host(),
+				RiemannPort:          fakeRiemann.Port(),
+				RiemannTransport:     "tcp",
 				TrafficControllerURL: strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
 				DisableAccessControl: true,
 			}
 
-			nozzle = datadogfirehosenozzle.NewDatadogFirehoseNozzle(config, tokenFetcher)
-		})
-
-		AfterEach(func() {
-			fakeUAA.Close()
-			fakeFirehose.Close()
-			influxDbAPI.Close()
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, tokenFetcher, logger)
 		})
 
 		It("can still tries to connect to the firehose", func() {
@@ -239,12 +314,400 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			Consistently(fakeFirehose.LastAuthorization).Should(Equal(""))
 		})
 
+		It("reports the firehose connection and successful flushes as ready", func() {
+			go nozzle.Start()
+
+			Eventually(func() bool {
+				return nozzle.Health().Readiness().Components[nozzlehealth.Riemann].LastSuccessAt != nil
+			}, 3).Should(BeTrue())
+
+			report := nozzle.Health().Readiness()
+			Expect(report.Components[nozzlehealth.Firehose].LastSuccessAt).NotTo(BeNil())
+			Expect(report.Components).NotTo(HaveKey(nozzlehealth.UAA))
+			Expect(nozzle.Health().Liveness().Healthy()).To(BeTrue())
+		})
+
+		It("reports the Riemann canary as ready once its event is indexed", func() {
+			config.CanaryIntervalSeconds = 1
+			config.CanaryTimeoutSeconds = 1
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, tokenFetcher, logger)
+			go nozzle.Start()
+
+			Eventually(func() bool {
+				return nozzle.Health().Readiness().Components[nozzlehealth.Canary].LastSuccessAt != nil
+			}, 3).Should(BeTrue())
+			Expect(findEvent(fakeRiemann.Events(), "canary").GetTags()).To(ConsistOf(HavePrefix("canary-")))
+		})
+
+		It("reports the Riemann canary as not ready when events are not indexed", func() {
+			fakeRiemann.StopIndexing()
+			config.CanaryIntervalSeconds = 1
+			config.CanaryTimeoutSeconds = 1
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, tokenFetcher, logger)
+			go nozzle.Start()
+
+			Eventually(func() string {
+				return nozzle.Health().Readiness().Components[nozzlehealth.Canary].LastError
+			}, 3).Should(ContainSubstring("not indexed"))
+			Expect(nozzle.Health().Readiness().Healthy()).To(BeFalse())
+		})
+
+		It("stays ready while the canary passes on another Riemann endpoint", func() {
+			unindexed := NewFakeRiemann("tcp")
+			unindexed.Start()
+			defer unindexed.Close()
+			unindexed.StopIndexing()
+			config.RiemannEndpoints = []string{unindexed.Address(), fakeRiemann.Address()}
+			config.CanaryIntervalSeconds = 1
+			config.CanaryTimeoutSeconds = 1
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, tokenFetcher, logger)
+			go nozzle.Start()
+
+			Eventually(logOutput, 3).Should(gbytes.Say("Riemann canary check failed"))
+			Eventually(func() bool {
+				return nozzle.Health().Readiness().Components[nozzlehealth.Canary].LastSuccessAt != nil
+			}, 3).Should(BeTrue())
+			Expect(nozzle.Health().Readiness().Components[nozzlehealth.Canary].Healthy).To(BeTrue())
+		})
+
 		It("does not rquire the presence of config.UAAURL", func() {
 			nozzle.Start()
 			Consistently(func() int { return tokenFetcher.NumCalls }).Should(Equal(0))
 		})
 	})
 
+	Context("with an RLP gateway", func() {
+		var fakeGateway *FakeRLPGateway
+
+		BeforeEach(func() {
+			fakeGateway = NewFakeRLPGateway(fakeUAA.AuthToken())
+			fakeGateway.Start()
+			fakeGateway.AddEnvelopes(
+				`{"timestamp": "1000000000", "source_id": "gorouter", "tags": {"deployment": "cf", "job": "router"},
+					"gauge": {"metrics": {"latency": {"unit": "ms", "value": 12}}}}`,
+				`{"timestamp": "1000000000", "source_id": "gorouter", "tags": {"deployment": "cf", "job": "router"},
+					"counter": {"name": "requests", "delta": "2", "total": "40"}}`,
+			)
+
+			config.RLPGatewayURL = fakeGateway.URL()
+			config.FirehoseSubscriptionID = "riemann-nozzle"
+			config.FlushDurationSeconds = 1
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, &uaatokenfetcher.UAATokenFetcher{UaaUrl: fakeUAA.URL()}, logger)
+		})
+
+		AfterEach(func() {
+			fakeGateway.Close()
+		})
+
+		It("reads V2 envelopes in place of the firehose", func() {
+			go nozzle.Start()
+
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.gorouter.latency")
+			}, 3).ShouldNot(BeNil())
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.gorouter.requests")
+			}, 3).ShouldNot(BeNil())
+
+			Expect(fakeGateway.LastAuthorization()).To(Equal(fakeUAA.AuthToken()))
+			Expect(fakeGateway.LastQuery().Get("shard_id")).To(Equal("riemann-nozzle"))
+			Expect(fakeFirehose.Requested()).To(BeFalse())
+			Expect(nozzle.Health().Readiness().Components[nozzlehealth.Firehose].LastSuccessAt).NotTo(BeNil())
+		})
+	})
+
+	Context("with a push receiver", func() {
+		BeforeEach(func() {
+			fakeFirehose.AddEvent(events.Envelope{
+				Origin:      pb.String("origin"),
+				Timestamp:   pb.Int64(1000000000),
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{Name: pb.String("metricName"), Value: pb.Float64(1), Unit: pb.String("gauge")},
+			})
+			config.FlushDurationSeconds = 1
+		})
+
+		It("sends pushed custom metrics along with the firehose", func() {
+			receiver := nozzlepush.New("secret", 1024)
+			nozzle.SetPushReceiver(receiver)
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+			go nozzle.Start()
+
+			request, err := http.NewRequest("POST", server.URL, strings.NewReader(`[{"name": "duration", "origin": "backup", "type": "gauge", "value": 42}]`))
+			Expect(err).ToNot(HaveOccurred())
+			request.Header.Set("Authorization", "Bearer secret")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.backup.duration")
+			}, 3).ShouldNot(BeNil())
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.backup.duration").GetMetricD()).To(Equal(42.0))
+			Expect(findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.metricName")).NotTo(BeNil())
+		})
+	})
+
+	Context("with a syslog listener", func() {
+		var fakeGateway *FakeRLPGateway
+		var listener *sysloglistener.Listener
+
+		BeforeEach(func() {
+			fakeGateway = NewFakeRLPGateway(fakeUAA.AuthToken())
+			fakeGateway.Start()
+			fakeGateway.AddEnvelopes(`{"timestamp": "1000000000", "source_id": "gorouter", "gauge": {"metrics": {"latency": {"unit": "ms", "value": 12}}}}`)
+
+			config.RLPGatewayURL = fakeGateway.URL()
+			config.FlushDurationSeconds = 1
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, &uaatokenfetcher.UAATokenFetcher{UaaUrl: fakeUAA.URL()}, logger)
+			listener = sysloglistener.New("127.0.0.1:0", nil, logger)
+			nozzle.AddSource(nozzlehealth.Syslog, listener)
+		})
+
+		AfterEach(func() {
+			fakeGateway.Close()
+		})
+
+		It("forwards syslog metrics alongside the firehose", func() {
+			go nozzle.Start()
+
+			Eventually(listener.Addr).ShouldNot(BeNil())
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			fmt.Fprint(conn, "<14>1 2020-01-30T00:00:00Z host uaa - - [gauge@47450 name=\"tokens\" value=\"4\" unit=\"count\"]\n")
+
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.uaa.tokens")
+			}, 3).ShouldNot(BeNil())
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.gorouter.latency")
+			}, 3).ShouldNot(BeNil())
+			Expect(nozzle.Health().Readiness().Components[nozzlehealth.Syslog].LastSuccessAt).NotTo(BeNil())
+		})
+
+		It("stops when the listener fails", func() {
+			occupied, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer occupied.Close()
+			nozzle.AddSource("other-syslog", sysloglistener.New(occupied.Addr().String(), nil, logger))
+
+			errs := make(chan error, 1)
+			go func() { errs <- nozzle.Start() }()
+
+			var startErr error
+			Eventually(errs, 3).Should(Receive(&startErr))
+			Expect(startErr.Error()).To(ContainSubstring("Can not listen for syslog"))
+			Expect(nozzle.Health().Readiness().Components["other-syslog"].LastError).NotTo(BeEmpty())
+		})
+	})
+
+	Context("with several foundations", func() {
+		var westFirehose *FakeFirehose
+
+		valueMetric := func(name string) events.Envelope {
+			return events.Envelope{
+				Origin:    pb.String("origin"),
+				Timestamp: pb.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  pb.String(name),
+					Value: pb.Float64(5),
+					Unit:  pb.String("gauge"),
+				},
+				Deployment: pb.String("cf"),
+				Job:        pb.String("doppler"),
+			}
+		}
+
+		BeforeEach(func() {
+			westFirehose = NewFakeFirehose("")
+			westFirehose.Start()
+
+			fakeFirehose.AddEvent(valueMetric("eastMetric"))
+			westFirehose.AddEvent(valueMetric("westMetric"))
+
+			config.FlushDurationSeconds = 1
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, nil, logger)
+			nozzle.AddFoundation(nozzleconfig.FoundationConfig{
+				Name:                   "east",
+				UAAURL:                 fakeUAA.URL(),
+				TrafficControllerURL:   strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
+				FirehoseSubscriptionID: "east-subscription",
+			}, &uaatokenfetcher.UAATokenFetcher{UaaUrl: fakeUAA.URL()})
+			nozzle.AddFoundation(nozzleconfig.FoundationConfig{
+				Name:                 "west",
+				TrafficControllerURL: strings.Replace(westFirehose.URL(), "http:", "ws:", 1),
+				DisableAccessControl: true,
+			}, nil)
+		})
+
+		AfterEach(func() {
+			westFirehose.Close()
+		})
+
+		It("tags each foundation's metrics with its name", func() {
+			go nozzle.Start()
+
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.westMetric")
+			}, 3).ShouldNot(BeNil())
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.eastMetric")
+			}, 3).ShouldNot(BeNil())
+
+			Expect(attributeValue(findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.westMetric"), "foundation")).To(Equal("west"))
+			Expect(attributeValue(findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.eastMetric"), "foundation")).To(Equal("east"))
+			Expect(fakeFirehose.LastAuthorization()).To(Equal("bearer 123456789"))
+		})
+
+		It("tracks the health of each foundation", func() {
+			go nozzle.Start()
+
+			Eventually(func() bool {
+				report := nozzle.Health().Readiness()
+				return report.Components["firehose.east"].LastSuccessAt != nil && report.Components["firehose.west"].LastSuccessAt != nil
+			}, 3).Should(BeTrue())
+
+			report := nozzle.Health().Readiness()
+			Expect(report.Components).To(HaveKey("uaa.east"))
+			Expect(report.Components).NotTo(HaveKey("uaa.west"))
+			Expect(report.Components).NotTo(HaveKey(nozzlehealth.Firehose))
+			Expect(report.Components).NotTo(HaveKey(nozzlehealth.UAA))
+		})
+
+		It("keeps reading from the others and reconnects when one foundation goes away", func() {
+			westFirehose.Close()
+			go nozzle.Start()
+
+			Eventually(fakeFirehose.Connections, 5).Should(BeNumerically(">=", 2))
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.eastMetric")
+			}, 3).ShouldNot(BeNil())
+			Eventually(func() string {
+				return nozzle.Health().Readiness().Components["firehose.west"].LastError
+			}, 3).ShouldNot(BeEmpty())
+		})
+
+		It("reconnects when a foundation's firehose closes without an error, leaving its envelopes untouched", func() {
+			westMetric := valueMetric("westMetric")
+			westMetric.Tags = map[string]string{"source_id": "west-source"}
+			west := &closingSource{envelope: &westMetric}
+			nozzle.SetFirehoseOpener(func(config nozzleconfig.FoundationConfig, authToken string) riemannfirehosenozzle.EnvelopeSource {
+				if config.Name == "west" {
+					return west
+				}
+				eastMetric := valueMetric("eastMetric")
+				return newQueuedSource(false, &eastMetric)
+			})
+			go nozzle.Start()
+
+			Eventually(west.Streams, 5).Should(BeNumerically(">=", 2))
+			Expect(nozzle.Health().Readiness().Components["firehose.west"].LastError).To(Equal("firehose stream closed"))
+			Eventually(func() *proto.Event {
+				return findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.westMetric")
+			}, 3).ShouldNot(BeNil())
+			Expect(attributeValue(findEvent(fakeRiemann.Events(), "riemann.nozzle.origin.westMetric"), "foundation")).To(Equal("west"))
+			Expect(westMetric.Tags).To(Equal(map[string]string{"source_id": "west-source"}))
+		})
+	})
+
+	Context("with a recorded envelope file", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "riemannfirehosenozzle")
+			Expect(err).ToNot(HaveOccurred())
+
+			writer, err := envelopefile.NewWriter(filepath.Join(dir, "recorded"), 0, 0)
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				Expect(writer.Write(&events.Envelope{
+					Origin:    pb.String("origin"),
+					Timestamp: pb.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  pb.String(fmt.Sprintf("replayed-%d", i)),
+						Value: pb.Float64(float64(i)),
+						Unit:  pb.String("gauge"),
+					},
+				})).To(Succeed())
+			}
+			Expect(writer.Close()).To(Succeed())
+
+			nozzle.SetEnvelopeSource(envelopefile.NewReplaySource(filepath.Join(dir, "recorded"), false))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("forwards the replayed envelopes and stops at the end of the file", func() {
+			recorder, err := envelopefile.NewWriter(filepath.Join(dir, "re-recorded"), 0, 0)
+			Expect(err).ToNot(HaveOccurred())
+			nozzle.SetEnvelopeRecorder(recorder)
+
+			Expect(nozzle.Start()).To(Succeed())
+			Expect(recorder.Close()).To(Succeed())
+
+			for i := 0; i < 3; i++ {
+				Expect(findEvent(fakeRiemann.Events(), fmt.Sprintf("riemann.nozzle.origin.replayed-%d", i))).NotTo(BeNil())
+			}
+			Expect(fakeUAA.Requested()).To(BeFalse())
+			Expect(fakeFirehose.Requested()).To(BeFalse())
+
+			recorded, err := ioutil.ReadFile(filepath.Join(dir, "recorded"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.ReadFile(filepath.Join(dir, "re-recorded"))).To(Equal(recorded))
+		})
+
+		It("writes events to the debug sink instead of Riemann on a dry run", func() {
+			config.DryRun = true
+			config.DebugSinkPath = filepath.Join(dir, "events.jsonl")
+
+			Expect(nozzle.Start()).To(Succeed())
+
+			Expect(fakeRiemann.MessagesServed()).To(Equal(0))
+			written, err := ioutil.ReadFile(config.DebugSinkPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(written)).To(ContainSubstring(`"service":"riemann.nozzle.origin.replayed-2"`))
+		})
+	})
+
+	Context("when Riemann is down", func() {
+		It("keeps reading envelopes while a batch is retried", func() {
+			down := NewFakeRiemann("tcp")
+			down.Start()
+			down.Close()
+			config.RiemannPort = down.Port()
+			config.RiemannMaxRetries = 100
+			config.RiemannRetryBackoffMs = 1000
+			config.RiemannMaxBackoffMs = 1000
+			config.FlushDurationSeconds = 1
+			config.IngestQueueSize = 1
+			source := &queuedSource{envelopes: make(chan *events.Envelope)}
+			nozzle.SetEnvelopeSource(source)
+
+			go nozzle.Start()
+
+			Eventually(logOutput, 5).Should(gbytes.Say("retrying"))
+			// The retries of the first batch outlast the next flush, and every
+			// envelope is still taken straight away.
+			for i := 0; i < 20; i++ {
+				Eventually(source.envelopes, "200ms").Should(BeSent(&events.Envelope{
+					Origin:      pb.String("origin"),
+					Timestamp:   pb.Int64(1000000000),
+					EventType:   events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{Name: pb.String("metricName"), Value: pb.Float64(float64(i))},
+				}))
+				time.Sleep(100 * time.Millisecond)
+			}
+		})
+	})
+
 	Context("when idle timeout has expired", func() {
 		var fakeIdleFirehose *FakeIdleFirehose
 		BeforeEach(func() {
@@ -252,7 +715,9 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			fakeIdleFirehose.Start()
 
 			config = &nozzleconfig.NozzleConfig{
-				DataDogURL:           influxDbAPI.URL(),
+				RiemannHost:          fakeRiemann.Host(),
+				RiemannPort:          fakeRiemann.Port(),
+				RiemannTransport:     "tcp",
 				TrafficControllerURL: strings.Replace(fakeIdleFirehose.URL(), "http:", "ws:", 1),
 				DisableAccessControl: true,
 				IdleTimeoutSeconds:   1,
@@ -260,7 +725,7 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			}
 
 			tokenFetcher := &FakeTokenFetcher{}
-			nozzle = datadogfirehosenozzle.NewDatadogFirehoseNozzle(config, tokenFetcher)
+			nozzle = riemannfirehosenozzle.NewRiemannFirehoseNozzle(config, tokenFetcher, logger)
 		})
 		AfterEach(func() {
 			fakeIdleFirehose.Close()
@@ -274,11 +739,110 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 	})
 })
 
-func findSlowConsumerMetric(payload datadogclient.Payload) *datadogclient.Metric {
-	for _, metric := range payload.Series {
-		if metric.Metric == "datadog.nozzle.slowConsumerAlert" {
-			return &metric
+func findSlowConsumerMetric(events []*proto.Event) *proto.Event {
+	return findEvent(events, "riemann.nozzle.slowConsumerAlert")
+}
+
+// closingSource hands over its envelope and then closes both of its
+// channels without an error, as a firehose that goes away quietly does.
+type closingSource struct {
+	envelope *events.Envelope
+	lock     sync.Mutex
+	streams  int
+}
+
+func (s *closingSource) Stream(onConnect func()) (<-chan *events.Envelope, <-chan error) {
+	s.lock.Lock()
+	s.streams++
+	s.lock.Unlock()
+
+	envelopes := make(chan *events.Envelope)
+	errs := make(chan error)
+	go func() {
+		onConnect()
+		envelopes <- s.envelope
+		close(envelopes)
+		close(errs)
+	}()
+	return envelopes, errs
+}
+
+func (s *closingSource) Streams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams
+}
+
+func (s *closingSource) Close() error {
+	return nil
+}
+
+func findSlowConsumerMetricInState(events []*proto.Event, state string) *proto.Event {
+	for _, event := range events {
+		if event.GetService() == "riemann.nozzle.slowConsumerAlert" && event.GetState() == state {
+			return event
 		}
 	}
 	return nil
 }
+
+func attributeValue(event *proto.Event, key string) string {
+	for _, attribute := range event.GetAttributes() {
+		if attribute.GetKey() == key {
+			return attribute.GetValue()
+		}
+	}
+	return ""
+}
+
+func findEvent(events []*proto.Event, service string) *proto.Event {
+	for _, event := range events {
+		if event.GetService() == service {
+			return event
+		}
+	}
+	return nil
+}
+
+func countEvents(events []*proto.Event, service string) int {
+	count := 0
+	for _, event := range events {
+		if event.GetService() == service {
+			count++
+		}
+	}
+	return count
+}
+
+// queuedSource has all of its envelopes ready at once, so they arrive faster
+// than the nozzle can handle them. With eof it ends once they are read;
+// otherwise it stays open.
+type queuedSource struct {
+	envelopes chan *events.Envelope
+	eof       bool
+}
+
+func newQueuedSource(eof bool, envelopes ...*events.Envelope) *queuedSource {
+	queued := make(chan *events.Envelope, len(envelopes))
+	for _, envelope := range envelopes {
+		queued <- envelope
+	}
+	return &queuedSource{envelopes: queued, eof: eof}
+}
+
+func (s *queuedSource) Stream(onConnect func()) (<-chan *events.Envelope, <-chan error) {
+	errs := make(chan error)
+	if s.eof {
+		go func() {
+			for len(s.envelopes) > 0 {
+				runtime.Gosched()
+			}
+			errs <- io.EOF
+		}()
+	}
+	return s.envelopes, errs
+}
+
+func (s *queuedSource) Close() error {
+	return nil
+}
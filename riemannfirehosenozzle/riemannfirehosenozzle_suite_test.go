@@ -9,9 +9,9 @@ import (
 	"testing"
 )
 
-func TestDatadogfirehosenozzle(t *testing.T) {
+func TestRiemannfirehosenozzle(t *testing.T) {
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "DatadogFirehoseNozzle Suite")
+	RunSpecs(t, "RiemannFirehoseNozzle Suite")
 }
 
 var _ = BeforeSuite(func() {
@@ -0,0 +1,60 @@
+package riemannfirehosenozzle
+
+import (
+	"errors"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlehealth"
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+)
+
+// pendingBatches is how many flushed batches can wait while an earlier one
+// is being sent. Past that, a flush's batch is dropped: holding up the main
+// loop instead would leave envelopes unread until the firehose drops the
+// nozzle.
+const pendingBatches = 4
+
+var errSendBacklog = errors.New("batches are flushed faster than Riemann takes them")
+
+// startSender sends flushed batches to Riemann from a goroutine of its own,
+// so that envelopes are still read while a batch is retried.
+func (d *RiemannFirehoseNozzle) startSender() {
+	d.batches = make(chan *riemannclient.Batch, pendingBatches)
+	d.senderDone = make(chan struct{})
+	go d.runSender()
+}
+
+func (d *RiemannFirehoseNozzle) runSender() {
+	defer close(d.senderDone)
+	for batch := range d.batches {
+		err := d.client.Send(batch)
+		if err != nil {
+			d.logger.Error("Error posting metrics", err, nozzlelogger.Fields{"sink": "riemann"})
+			d.health.Failed(nozzlehealth.Riemann, err)
+			continue
+		}
+		d.health.Succeeded(nozzlehealth.Riemann)
+	}
+}
+
+// stopSender waits for the batches already flushed to be sent.
+func (d *RiemannFirehoseNozzle) stopSender() {
+	close(d.batches)
+	<-d.senderDone
+}
+
+// sendBatch hands the batch of a flush to the sender, or drops it if too
+// many are waiting already.
+func (d *RiemannFirehoseNozzle) sendBatch(batch *riemannclient.Batch) {
+	select {
+	case d.batches <- batch:
+	default:
+		d.client.DropBatch(batch)
+		d.logger.Error("Dropping batch, Riemann is not keeping up with flushes", errSendBacklog, nozzlelogger.Fields{
+			"sink":            "riemann",
+			"batch_size":      batch.Len(),
+			"pending_batches": pendingBatches,
+		})
+		d.health.Failed(nozzlehealth.Riemann, errSendBacklog)
+	}
+}
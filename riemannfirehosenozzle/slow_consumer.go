@@ -0,0 +1,73 @@
+package riemannfirehosenozzle
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The signals that the nozzle is not keeping up.
+const (
+	// Doppler dropped envelopes it could not send to the nozzle fast enough.
+	signalTruncatingBuffer = "truncating_buffer"
+	// The traffic controller closed the connection because the nozzle did
+	// not answer its pings in time.
+	signalPolicyViolation = "policy_violation"
+	// Envelopes are piling up in the nozzle's own ingest queue.
+	signalIngestQueue = "ingest_queue"
+)
+
+// slowConsumer tracks whether the nozzle is keeping up with what it is sent.
+// Any signal makes it slow, and it stays slow until hold has passed without
+// another, so that an alert does not flap between flushes.
+type slowConsumer struct {
+	hold       time.Duration
+	since      time.Time
+	lastSignal time.Time
+	signals    map[string]int
+}
+
+func (s *slowConsumer) slow() bool {
+	return !s.since.IsZero()
+}
+
+// signal records a sign of slowness and reports whether the nozzle was
+// keeping up until now.
+func (s *slowConsumer) signal(name string, now time.Time) bool {
+	started := !s.slow()
+	if started {
+		s.since = now
+		s.signals = make(map[string]int)
+	}
+	s.lastSignal = now
+	s.signals[name]++
+	return started
+}
+
+// recover ends a slow spell once hold has passed since its last signal,
+// returning how long it lasted.
+func (s *slowConsumer) recover(now time.Time) (time.Duration, bool) {
+	if !s.slow() || now.Sub(s.lastSignal) < s.hold {
+		return 0, false
+	}
+	duration := now.Sub(s.since)
+	s.since = time.Time{}
+	return duration, true
+}
+
+// describe lists how often each signal was seen during the current or most
+// recent slow spell, such as "policy_violation=1, truncating_buffer=3".
+func (s *slowConsumer) describe() string {
+	names := make([]string, 0, len(s.signals))
+	for name := range s.signals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%s=%d", name, s.signals[name])
+	}
+	return strings.Join(counts, ", ")
+}
@@ -0,0 +1,86 @@
+package riemannfirehosenozzle
+
+import (
+	"github.com/18F/riemann-firehose-nozzle/riemannclient"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// workerQueueSize is how many envelopes can wait for each aggregation worker
+// before the main loop blocks on it.
+const workerQueueSize = 1024
+
+// workItem is an envelope for a worker to aggregate or, with merge set, a
+// request to hand over its shard to be merged. The worker waits for merged to
+// be closed before it clears the shard and carries on.
+type workItem struct {
+	envelope *events.Envelope
+	merge    chan<- *riemannclient.Shard
+	merged   <-chan struct{}
+}
+
+// startWorkers starts AggregationWorkers goroutines that each aggregate the
+// envelopes of their share of the series into a shard of their own, so that
+// aggregation is spread over several cores without locking. With a single
+// worker the main loop aggregates instead. The workers stop when done is
+// closed.
+func (d *RiemannFirehoseNozzle) startWorkers(done <-chan struct{}) {
+	if d.config.AggregationWorkers <= 1 {
+		return
+	}
+
+	shards := d.client.NewShards(int(d.config.AggregationWorkers))
+	d.workers = make([]chan<- workItem, len(shards))
+	for i, shard := range shards {
+		items := make(chan workItem, workerQueueSize)
+		d.workers[i] = items
+		go runWorker(shard, items, done)
+	}
+}
+
+func runWorker(shard *riemannclient.Shard, items <-chan workItem, done <-chan struct{}) {
+	for {
+		select {
+		case item := <-items:
+			if item.merge != nil {
+				item.merge <- shard
+				<-item.merged
+				shard.Reset()
+				continue
+			}
+			shard.AddMetric(item.envelope)
+		case <-done:
+			return
+		}
+	}
+}
+
+// aggregate passes envelope to the worker that owns its series, or adds it
+// to the client when there are no workers.
+func (d *RiemannFirehoseNozzle) aggregate(envelope *events.Envelope) {
+	if d.workers == nil {
+		d.client.AddMetric(envelope)
+		return
+	}
+	d.workers[riemannclient.ShardFor(envelope, len(d.workers))] <- workItem{envelope: envelope}
+}
+
+// mergeShards adds what every worker aggregated to the client ahead of a
+// flush. Each worker handles the request after the envelopes already passed
+// to it, so none of those are left for the next flush, and then waits while
+// its shard is merged, so that the shard can be cleared in place rather
+// than replaced.
+func (d *RiemannFirehoseNozzle) mergeShards() {
+	if d.workers == nil {
+		return
+	}
+
+	shards := make(chan *riemannclient.Shard, len(d.workers))
+	merged := make(chan struct{})
+	for _, worker := range d.workers {
+		worker <- workItem{merge: shards, merged: merged}
+	}
+	for range d.workers {
+		d.client.Merge(<-shards)
+	}
+	close(merged)
+}
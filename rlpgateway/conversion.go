@@ -0,0 +1,273 @@
+package rlpgateway
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// batch is the body of each server-sent event from /v2/read, a Loggregator
+// V2 EnvelopeBatch in the protobuf JSON mapping.
+type batch struct {
+	Batch []envelope `json:"batch"`
+}
+
+type envelope struct {
+	Timestamp  jsonInt64         `json:"timestamp"`
+	SourceID   string            `json:"source_id"`
+	InstanceID string            `json:"instance_id"`
+	Tags       map[string]string `json:"tags"`
+
+	Log     *logMessage `json:"log"`
+	Counter *counter    `json:"counter"`
+	Gauge   *gauge      `json:"gauge"`
+	Timer   *timer      `json:"timer"`
+	Event   *event      `json:"event"`
+}
+
+type logMessage struct {
+	Payload []byte `json:"payload"`
+	Type    string `json:"type"`
+}
+
+type counter struct {
+	Name  string     `json:"name"`
+	Delta jsonUint64 `json:"delta"`
+	Total jsonUint64 `json:"total"`
+}
+
+type gauge struct {
+	Metrics map[string]gaugeValue `json:"metrics"`
+}
+
+type gaugeValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+type timer struct {
+	Name  string    `json:"name"`
+	Start jsonInt64 `json:"start"`
+	Stop  jsonInt64 `json:"stop"`
+}
+
+type event struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// jsonInt64 and jsonUint64 accept the 64 bit integers of the protobuf JSON
+// mapping, which are quoted, as well as bare numbers.
+type jsonInt64 int64
+
+func (i *jsonInt64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*i = jsonInt64(value)
+	return err
+}
+
+type jsonUint64 uint64
+
+func (i *jsonUint64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	*i = jsonUint64(value)
+	return err
+}
+
+// Tags that become fields of the V1 envelope rather than tags.
+var envelopeTags = map[string]bool{
+	"origin":     true,
+	"deployment": true,
+	"job":        true,
+	"index":      true,
+	"ip":         true,
+}
+
+// Gauges with all of these metrics are container metrics.
+var containerMetrics = []string{"cpu", "memory", "disk", "memory_quota", "disk_quota"}
+
+// parseBatch converts one server-sent event's data to V1 envelopes.
+func parseBatch(data []byte) ([]*events.Envelope, error) {
+	var b batch
+	err := json.Unmarshal(data, &b)
+	if err != nil {
+		return nil, err
+	}
+
+	var converted []*events.Envelope
+	for _, e := range b.Batch {
+		converted = append(converted, toV1(e)...)
+	}
+	return converted, nil
+}
+
+// toV1 converts a V2 envelope the way Loggregator does for the V1 firehose.
+// A gauge becomes one ValueMetric per metric, or a ContainerMetric if it
+// carries an application instance's usage, and a timer becomes an
+// HttpStartStop. Events have no V1 counterpart and become Errors. Envelopes
+// of no known type are skipped.
+func toV1(e envelope) []*events.Envelope {
+	switch {
+	case e.Gauge != nil && isContainerMetric(e.Gauge):
+		return []*events.Envelope{newEnvelope(e, events.Envelope_ContainerMetric, func(v1 *events.Envelope) {
+			instanceIndex, _ := strconv.Atoi(e.InstanceID)
+			v1.ContainerMetric = &events.ContainerMetric{
+				ApplicationId:    proto.String(e.SourceID),
+				InstanceIndex:    proto.Int32(int32(instanceIndex)),
+				CpuPercentage:    proto.Float64(e.Gauge.Metrics["cpu"].Value),
+				MemoryBytes:      proto.Uint64(uint64(e.Gauge.Metrics["memory"].Value)),
+				DiskBytes:        proto.Uint64(uint64(e.Gauge.Metrics["disk"].Value)),
+				MemoryBytesQuota: proto.Uint64(uint64(e.Gauge.Metrics["memory_quota"].Value)),
+				DiskBytesQuota:   proto.Uint64(uint64(e.Gauge.Metrics["disk_quota"].Value)),
+			}
+		})}
+	case e.Gauge != nil:
+		names := make([]string, 0, len(e.Gauge.Metrics))
+		for name := range e.Gauge.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		converted := make([]*events.Envelope, 0, len(names))
+		for _, name := range names {
+			metric := e.Gauge.Metrics[name]
+			converted = append(converted, newEnvelope(e, events.Envelope_ValueMetric, func(v1 *events.Envelope) {
+				v1.ValueMetric = &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(metric.Value),
+					Unit:  proto.String(metric.Unit),
+				}
+			}))
+		}
+		return converted
+	case e.Counter != nil:
+		return []*events.Envelope{newEnvelope(e, events.Envelope_CounterEvent, func(v1 *events.Envelope) {
+			v1.CounterEvent = &events.CounterEvent{
+				Name:  proto.String(e.Counter.Name),
+				Delta: proto.Uint64(uint64(e.Counter.Delta)),
+				Total: proto.Uint64(uint64(e.Counter.Total)),
+			}
+		})}
+	case e.Timer != nil:
+		return []*events.Envelope{newEnvelope(e, events.Envelope_HttpStartStop, func(v1 *events.Envelope) {
+			v1.HttpStartStop = httpStartStop(e)
+		})}
+	case e.Log != nil:
+		return []*events.Envelope{newEnvelope(e, events.Envelope_LogMessage, func(v1 *events.Envelope) {
+			messageType := events.LogMessage_OUT
+			if e.Log.Type == "ERR" {
+				messageType = events.LogMessage_ERR
+			}
+			v1.LogMessage = &events.LogMessage{
+				Message:        e.Log.Payload,
+				MessageType:    messageType.Enum(),
+				Timestamp:      proto.Int64(int64(e.Timestamp)),
+				AppId:          proto.String(e.SourceID),
+				SourceType:     proto.String(e.Tags["source_type"]),
+				SourceInstance: proto.String(e.InstanceID),
+			}
+		})}
+	case e.Event != nil:
+		return []*events.Envelope{newEnvelope(e, events.Envelope_Error, func(v1 *events.Envelope) {
+			v1.Error = &events.Error{
+				Source:  proto.String(e.SourceID),
+				Code:    proto.Int32(0),
+				Message: proto.String(e.Event.Title + ": " + e.Event.Body),
+			}
+		})}
+	default:
+		return nil
+	}
+}
+
+// newEnvelope returns a V1 envelope of eventType with the fields common to
+// every type filled from e, and lets set add the event itself.
+func newEnvelope(e envelope, eventType events.Envelope_EventType, set func(*events.Envelope)) *events.Envelope {
+	origin := e.Tags["origin"]
+	if origin == "" {
+		origin = e.SourceID
+	}
+
+	tags := map[string]string{"source_id": e.SourceID}
+	if e.InstanceID != "" {
+		tags["instance_id"] = e.InstanceID
+	}
+	for key, value := range e.Tags {
+		if !envelopeTags[key] {
+			tags[key] = value
+		}
+	}
+
+	v1 := &events.Envelope{
+		Origin:     proto.String(origin),
+		EventType:  eventType.Enum(),
+		Timestamp:  proto.Int64(int64(e.Timestamp)),
+		Deployment: proto.String(e.Tags["deployment"]),
+		Job:        proto.String(e.Tags["job"]),
+		Index:      proto.String(e.Tags["index"]),
+		Ip:         proto.String(e.Tags["ip"]),
+		Tags:       tags,
+	}
+	set(v1)
+	return v1
+}
+
+func isContainerMetric(g *gauge) bool {
+	for _, name := range containerMetrics {
+		if _, ok := g.Metrics[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// httpStartStop fills every field V1 requires, taking what it can from the
+// tags Loggregator puts on HTTP timers.
+func httpStartStop(e envelope) *events.HttpStartStop {
+	peerType := events.PeerType_Client
+	if value, ok := events.PeerType_value[e.Tags["peer_type"]]; ok {
+		peerType = events.PeerType(value)
+	}
+	method := events.Method_GET
+	if value, ok := events.Method_value[strings.ToUpper(e.Tags["method"])]; ok {
+		method = events.Method(value)
+	}
+	statusCode, _ := strconv.Atoi(e.Tags["status_code"])
+	contentLength, _ := strconv.ParseInt(e.Tags["content_length"], 10, 64)
+
+	startStop := &events.HttpStartStop{
+		StartTimestamp: proto.Int64(int64(e.Timer.Start)),
+		StopTimestamp:  proto.Int64(int64(e.Timer.Stop)),
+		RequestId:      parseUUID(e.Tags["request_id"]),
+		PeerType:       peerType.Enum(),
+		Method:         method.Enum(),
+		Uri:            proto.String(e.Tags["uri"]),
+		RemoteAddress:  proto.String(e.Tags["remote_address"]),
+		UserAgent:      proto.String(e.Tags["user_agent"]),
+		StatusCode:     proto.Int32(int32(statusCode)),
+		ContentLength:  proto.Int64(contentLength),
+	}
+	if e.SourceID != "" {
+		startStop.ApplicationId = parseUUID(e.SourceID)
+	}
+	return startStop
+}
+
+// parseUUID converts a UUID string to the V1 representation, or to a zero
+// UUID if it is not one.
+func parseUUID(value string) *events.UUID {
+	id, err := hex.DecodeString(strings.Replace(value, "-", "", -1))
+	if err != nil || len(id) != 16 {
+		return &events.UUID{Low: proto.Uint64(0), High: proto.Uint64(0)}
+	}
+	return &events.UUID{
+		Low:  proto.Uint64(binary.LittleEndian.Uint64(id[:8])),
+		High: proto.Uint64(binary.LittleEndian.Uint64(id[8:])),
+	}
+}
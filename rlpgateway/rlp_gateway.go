@@ -0,0 +1,248 @@
+// Package rlpgateway reads Loggregator V2 envelopes from the Reverse Log
+// Proxy gateway's /v2/read server-sent-events stream and converts them to
+// the V1 envelopes the rest of the nozzle handles.
+package rlpgateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	reconnectTimeout = 500 * time.Millisecond
+	maxRetries       = 5
+
+	// The gateway sends heartbeats well within this, so a stream that is
+	// silent for longer has gone away.
+	defaultIdleTimeout = time.Minute
+)
+
+// TokenRefresher fetches a new token when the gateway rejects the current
+// one.
+type TokenRefresher interface {
+	RefreshAuthToken() (string, error)
+}
+
+// Source streams every envelope type from one shard of the gateway. The
+// gateway ends streams now and then by design, so the source reconnects
+// whenever a stream ends and only reports an error once maxRetries
+// connections in a row have failed.
+type Source struct {
+	readURL     string
+	client      *http.Client
+	refresher   TokenRefresher
+	idleTimeout time.Duration
+
+	lock      sync.Mutex
+	authToken string
+	body      io.ReadCloser
+	closed    bool
+	done      chan struct{}
+}
+
+// New returns a source reading shard shardID from the gateway at gatewayURL.
+// authToken is sent as is in the Authorization header; refresher may be nil
+// when the gateway does not check it.
+func New(gatewayURL string, shardID string, tlsConfig *tls.Config, authToken string, refresher TokenRefresher) *Source {
+	query := url.Values{"shard_id": {shardID}}
+	for _, envelopeType := range []string{"counter", "gauge", "timer", "log", "event"} {
+		query.Set(envelopeType, "")
+	}
+
+	return &Source{
+		readURL:     strings.TrimSuffix(gatewayURL, "/") + "/v2/read?" + query.Encode(),
+		client:      &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}},
+		refresher:   refresher,
+		idleTimeout: defaultIdleTimeout,
+		authToken:   authToken,
+		done:        make(chan struct{}),
+	}
+}
+
+// SetIdleTimeout sets how long a stream may go without data, heartbeats
+// included, before the source drops it and reconnects. It must be called
+// before Stream.
+func (s *Source) SetIdleTimeout(idleTimeout time.Duration) {
+	if idleTimeout > 0 {
+		s.idleTimeout = idleTimeout
+	}
+}
+
+func (s *Source) Stream(onConnect func()) (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+	go s.run(onConnect, messages, errs)
+	return messages, errs
+}
+
+func (s *Source) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.body != nil {
+		s.body.Close()
+	}
+	return nil
+}
+
+func (s *Source) run(onConnect func(), messages chan<- *events.Envelope, errs chan<- error) {
+	failures := 0
+	for {
+		body, err := s.connect()
+		if err == nil {
+			failures = 0
+			if onConnect != nil {
+				onConnect()
+			}
+			err = s.read(body, messages)
+		}
+		if s.isClosed() {
+			return
+		}
+		if err != nil {
+			failures++
+			if failures >= maxRetries {
+				errs <- err
+				return
+			}
+		}
+
+		select {
+		case <-time.After(reconnectTimeout):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// connect opens a stream, refreshing the token once if the gateway rejects
+// it.
+func (s *Source) connect() (io.ReadCloser, error) {
+	response, err := s.request()
+	if err == nil && response.StatusCode == http.StatusUnauthorized && s.refresher != nil {
+		response.Body.Close()
+		authToken, refreshErr := s.refresher.RefreshAuthToken()
+		if refreshErr != nil {
+			return nil, refreshErr
+		}
+		s.lock.Lock()
+		s.authToken = authToken
+		s.lock.Unlock()
+		response, err = s.request()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		return nil, fmt.Errorf("RLP gateway returned %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		response.Body.Close()
+		return nil, io.EOF
+	}
+	s.body = response.Body
+	return response.Body, nil
+}
+
+func (s *Source) request() (*http.Response, error) {
+	request, err := http.NewRequest("GET", s.readURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	request.Header.Set("Authorization", s.authToken)
+	s.lock.Unlock()
+	request.Header.Set("Accept", "text/event-stream")
+	return s.client.Do(request)
+}
+
+// read delivers the envelopes of one stream until it ends, returning nil if
+// the gateway ended it cleanly.
+func (s *Source) read(body io.ReadCloser, messages chan<- *events.Envelope) error {
+	defer body.Close()
+
+	// Closing the body is the only way to interrupt a blocked read.
+	idle := time.AfterFunc(s.idleTimeout, func() { body.Close() })
+	defer idle.Stop()
+
+	reader := bufio.NewReader(body)
+	var data bytes.Buffer
+	var eventName string
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			if !idle.Stop() {
+				return fmt.Errorf("RLP gateway stream was idle for %s", s.idleTimeout)
+			}
+			return err
+		}
+		idle.Reset(s.idleTimeout)
+
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			// Only unnamed events carry batches. The gateway names the
+			// heartbeats it sends while it has nothing else, which only keep
+			// the stream alive.
+			named := eventName != "" && eventName != "message"
+			eventName = ""
+			if data.Len() == 0 || named {
+				data.Reset()
+				continue
+			}
+			envelopes, parseErr := parseBatch(data.Bytes())
+			data.Reset()
+			if parseErr != nil {
+				return fmt.Errorf("Can not parse RLP gateway batch: %s", parseErr)
+			}
+			for _, envelope := range envelopes {
+				select {
+				case messages <- envelope:
+				case <-s.done:
+					return nil
+				}
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(fieldValue(line, "data:"))
+		case bytes.HasPrefix(line, []byte("event:")):
+			eventName = string(fieldValue(line, "event:"))
+		}
+	}
+}
+
+func fieldValue(line []byte, field string) []byte {
+	return bytes.TrimPrefix(bytes.TrimPrefix(line, []byte(field)), []byte(" "))
+}
+
+func (s *Source) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
@@ -0,0 +1,177 @@
+package rlpgateway_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/rlpgateway"
+	. "github.com/18F/riemann-firehose-nozzle/testhelpers"
+	"github.com/cloudfoundry/sonde-go/events"
+	pb "github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeRefresher struct {
+	token string
+	err   error
+	calls int
+}
+
+func (r *fakeRefresher) RefreshAuthToken() (string, error) {
+	r.calls++
+	return r.token, r.err
+}
+
+var _ = Describe("RLPGateway", func() {
+	var (
+		gateway *FakeRLPGateway
+		source  *rlpgateway.Source
+	)
+
+	BeforeEach(func() {
+		gateway = NewFakeRLPGateway("bearer 123456789")
+		gateway.Start()
+		source = rlpgateway.New(gateway.URL(), "riemann-nozzle", nil, "bearer 123456789", nil)
+	})
+
+	AfterEach(func() {
+		source.Close()
+		gateway.Close()
+	})
+
+	receive := func(messages <-chan *events.Envelope, count int) []*events.Envelope {
+		var received []*events.Envelope
+		for len(received) < count {
+			var envelope *events.Envelope
+			Eventually(messages).Should(Receive(&envelope))
+			received = append(received, envelope)
+		}
+		return received
+	}
+
+	It("reads every envelope type from the shard", func() {
+		gateway.AddEnvelopes(`{"timestamp": "1000", "source_id": "doppler"}`)
+		messages, _ := source.Stream(nil)
+
+		Eventually(gateway.Connections).Should(BeNumerically(">=", 1))
+		Expect(gateway.LastAuthorization()).To(Equal("bearer 123456789"))
+		query := gateway.LastQuery()
+		Expect(query.Get("shard_id")).To(Equal("riemann-nozzle"))
+		for _, envelopeType := range []string{"counter", "gauge", "timer", "log", "event"} {
+			Expect(query).To(HaveKey(envelopeType))
+		}
+		Consistently(messages, 0.2).ShouldNot(Receive())
+	})
+
+	It("converts gauges to value metrics", func() {
+		gateway.AddEnvelopes(`{"timestamp": "1000", "source_id": "doppler", "instance_id": "2",
+			"tags": {"origin": "loggregator.doppler", "deployment": "cf", "job": "doppler", "index": "abc", "ip": "10.0.0.1", "zone": "z1"},
+			"gauge": {"metrics": {"ingress": {"unit": "count", "value": 7}, "dropped": {"unit": "count", "value": 1}}}}`)
+		messages, _ := source.Stream(nil)
+
+		received := receive(messages, 2)
+		Expect(received[0].GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(received[0].GetOrigin()).To(Equal("loggregator.doppler"))
+		Expect(received[0].GetTimestamp()).To(Equal(int64(1000)))
+		Expect(received[0].GetDeployment()).To(Equal("cf"))
+		Expect(received[0].GetJob()).To(Equal("doppler"))
+		Expect(received[0].GetIndex()).To(Equal("abc"))
+		Expect(received[0].GetIp()).To(Equal("10.0.0.1"))
+		Expect(received[0].GetTags()).To(Equal(map[string]string{"source_id": "doppler", "instance_id": "2", "zone": "z1"}))
+		Expect(received[0].GetValueMetric().GetName()).To(Equal("dropped"))
+		Expect(received[0].GetValueMetric().GetValue()).To(Equal(1.0))
+		Expect(received[1].GetValueMetric().GetName()).To(Equal("ingress"))
+		Expect(received[1].GetValueMetric().GetUnit()).To(Equal("count"))
+	})
+
+	It("converts each envelope type to its V1 counterpart", func() {
+		gateway.AddEnvelopes(
+			`{"timestamp": "1000", "source_id": "gorouter", "counter": {"name": "requests", "delta": "3", "total": "1234"}}`,
+			`{"timestamp": "1000", "source_id": "0f6b7c8e-1b5d-4d3a-9f2e-6a1c2b3d4e5f", "instance_id": "1",
+				"gauge": {"metrics": {"cpu": {"value": 12.5}, "memory": {"value": 1024}, "disk": {"value": 2048}, "memory_quota": {"value": 4096}, "disk_quota": {"value": 8192}}}}`,
+			`{"timestamp": "1000", "source_id": "gorouter", "tags": {"method": "POST", "uri": "/v2/apps", "status_code": "201", "peer_type": "Server"},
+				"timer": {"name": "http", "start": "100", "stop": "250"}}`,
+			`{"timestamp": "1000", "source_id": "app-guid", "instance_id": "0", "tags": {"source_type": "APP/PROC/WEB"}, "log": {"payload": "aGVsbG8=", "type": "ERR"}}`,
+			`{"timestamp": "1000", "source_id": "bosh", "event": {"title": "VM restarted", "body": "router/0"}}`,
+		)
+		messages, _ := source.Stream(nil)
+
+		received := receive(messages, 5)
+		for _, envelope := range received {
+			_, err := pb.Marshal(envelope)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		Expect(received[0].GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(received[0].GetOrigin()).To(Equal("gorouter"))
+		Expect(received[0].GetCounterEvent().GetName()).To(Equal("requests"))
+		Expect(received[0].GetCounterEvent().GetDelta()).To(Equal(uint64(3)))
+		Expect(received[0].GetCounterEvent().GetTotal()).To(Equal(uint64(1234)))
+
+		Expect(received[1].GetEventType()).To(Equal(events.Envelope_ContainerMetric))
+		Expect(received[1].GetContainerMetric().GetApplicationId()).To(Equal("0f6b7c8e-1b5d-4d3a-9f2e-6a1c2b3d4e5f"))
+		Expect(received[1].GetContainerMetric().GetInstanceIndex()).To(Equal(int32(1)))
+		Expect(received[1].GetContainerMetric().GetCpuPercentage()).To(Equal(12.5))
+		Expect(received[1].GetContainerMetric().GetDiskBytesQuota()).To(Equal(uint64(8192)))
+
+		Expect(received[2].GetEventType()).To(Equal(events.Envelope_HttpStartStop))
+		Expect(received[2].GetHttpStartStop().GetStartTimestamp()).To(Equal(int64(100)))
+		Expect(received[2].GetHttpStartStop().GetStopTimestamp()).To(Equal(int64(250)))
+		Expect(received[2].GetHttpStartStop().GetMethod()).To(Equal(events.Method_POST))
+		Expect(received[2].GetHttpStartStop().GetPeerType()).To(Equal(events.PeerType_Server))
+		Expect(received[2].GetHttpStartStop().GetStatusCode()).To(Equal(int32(201)))
+
+		Expect(received[3].GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(string(received[3].GetLogMessage().GetMessage())).To(Equal("hello"))
+		Expect(received[3].GetLogMessage().GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(received[3].GetLogMessage().GetAppId()).To(Equal("app-guid"))
+		Expect(received[3].GetLogMessage().GetSourceType()).To(Equal("APP/PROC/WEB"))
+
+		Expect(received[4].GetEventType()).To(Equal(events.Envelope_Error))
+		Expect(received[4].GetError().GetSource()).To(Equal("bosh"))
+		Expect(received[4].GetError().GetMessage()).To(Equal("VM restarted: router/0"))
+	})
+
+	It("reconnects whenever the gateway ends the stream", func() {
+		gateway.AddEnvelopes(`{"timestamp": "1000", "source_id": "gorouter", "counter": {"name": "requests", "delta": "1", "total": "1"}}`)
+		connects := make(chan bool, 10)
+		messages, errs := source.Stream(func() { connects <- true })
+
+		receive(messages, 2)
+		Expect(connects).To(HaveLen(2))
+		Expect(errs).NotTo(Receive())
+	})
+
+	It("refreshes the token when the gateway rejects it", func() {
+		refresher := &fakeRefresher{token: "bearer fresh"}
+		source = rlpgateway.New(gateway.URL(), "riemann-nozzle", nil, "bearer expired", refresher)
+		gateway.SetValidToken("bearer fresh")
+		gateway.AddEnvelopes(`{"timestamp": "1000", "source_id": "gorouter", "counter": {"name": "requests", "delta": "1", "total": "1"}}`)
+		messages, _ := source.Stream(nil)
+
+		receive(messages, 1)
+		Expect(refresher.calls).To(Equal(1))
+		Expect(gateway.LastAuthorization()).To(Equal("bearer fresh"))
+	})
+
+	It("reports an error once the gateway has failed repeatedly", func() {
+		source = rlpgateway.New(gateway.URL(), "riemann-nozzle", nil, "bearer expired", &fakeRefresher{err: errors.New("UAA is down")})
+		connected := false
+		_, errs := source.Stream(func() { connected = true })
+
+		var err error
+		Eventually(errs, 5*time.Second).Should(Receive(&err))
+		Expect(err).To(MatchError("UAA is down"))
+		Expect(connected).To(BeFalse())
+	})
+
+	It("reports gateway errors with their status", func() {
+		source = rlpgateway.New(gateway.URL(), "riemann-nozzle", nil, "bearer wrong", nil)
+		_, errs := source.Stream(nil)
+
+		var err error
+		Eventually(errs, 5*time.Second).Should(Receive(&err))
+		Expect(err.Error()).To(ContainSubstring("RLP gateway returned 401 Unauthorized"))
+	})
+})
@@ -0,0 +1,102 @@
+package rotatingfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is a buffered file that rotates once it would grow past maxBytes:
+// path becomes path.1, path.1 becomes path.2 and so on, keeping at most
+// maxFiles files including the current one. A single Write never spans two
+// files, so callers that write one record per call keep records whole.
+type File struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	buffer   *bufio.Writer
+	written  int64
+}
+
+// Open truncates path and starts writing to it. A maxBytes of 0 never
+// rotates.
+func Open(path string, maxBytes int64, maxFiles int) (*File, error) {
+	f := &File{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.maxBytes > 0 && f.written > 0 && f.written+int64(len(p)) > f.maxBytes {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.buffer.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+// Flush writes buffered data to disk.
+func (f *File) Flush() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.buffer.Flush()
+}
+
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.closeFile()
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Can not open file %s: %s", f.path, err)
+	}
+	f.file = file
+	f.buffer = bufio.NewWriter(file)
+	f.written = 0
+	return nil
+}
+
+func (f *File) closeFile() error {
+	flushErr := f.buffer.Flush()
+	closeErr := f.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+func (f *File) rotate() error {
+	err := f.closeFile()
+	if err != nil {
+		return err
+	}
+
+	if f.maxFiles > 1 {
+		for i := f.maxFiles - 1; i > 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i-1), fmt.Sprintf("%s.%d", f.path, i))
+		}
+		err = os.Rename(f.path, f.path+".1")
+		if err != nil {
+			return fmt.Errorf("Can not rotate file %s: %s", f.path, err)
+		}
+	}
+	return f.open()
+}
@@ -0,0 +1,67 @@
+package rotatingfile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/18F/riemann-firehose-nozzle/rotatingfile"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RotatingFile", func() {
+	var dir string
+	var path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "rotatingfile")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "out.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("never rotates without a size limit", func() {
+		file, err := rotatingfile.Open(path, 0, 3)
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 100; i++ {
+			_, err = file.Write([]byte("line\n"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(file.Close()).To(Succeed())
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(contents).To(HaveLen(500))
+		Expect(path + ".1").NotTo(BeAnExistingFile())
+	})
+
+	It("rotates before a write that would pass the limit and keeps maxFiles files", func() {
+		file, err := rotatingfile.Open(path, 10, 2)
+		Expect(err).ToNot(HaveOccurred())
+		for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+			_, err = file.Write([]byte(line))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(file.Close()).To(Succeed())
+
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("four\n")))
+		Expect(ioutil.ReadFile(path + ".1")).To(Equal([]byte("three\n")))
+		Expect(path + ".2").NotTo(BeAnExistingFile())
+	})
+
+	It("makes buffered writes visible on Flush", func() {
+		file, err := rotatingfile.Open(path, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+
+		_, err = file.Write([]byte("line\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(file.Flush()).To(Succeed())
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("line\n")))
+	})
+})
@@ -0,0 +1,13 @@
+package rotatingfile_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Rotating File Suite")
+}
@@ -0,0 +1,320 @@
+package sysloglistener
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// The structured data IDs the CF syslog agents use for metrics. 47450 is
+// Cloud Foundry's private enterprise number.
+const (
+	gaugeID   = "gauge@47450"
+	counterID = "counter@47450"
+	tagsID    = "tags@47450"
+)
+
+// Tags that become fields of the envelope rather than tags.
+var envelopeTags = map[string]bool{
+	"origin":     true,
+	"deployment": true,
+	"job":        true,
+	"index":      true,
+	"ip":         true,
+}
+
+// message is the part of an RFC5424 message the nozzle uses.
+type message struct {
+	timestamp      time.Time
+	hostname       string
+	appName        string
+	procID         string
+	structuredData []element
+	msg            string
+}
+
+// element is one SD-ELEMENT, with its parameters in order.
+type element struct {
+	id     string
+	params []param
+}
+
+type param struct {
+	name  string
+	value string
+}
+
+func (e element) param(name string) (string, bool) {
+	for _, p := range e.params {
+		if p.name == name {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+// parse reads an RFC5424 message:
+//
+//	<PRI>VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parse(data []byte) (*message, error) {
+	line := strings.TrimRight(string(data), "\r\n")
+	if !strings.HasPrefix(line, "<") {
+		return nil, errors.New("missing priority")
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("malformed priority")
+	}
+	if _, err := strconv.Atoi(line[1:end]); err != nil {
+		return nil, errors.New("malformed priority")
+	}
+	rest := line[end+1:]
+
+	fields := make([]string, 6)
+	for i := range fields {
+		space := strings.IndexByte(rest, ' ')
+		if space < 0 {
+			return nil, errors.New("truncated header")
+		}
+		fields[i], rest = rest[:space], rest[space+1:]
+	}
+	if fields[0] != "1" {
+		return nil, fmt.Errorf("unsupported version %q", fields[0])
+	}
+
+	m := &message{
+		hostname: nilValue(fields[2]),
+		appName:  nilValue(fields[3]),
+		procID:   nilValue(fields[4]),
+	}
+	if fields[1] != "-" {
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed timestamp %q", fields[1])
+		}
+		m.timestamp = timestamp
+	}
+
+	var err error
+	m.structuredData, rest, err = parseStructuredData(rest)
+	if err != nil {
+		return nil, err
+	}
+	m.msg = strings.TrimPrefix(rest, " ")
+	return m, nil
+}
+
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// parseStructuredData reads STRUCTURED-DATA from the start of s and returns
+// what follows it.
+func parseStructuredData(s string) ([]element, string, error) {
+	if strings.HasPrefix(s, "-") {
+		return nil, s[1:], nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return nil, "", errors.New("malformed structured data")
+	}
+
+	var elements []element
+	for strings.HasPrefix(s, "[") {
+		var e element
+		var err error
+		e, s, err = parseElement(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		elements = append(elements, e)
+	}
+	return elements, s, nil
+}
+
+// parseElement reads an SD-ELEMENT after its opening bracket.
+func parseElement(s string) (element, string, error) {
+	end := strings.IndexAny(s, " ]")
+	if end <= 0 {
+		return element{}, "", errors.New("malformed structured data ID")
+	}
+	e := element{id: s[:end]}
+	s = s[end:]
+
+	for {
+		switch {
+		case strings.HasPrefix(s, "]"):
+			return e, s[1:], nil
+		case strings.HasPrefix(s, " "):
+			s = s[1:]
+		default:
+			return element{}, "", fmt.Errorf("malformed structured data in %s", e.id)
+		}
+
+		equals := strings.Index(s, `="`)
+		if equals <= 0 {
+			return element{}, "", fmt.Errorf("malformed parameter in %s", e.id)
+		}
+		name := s[:equals]
+		value, rest, err := parseParamValue(s[equals+2:])
+		if err != nil {
+			return element{}, "", fmt.Errorf("%s in %s", err, e.id)
+		}
+		e.params = append(e.params, param{name: name, value: value})
+		s = rest
+	}
+}
+
+// parseParamValue reads a PARAM-VALUE after its opening quote, undoing the
+// escapes of '"', '\' and ']'.
+func parseParamValue(s string) (string, string, error) {
+	var value bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+				i++
+			}
+			value.WriteByte(s[i])
+		case '"':
+			return value.String(), s[i+1:], nil
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return "", "", errors.New("unterminated parameter value")
+}
+
+// toEnvelopes converts a message to one envelope per gauge or counter in
+// its structured data, or to a single LogMessage if it has neither.
+func toEnvelopes(m *message) ([]*events.Envelope, error) {
+	tags := make(map[string]string)
+	for _, e := range m.structuredData {
+		if e.id == tagsID {
+			for _, p := range e.params {
+				tags[p.name] = p.value
+			}
+		}
+	}
+
+	var converted []*events.Envelope
+	for _, e := range m.structuredData {
+		switch e.id {
+		case gaugeID:
+			name, raw, err := metricParams(e, "value")
+			if err != nil {
+				return nil, err
+			}
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed value %q in %s %s", raw, e.id, name)
+			}
+			unit, _ := e.param("unit")
+			converted = append(converted, newEnvelope(m, tags, events.Envelope_ValueMetric, func(envelope *events.Envelope) {
+				envelope.ValueMetric = &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(value),
+					Unit:  proto.String(unit),
+				}
+			}))
+		case counterID:
+			name, raw, err := metricParams(e, "total")
+			if err != nil {
+				return nil, err
+			}
+			total, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed total %q in %s %s", raw, e.id, name)
+			}
+			delta := uint64(0)
+			if raw, ok := e.param("delta"); ok {
+				delta, err = strconv.ParseUint(raw, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("malformed delta %q in %s %s", raw, e.id, name)
+				}
+			}
+			converted = append(converted, newEnvelope(m, tags, events.Envelope_CounterEvent, func(envelope *events.Envelope) {
+				envelope.CounterEvent = &events.CounterEvent{
+					Name:  proto.String(name),
+					Delta: proto.Uint64(delta),
+					Total: proto.Uint64(total),
+				}
+			}))
+		}
+	}
+	if len(converted) > 0 {
+		return converted, nil
+	}
+
+	return []*events.Envelope{newEnvelope(m, tags, events.Envelope_LogMessage, func(envelope *events.Envelope) {
+		envelope.LogMessage = &events.LogMessage{
+			Message:        []byte(m.msg),
+			MessageType:    events.LogMessage_OUT.Enum(),
+			Timestamp:      envelope.Timestamp,
+			AppId:          proto.String(m.appName),
+			SourceInstance: proto.String(m.procID),
+		}
+	})}, nil
+}
+
+// metricParams returns the name of a gauge or counter and the raw value of
+// its parameter valueParam.
+func metricParams(e element, valueParam string) (string, string, error) {
+	name, ok := e.param("name")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("%s has no name", e.id)
+	}
+	raw, ok := e.param(valueParam)
+	if !ok {
+		return "", "", fmt.Errorf("%s %s has no %s", e.id, name, valueParam)
+	}
+	return name, raw, nil
+}
+
+// newEnvelope returns an envelope of eventType with the fields common to
+// every type filled from m and its tags, and lets set add the event itself.
+// The app name is the origin unless the tags name one.
+func newEnvelope(m *message, tags map[string]string, eventType events.Envelope_EventType, set func(*events.Envelope)) *events.Envelope {
+	origin := tags["origin"]
+	if origin == "" {
+		origin = m.appName
+	}
+	timestamp := m.timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	otherTags := map[string]string{"source_id": m.appName}
+	if m.procID != "" {
+		otherTags["instance_id"] = strings.Trim(m.procID, "[]")
+	}
+	if m.hostname != "" {
+		otherTags["hostname"] = m.hostname
+	}
+	for key, value := range tags {
+		if !envelopeTags[key] {
+			otherTags[key] = value
+		}
+	}
+
+	envelope := &events.Envelope{
+		Origin:     proto.String(origin),
+		EventType:  eventType.Enum(),
+		Timestamp:  proto.Int64(timestamp.UnixNano()),
+		Deployment: proto.String(tags["deployment"]),
+		Job:        proto.String(tags["job"]),
+		Index:      proto.String(tags["index"]),
+		Ip:         proto.String(tags["ip"]),
+		Tags:       otherTags,
+	}
+	set(envelope)
+	return envelope
+}
@@ -0,0 +1,252 @@
+// Package sysloglistener receives RFC5424 syslog messages over TCP or TLS,
+// such as those sent by CF syslog agents, and converts the gauges and
+// counters in their structured data to envelopes.
+package sysloglistener
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// maxMessageBytes bounds a single message so that a misbehaving sender
+// cannot make the nozzle buffer without limit.
+const (
+	maxMessageBytes = 64 << 10
+	maxCountDigits  = 6
+)
+
+// Listener accepts syslog connections and streams what they send as
+// envelopes. Messages may be framed by octet counting or end with a
+// newline, as described in RFC6587; a connection may mix both. A message
+// that cannot be parsed is logged and skipped, and one that is too long
+// closes its connection.
+type Listener struct {
+	address   string
+	tlsConfig *tls.Config
+	logger    *nozzlelogger.Logger
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	done     chan struct{}
+}
+
+// New returns a listener on address, a host:port. With tlsConfig it
+// accepts TLS connections only.
+func New(address string, tlsConfig *tls.Config, logger *nozzlelogger.Logger) *Listener {
+	return &Listener{
+		address:   address,
+		tlsConfig: tlsConfig,
+		logger:    logger,
+		conns:     make(map[net.Conn]bool),
+		done:      make(chan struct{}),
+	}
+}
+
+// Stream starts listening, calling onConnect once it is. The error channel
+// receives an error only if the listener cannot listen or accept.
+func (l *Listener) Stream(onConnect func()) (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+
+	var listener net.Listener
+	var err error
+	if l.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", l.address, l.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", l.address)
+	}
+	if err != nil {
+		errs <- fmt.Errorf("Can not listen for syslog on %s: %s", l.address, err)
+		return messages, errs
+	}
+
+	l.lock.Lock()
+	l.listener = listener
+	l.lock.Unlock()
+	if onConnect != nil {
+		onConnect()
+	}
+
+	go l.accept(listener, messages, errs)
+	return messages, errs
+}
+
+// Addr returns the address the listener is listening on, or nil before
+// Stream.
+func (l *Listener) Addr() net.Addr {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.listener == nil {
+		return nil
+	}
+	return l.listener.Addr()
+}
+
+func (l *Listener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	for conn := range l.conns {
+		conn.Close()
+	}
+	if l.listener != nil {
+		return l.listener.Close()
+	}
+	return nil
+}
+
+func (l *Listener) accept(listener net.Listener, messages chan<- *events.Envelope, errs chan<- error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			if !l.isClosed() {
+				errs <- fmt.Errorf("Can not accept syslog connections: %s", err)
+			}
+			return
+		}
+
+		if !l.track(conn) {
+			conn.Close()
+			return
+		}
+		go l.serve(conn, messages)
+	}
+}
+
+func (l *Listener) serve(conn net.Conn, messages chan<- *events.Envelope) {
+	defer l.untrack(conn)
+	defer conn.Close()
+
+	logger := l.logger.With(nozzlelogger.Fields{"remote_address": conn.RemoteAddr().String()})
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := readFrame(reader)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if !l.isClosed() {
+				logger.Warn("Closing syslog connection", nozzlelogger.Fields{"reason": err.Error()})
+			}
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		message, err := parse(data)
+		var envelopes []*events.Envelope
+		if err == nil {
+			envelopes, err = toEnvelopes(message)
+		}
+		if err != nil {
+			logger.Debug("Skipping syslog message", nozzlelogger.Fields{"reason": err.Error()})
+			continue
+		}
+
+		for _, envelope := range envelopes {
+			select {
+			case messages <- envelope:
+			case <-l.done:
+				return
+			}
+		}
+	}
+}
+
+// readFrame reads one message, framed either by an octet count or by a
+// trailing newline.
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] < '0' || first[0] > '9' {
+		var line []byte
+		for {
+			chunk, isPrefix, err := reader.ReadLine()
+			if err != nil {
+				return nil, err
+			}
+			line = append(line, chunk...)
+			if len(line) > maxMessageBytes {
+				return nil, fmt.Errorf("message longer than %d bytes", maxMessageBytes)
+			}
+			if !isPrefix {
+				return line, nil
+			}
+		}
+	}
+
+	count := 0
+	for digits := 0; ; digits++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if b == ' ' && digits > 0 {
+			break
+		}
+		if b < '0' || b > '9' || digits == maxCountDigits {
+			return nil, errors.New("malformed octet count")
+		}
+		count = count*10 + int(b-'0')
+	}
+	if count > maxMessageBytes {
+		return nil, fmt.Errorf("message longer than %d bytes", maxMessageBytes)
+	}
+	data := make([]byte, count)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	return data, nil
+}
+
+// unexpected reports a connection that ends part way through a message.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (l *Listener) track(conn net.Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = true
+	return true
+}
+
+func (l *Listener) untrack(conn net.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.conns, conn)
+}
+
+func (l *Listener) isClosed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.closed
+}
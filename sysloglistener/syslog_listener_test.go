@@ -0,0 +1,159 @@
+package sysloglistener_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+	"github.com/18F/riemann-firehose-nozzle/sysloglistener"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("SyslogListener", func() {
+	var (
+		listener  *sysloglistener.Listener
+		logOutput *gbytes.Buffer
+		logger    *nozzlelogger.Logger
+		messages  <-chan *events.Envelope
+		errs      <-chan error
+	)
+
+	BeforeEach(func() {
+		logOutput = gbytes.NewBuffer()
+		logger = nozzlelogger.New(logOutput, nozzlelogger.Debug, nozzlelogger.FormatJSON)
+		listener = sysloglistener.New("127.0.0.1:0", nil, logger)
+		messages, errs = listener.Stream(nil)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	octetCounted := func(message string) string {
+		return fmt.Sprintf("%d %s", len(message), message)
+	}
+
+	receive := func() *events.Envelope {
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		return envelope
+	}
+
+	It("converts gauges with their tags to value metrics", func() {
+		conn := dial()
+		defer conn.Close()
+
+		fmt.Fprint(conn, octetCounted(`<14>1 2020-01-30T00:00:00.5Z router-host gorouter [router/0] - [gauge@47450 name="latency" value="12.5" unit="ms"][tags@47450 deployment="cf" job="router" index="abc" zone="z1"]`))
+
+		envelope := receive()
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(envelope.GetOrigin()).To(Equal("gorouter"))
+		Expect(envelope.GetTimestamp()).To(Equal(time.Date(2020, 1, 30, 0, 0, 0, 500000000, time.UTC).UnixNano()))
+		Expect(envelope.GetDeployment()).To(Equal("cf"))
+		Expect(envelope.GetJob()).To(Equal("router"))
+		Expect(envelope.GetIndex()).To(Equal("abc"))
+		Expect(envelope.GetTags()).To(Equal(map[string]string{"source_id": "gorouter", "instance_id": "router/0", "hostname": "router-host", "zone": "z1"}))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("latency"))
+		Expect(envelope.GetValueMetric().GetValue()).To(Equal(12.5))
+		Expect(envelope.GetValueMetric().GetUnit()).To(Equal("ms"))
+	})
+
+	It("converts counters and reads newline framed messages", func() {
+		conn := dial()
+		defer conn.Close()
+
+		fmt.Fprint(conn, "<14>1 2020-01-30T00:00:00Z host api - - [counter@47450 name=\"requests\" total=\"18446744073709551615\" delta=\"2\"][tags@47450 origin=\"cloud_controller\"]\n")
+
+		envelope := receive()
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(envelope.GetOrigin()).To(Equal("cloud_controller"))
+		Expect(envelope.GetCounterEvent().GetName()).To(Equal("requests"))
+		Expect(envelope.GetCounterEvent().GetTotal()).To(Equal(uint64(18446744073709551615)))
+		Expect(envelope.GetCounterEvent().GetDelta()).To(Equal(uint64(2)))
+	})
+
+	It("passes other messages on as logs", func() {
+		conn := dial()
+		defer conn.Close()
+
+		fmt.Fprint(conn, octetCounted(`<14>1 - host app-guid [APP/PROC/WEB/0] - [tags@47450 note="a \"quoted\" \] value"] hello world`))
+
+		envelope := receive()
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal("hello world"))
+		Expect(envelope.GetLogMessage().GetAppId()).To(Equal("app-guid"))
+		Expect(envelope.GetTags()["note"]).To(Equal(`a "quoted" ] value`))
+		Expect(envelope.GetTimestamp()).To(BeNumerically("~", time.Now().UnixNano(), int64(time.Minute)))
+	})
+
+	It("skips messages it cannot parse and keeps the connection", func() {
+		conn := dial()
+		defer conn.Close()
+
+		fmt.Fprint(conn, "not syslog at all\n")
+		fmt.Fprint(conn, octetCounted(`<14>1 2020-01-30T00:00:00Z host gorouter - - [gauge@47450 name="latency" value="fast"]`))
+		fmt.Fprint(conn, octetCounted(`<14>1 2020-01-30T00:00:00Z host gorouter - - [gauge@47450 name="latency" value="3"]`))
+
+		envelope := receive()
+		Expect(envelope.GetValueMetric().GetValue()).To(Equal(3.0))
+		Expect(logOutput).To(gbytes.Say("Skipping syslog message"))
+		Expect(logOutput).To(gbytes.Say(`malformed value \\"fast\\"`))
+	})
+
+	It("closes connections that send oversized messages", func() {
+		conn := dial()
+		defer conn.Close()
+
+		fmt.Fprint(conn, "999999 <14>1")
+
+		Eventually(logOutput).Should(gbytes.Say("Closing syslog connection"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports when it cannot listen", func() {
+		other := sysloglistener.New(listener.Addr().String(), nil, logger)
+		_, otherErrs := other.Stream(nil)
+
+		var err error
+		Expect(otherErrs).To(Receive(&err))
+		Expect(err.Error()).To(ContainSubstring("Can not listen for syslog"))
+		Expect(errs).NotTo(Receive())
+	})
+
+	It("accepts TLS connections", func() {
+		// Borrow the test server's certificate.
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		defer server.Close()
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+
+		tlsListener := sysloglistener.New("127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates}, logger)
+		tlsMessages, _ := tlsListener.Stream(nil)
+		defer tlsListener.Close()
+
+		conn, err := tls.Dial("tcp", tlsListener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com"})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		fmt.Fprint(conn, octetCounted(`<14>1 2020-01-30T00:00:00Z host gorouter - - [gauge@47450 name="latency" value="3"]`))
+
+		var envelope *events.Envelope
+		Eventually(tlsMessages).Should(Receive(&envelope))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("latency"))
+	})
+})
@@ -19,6 +19,7 @@ type FakeFirehose struct {
 
 	lastAuthorization string
 	requested         bool
+	connections       int
 
 	events       []events.Envelope
 	closeMessage []byte
@@ -56,6 +57,13 @@ func (f *FakeFirehose) Requested() bool {
 	return f.requested
 }
 
+// Connections returns the number of requests made with a valid token.
+func (f *FakeFirehose) Connections() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.connections
+}
+
 func (f *FakeFirehose) AddEvent(event events.Envelope) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
@@ -83,6 +91,7 @@ func (f *FakeFirehose) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	f.connections++
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(*http.Request) bool { return true },
 	}
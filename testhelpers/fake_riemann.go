@@ -0,0 +1,250 @@
+package testhelpers
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+
+	"github.com/amir/raidman/proto"
+	pb "github.com/golang/protobuf/proto"
+)
+
+// RiemannResponse scripts how FakeRiemann answers a single TCP message. A
+// response with Hangup set closes the connection without acknowledging,
+// which the client sees as a network error. UDP messages are never
+// acknowledged, so scripted responses only apply to TCP.
+type RiemannResponse struct {
+	Ok     bool
+	Error  string
+	Hangup bool
+}
+
+// FakeRiemann speaks the Riemann protobuf protocol over "tcp" or "udp" and
+// records the events it accepts. Over TCP it also answers queries of the form
+// `tagged "tag"` or `service = "service" and tagged "tag"` from the events it
+// has indexed.
+type FakeRiemann struct {
+	transport  string
+	listener   net.Listener
+	packetConn net.PacketConn
+	lock       sync.Mutex
+
+	responses      []RiemannResponse
+	messagesServed int
+	events         []*proto.Event
+	notIndexing    bool
+	queries        int
+}
+
+var fakeRiemannQuery = regexp.MustCompile(`^(?:service = "([^"]*)" and )?tagged "([^"]*)"$`)
+
+func NewFakeRiemann(transport string) *FakeRiemann {
+	return &FakeRiemann{transport: transport}
+}
+
+func (f *FakeRiemann) Start() {
+	var err error
+	if f.transport == "udp" {
+		f.packetConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		go f.readPackets()
+		return
+	}
+
+	f.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go f.accept()
+}
+
+func (f *FakeRiemann) Close() {
+	if f.packetConn != nil {
+		f.packetConn.Close()
+		return
+	}
+	f.listener.Close()
+}
+
+func (f *FakeRiemann) Transport() string {
+	return f.transport
+}
+
+func (f *FakeRiemann) Host() string {
+	host, _, _ := net.SplitHostPort(f.addr().String())
+	return host
+}
+
+func (f *FakeRiemann) Port() string {
+	_, port, _ := net.SplitHostPort(f.addr().String())
+	return port
+}
+
+// Address returns the host:port the server listens on.
+func (f *FakeRiemann) Address() string {
+	return f.addr().String()
+}
+
+func (f *FakeRiemann) addr() net.Addr {
+	if f.packetConn != nil {
+		return f.packetConn.LocalAddr()
+	}
+	return f.listener.Addr()
+}
+
+// SetResponses scripts the answers to the next messages, in order. Once the
+// script runs out every message is acknowledged with ok=true.
+func (f *FakeRiemann) SetResponses(responses ...RiemannResponse) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.responses = responses
+}
+
+// StopIndexing makes the server keep acknowledging events while leaving them
+// out of query results.
+func (f *FakeRiemann) StopIndexing() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.notIndexing = true
+}
+
+func (f *FakeRiemann) Queries() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.queries
+}
+
+func (f *FakeRiemann) MessagesServed() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.messagesServed
+}
+
+// Events returns every event received over UDP or acknowledged with ok=true
+// over TCP.
+func (f *FakeRiemann) Events() []*proto.Event {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	events := make([]*proto.Event, len(f.events))
+	copy(events, f.events)
+	return events
+}
+
+func (f *FakeRiemann) accept() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.serve(conn)
+	}
+}
+
+func (f *FakeRiemann) readPackets() {
+	buffer := make([]byte, 65536)
+	for {
+		n, _, err := f.packetConn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		message := &proto.Msg{}
+		if err := pb.Unmarshal(buffer[:n], message); err != nil {
+			continue
+		}
+
+		f.lock.Lock()
+		f.messagesServed++
+		f.events = append(f.events, message.GetEvents()...)
+		f.lock.Unlock()
+	}
+}
+
+func (f *FakeRiemann) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var length uint32
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		message := &proto.Msg{}
+		if err := pb.Unmarshal(data, message); err != nil {
+			return
+		}
+
+		var reply []byte
+		if message.Query != nil {
+			reply, _ = pb.Marshal(f.answerQuery(message.Query.GetString_()))
+		} else {
+			response := f.nextResponse(message)
+			if response.Hangup {
+				return
+			}
+			reply, _ = pb.Marshal(&proto.Msg{
+				Ok:    pb.Bool(response.Ok),
+				Error: pb.String(response.Error),
+			})
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint32(len(reply))); err != nil {
+			return
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *FakeRiemann) nextResponse(message *proto.Msg) RiemannResponse {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.messagesServed++
+	response := RiemannResponse{Ok: true}
+	if len(f.responses) > 0 {
+		response = f.responses[0]
+		f.responses = f.responses[1:]
+	}
+
+	if response.Ok && !response.Hangup {
+		f.events = append(f.events, message.GetEvents()...)
+	}
+	return response
+}
+
+func (f *FakeRiemann) answerQuery(query string) *proto.Msg {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.queries++
+	match := fakeRiemannQuery.FindStringSubmatch(query)
+	if match == nil {
+		return &proto.Msg{Ok: pb.Bool(false), Error: pb.String("parse error: " + query)}
+	}
+
+	answer := &proto.Msg{Ok: pb.Bool(true)}
+	if f.notIndexing {
+		return answer
+	}
+	for _, event := range f.events {
+		if match[1] != "" && event.GetService() != match[1] {
+			continue
+		}
+		for _, tag := range event.GetTags() {
+			if tag == match[2] {
+				answer.Events = append(answer.Events, event)
+				break
+			}
+		}
+	}
+	return answer
+}
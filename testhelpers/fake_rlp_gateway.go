@@ -0,0 +1,118 @@
+package testhelpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// FakeRLPGateway serves the Reverse Log Proxy gateway's /v2/read stream.
+// Each request gets every batch added so far as a server-sent event,
+// followed by a heartbeat, after which the stream ends as the real gateway's
+// streams do from time to time.
+type FakeRLPGateway struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	validToken string
+
+	lastAuthorization string
+	lastQuery         url.Values
+	connections       int
+
+	batches []string
+}
+
+func NewFakeRLPGateway(validToken string) *FakeRLPGateway {
+	return &FakeRLPGateway{
+		validToken: validToken,
+	}
+}
+
+func (f *FakeRLPGateway) Start() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Start()
+}
+
+func (f *FakeRLPGateway) Close() {
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+func (f *FakeRLPGateway) URL() string {
+	return f.server.URL
+}
+
+func (f *FakeRLPGateway) LastAuthorization() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastAuthorization
+}
+
+func (f *FakeRLPGateway) LastQuery() url.Values {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastQuery
+}
+
+// Connections returns the number of streams opened with a valid token.
+func (f *FakeRLPGateway) Connections() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.connections
+}
+
+// SetValidToken changes the token the gateway accepts, as if the previous
+// one had expired.
+func (f *FakeRLPGateway) SetValidToken(validToken string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.validToken = validToken
+}
+
+// AddEnvelopes adds a batch of V2 envelopes, each given in the protobuf
+// JSON mapping.
+func (f *FakeRLPGateway) AddEnvelopes(envelopes ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// Each batch must fit on one data line.
+	var batch bytes.Buffer
+	err := json.Compact(&batch, []byte(`{"batch":[`+strings.Join(envelopes, ",")+`]}`))
+	if err != nil {
+		panic(err)
+	}
+	f.batches = append(f.batches, batch.String())
+}
+
+func (f *FakeRLPGateway) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.lastAuthorization = r.Header.Get("Authorization")
+	f.lastQuery = r.URL.Query()
+
+	if r.URL.Path != "/v2/read" {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.lastAuthorization != f.validToken {
+		log.Printf("Bad token passed to RLP gateway: %s", f.lastAuthorization)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.connections++
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.WriteHeader(http.StatusOK)
+	for _, batch := range f.batches {
+		fmt.Fprintf(rw, "data: %s\n\n", batch)
+	}
+	fmt.Fprint(rw, "event: heartbeat\ndata: 1580428783\n\n")
+	rw.(http.Flusher).Flush()
+}
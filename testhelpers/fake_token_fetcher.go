@@ -4,7 +4,7 @@ type FakeTokenFetcher struct {
 	NumCalls int
 }
 
-func (tokenFetcher *FakeTokenFetcher) FetchAuthToken() string {
+func (tokenFetcher *FakeTokenFetcher) FetchAuthToken() (string, error) {
 	tokenFetcher.NumCalls++
-	return "auth token"
+	return "auth token", nil
 }
@@ -1,6 +1,7 @@
 package testhelpers
 
 import (
+	"encoding/pem"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -13,8 +14,12 @@ type FakeUAA struct {
 
 	tokenType   string
 	accessToken string
+	expiresIn   int
 
-	requested bool
+	failures   []int
+	requested  bool
+	requests   int
+	grantTypes []string
 }
 
 func NewFakeUAA(tokenType string, accessToken string) *FakeUAA {
@@ -29,6 +34,17 @@ func (f *FakeUAA) Start() {
 	f.server.Start()
 }
 
+// StartTLS serves over HTTPS with a self-signed certificate, available from
+// CACertPEM.
+func (f *FakeUAA) StartTLS() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.StartTLS()
+}
+
+func (f *FakeUAA) CACertPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.server.Certificate().Raw}))
+}
+
 func (f *FakeUAA) Close() {
 	f.server.Close()
 }
@@ -43,17 +59,61 @@ func (f *FakeUAA) Requested() bool {
 	return f.requested
 }
 
+func (f *FakeUAA) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *FakeUAA) GrantTypes() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.grantTypes...)
+}
+
+// SetExpiresIn makes the issued tokens expire after the given number of
+// seconds. Zero leaves expires_in out of the response.
+func (f *FakeUAA) SetExpiresIn(seconds int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expiresIn = seconds
+}
+
+// FailWith answers the next requests with the given HTTP status codes, in
+// order, before issuing tokens again.
+func (f *FakeUAA) FailWith(statusCodes ...int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = statusCodes
+}
+
 func (f *FakeUAA) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	r.ParseForm()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requested = true
+	f.requests++
+	f.grantTypes = append(f.grantTypes, r.PostForm.Get("grant_type"))
+
+	if len(f.failures) > 0 {
+		rw.WriteHeader(f.failures[0])
+		f.failures = f.failures[1:]
+		return
+	}
+
+	expiresIn := ""
+	if f.expiresIn > 0 {
+		expiresIn = fmt.Sprintf(`,
+			"expires_in": %d`, f.expiresIn)
+	}
 	rw.Write([]byte(fmt.Sprintf(`
 		{
 			"token_type": "%s",
-			"access_token": "%s"
+			"access_token": "%s"%s
 		}
-	`, f.tokenType, f.accessToken)))
-	f.lock.Lock()
-	f.requested = true
-	f.lock.Unlock()
+	`, f.tokenType, f.accessToken, expiresIn)))
 }
 
 func (f *FakeUAA) AuthToken() string {
@@ -1,27 +1,202 @@
 package uaatokenfetcher
 
 import (
-	"github.com/cloudfoundry-incubator/uaago"
-	"log"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/18F/riemann-firehose-nozzle/nozzlelogger"
+)
+
+const (
+	defaultRefreshMargin  = time.Minute
+	defaultMaxRetries     = 3
+	defaultInitialBackoff = 500 * time.Millisecond
+	maxBackoff            = 10 * time.Second
+	requestTimeout        = 30 * time.Second
 )
 
+// UAATokenFetcher obtains tokens from the UAA with the client_credentials
+// grant, using Username and Password as the client id and secret. Tokens are
+// cached and refreshed RefreshMargin before they expire.
 type UAATokenFetcher struct {
 	UaaUrl                string
 	Username              string
 	Password              string
 	InsecureSSLSkipVerify bool
+	TLSConfig             *tls.Config
+	RefreshMargin         time.Duration
+	MaxRetries            uint32
+	Logger                *nozzlelogger.Logger
+
+	lock       sync.Mutex
+	token      Token
+	httpClient *http.Client
 }
 
-func (uaa *UAATokenFetcher) FetchAuthToken() string {
-	uaaClient, err := uaago.NewClient(uaa.UaaUrl)
+// Token is an access token together with the time the UAA says it stops
+// being valid. ExpiresAt is zero when the UAA does not send expires_in.
+type Token struct {
+	Value     string
+	ExpiresAt time.Time
+}
+
+type tokenResponse struct {
+	TokenType   string `json:"token_type"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type statusError struct {
+	statusCode int
+	status     string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("UAA returned HTTP response: %s", e.status)
+}
+
+// FetchAuthToken returns a valid token, fetching a new one if the cached
+// token is missing or about to expire.
+func (uaa *UAATokenFetcher) FetchAuthToken() (string, error) {
+	token, err := uaa.Token()
+	return token.Value, err
+}
+
+// RefreshAuthToken lets the fetcher act as a noaa consumer.TokenRefresher.
+// noaa and the RLP gateway call it after the cached token was refused, so it
+// drops that token and always asks the UAA for a new one.
+func (uaa *UAATokenFetcher) RefreshAuthToken() (string, error) {
+	uaa.lock.Lock()
+	uaa.token = Token{}
+	uaa.lock.Unlock()
+	return uaa.FetchAuthToken()
+}
+
+func (uaa *UAATokenFetcher) Token() (Token, error) {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+
+	if uaa.token.Value != "" && !uaa.token.ExpiresAt.IsZero() && time.Now().Add(uaa.refreshMargin()).Before(uaa.token.ExpiresAt) {
+		return uaa.token, nil
+	}
+
+	token, err := uaa.fetchWithRetry()
 	if err != nil {
-		log.Fatalf("Error creating uaa client: %s", err.Error())
+		return Token{}, err
+	}
+	uaa.token = token
+	return token, nil
+}
+
+func (uaa *UAATokenFetcher) refreshMargin() time.Duration {
+	if uaa.RefreshMargin > 0 {
+		return uaa.RefreshMargin
+	}
+	return defaultRefreshMargin
+}
+
+func (uaa *UAATokenFetcher) fetchWithRetry() (Token, error) {
+	maxRetries := uaa.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
 	}
 
-	var authToken string
-	authToken, err = uaaClient.GetAuthToken(uaa.Username, uaa.Password, uaa.InsecureSSLSkipVerify)
+	backoff := defaultInitialBackoff
+	for attempt := uint32(0); ; attempt++ {
+		token, err := uaa.fetch()
+		if err == nil || !isTransient(err) || attempt >= maxRetries {
+			return token, err
+		}
+
+		uaa.Logger.Warn("Error getting oauth token, retrying", nozzlelogger.Fields{
+			"error":   err.Error(),
+			"attempt": attempt + 1,
+			"backoff": backoff.String(),
+		})
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (uaa *UAATokenFetcher) fetch() (Token, error) {
+	if uaa.UaaUrl == "" {
+		return Token{}, fmt.Errorf("UAA URL is not set")
+	}
+
+	data := url.Values{
+		"client_id":  {uaa.Username},
+		"grant_type": {"client_credentials"},
+	}
+	request, err := http.NewRequest("POST", strings.TrimRight(uaa.UaaUrl, "/")+"/oauth/token", strings.NewReader(data.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	request.SetBasicAuth(uaa.Username, uaa.Password)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	issuedAt := time.Now()
+	response, err := uaa.client().Do(request)
+	if err != nil {
+		return Token{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return Token{}, &statusError{statusCode: response.StatusCode, status: response.Status}
+	}
+
+	var body tokenResponse
+	err = json.NewDecoder(response.Body).Decode(&body)
 	if err != nil {
-		log.Fatalf("Error getting oauth token: %s. Please check your username and password.", err.Error())
+		return Token{}, fmt.Errorf("Can not parse UAA response: %s", err)
+	}
+	if body.AccessToken == "" {
+		return Token{}, fmt.Errorf("UAA response did not contain an access token")
+	}
+
+	token := Token{Value: fmt.Sprintf("%s %s", body.TokenType, body.AccessToken)}
+	if body.ExpiresIn > 0 {
+		token.ExpiresAt = issuedAt.Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+func (uaa *UAATokenFetcher) client() *http.Client {
+	if uaa.httpClient == nil {
+		tlsConfig := uaa.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{InsecureSkipVerify: uaa.InsecureSSLSkipVerify}
+		}
+		uaa.httpClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   requestTimeout,
+		}
+	}
+	return uaa.httpClient
+}
+
+// isTransient reports whether a failed token request is worth retrying:
+// network errors and 5xx responses are, bad credentials are not.
+func isTransient(err error) bool {
+	switch typedErr := err.(type) {
+	case *statusError:
+		return typedErr.statusCode >= 500
+	case *url.Error:
+		return isTransient(typedErr.Err)
+	case net.Error:
+		return true
+	default:
+		return false
 	}
-	return authToken
 }
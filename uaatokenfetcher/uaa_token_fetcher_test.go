@@ -1,9 +1,14 @@
 package uaatokenfetcher_test
 
 import (
-	"github.com/18F/influxdb-firehose-nozzle/uaatokenfetcher"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"time"
 
-	"github.com/18F/influxdb-firehose-nozzle/testhelpers"
+	"github.com/18F/riemann-firehose-nozzle/uaatokenfetcher"
+
+	"github.com/18F/riemann-firehose-nozzle/testhelpers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -23,9 +28,96 @@ var _ = Describe("UaaTokenFetcher", func() {
 		}
 	})
 
+	AfterEach(func() {
+		fakeUAA.Close()
+	})
+
 	It("fetches a token from the UAA", func() {
-		receivedAuthToken := tokenFetcher.FetchAuthToken()
+		receivedAuthToken, err := tokenFetcher.FetchAuthToken()
+		Expect(err).ToNot(HaveOccurred())
 		Expect(fakeUAA.Requested()).To(BeTrue())
 		Expect(receivedAuthToken).To(Equal(fakeToken))
 	})
+
+	It("uses the client_credentials grant", func() {
+		_, err := tokenFetcher.FetchAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fakeUAA.GrantTypes()).To(Equal([]string{"client_credentials"}))
+	})
+
+	It("parses expires_in and reuses the token until it is close to expiring", func() {
+		fakeUAA.SetExpiresIn(3600)
+
+		token, err := tokenFetcher.Token()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token.ExpiresAt).To(BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second))
+
+		_, err = tokenFetcher.FetchAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fakeUAA.Requests()).To(Equal(1))
+	})
+
+	It("refreshes the token ahead of expiry", func() {
+		fakeUAA.SetExpiresIn(30)
+		tokenFetcher.RefreshMargin = time.Minute
+
+		_, err := tokenFetcher.FetchAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = tokenFetcher.FetchAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fakeUAA.Requests()).To(Equal(2))
+	})
+
+	It("fetches a new token on refresh even if the cached one has not expired", func() {
+		fakeUAA.SetExpiresIn(3600)
+
+		_, err := tokenFetcher.FetchAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		receivedAuthToken, err := tokenFetcher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(receivedAuthToken).To(Equal(fakeToken))
+		Expect(fakeUAA.Requests()).To(Equal(2))
+	})
+
+	It("retries transient UAA failures", func() {
+		fakeUAA.FailWith(http.StatusServiceUnavailable)
+
+		receivedAuthToken, err := tokenFetcher.FetchAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(receivedAuthToken).To(Equal(fakeToken))
+		Expect(fakeUAA.Requests()).To(Equal(2))
+	})
+
+	It("returns an error instead of exiting when the credentials are rejected", func() {
+		fakeUAA.FailWith(http.StatusUnauthorized)
+
+		_, err := tokenFetcher.FetchAuthToken()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("401"))
+		Expect(fakeUAA.Requests()).To(Equal(1))
+	})
+
+	Context("when the UAA uses a certificate signed by a custom CA", func() {
+		BeforeEach(func() {
+			fakeUAA.Close()
+			fakeUAA.StartTLS()
+			tokenFetcher.UaaUrl = fakeUAA.URL()
+		})
+
+		It("fails without the CA and does not retry", func() {
+			_, err := tokenFetcher.FetchAuthToken()
+			Expect(err).To(HaveOccurred())
+			Expect(fakeUAA.Requests()).To(Equal(0))
+		})
+
+		It("succeeds when the CA is configured", func() {
+			rootCAs := x509.NewCertPool()
+			Expect(rootCAs.AppendCertsFromPEM([]byte(fakeUAA.CACertPEM()))).To(BeTrue())
+			tokenFetcher.TLSConfig = &tls.Config{RootCAs: rootCAs}
+
+			receivedAuthToken, err := tokenFetcher.FetchAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(receivedAuthToken).To(Equal(fakeToken))
+		})
+	})
 })